@@ -4,10 +4,14 @@ import (
 	"context"
 	"crypto/x509"
 	"encoding/pem"
+	"flag"
 	"net/http"
 	_ "net/http/pprof" // #nosec G108 // we don't use default mux
 	"os"
+	"os/signal"
 	"runtime"
+	"strings"
+	"syscall"
 	"time"
 
 	retryablehttp "github.com/hashicorp/go-retryablehttp"
@@ -30,38 +34,28 @@ func main() {
 	// set log level from config
 	log.SetLevelStr(cfg.Log.Level)
 
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	var pprofServer *http.Server
 	if cfg.EnableHTTPPprof {
+		// default mux serves pprof and expvar handlers
+		pprofServer = &http.Server{
+			Addr:              "localhost:6060",
+			ReadHeaderTimeout: cfg.Server.ReadHeaderTimeout,
+		}
 		go func() {
 			runtime.SetBlockProfileRate(1)
 			log.Info("Starting pprof server on :6060")
-			//nolint:gosec // We use it only for debugging purposes
-			if err := http.ListenAndServe("localhost:6060", nil); err != nil {
+			if err := pprofServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
 				log.Errorf("pprof server error: %v", err)
 			}
 		}()
 	}
 
-	var b *pem.Block
-	b, _ = pem.Decode([]byte(cfg.PrivateKey))
-
-	if cfg.PrivateKeyPath != "" && b == nil {
-		fileContent, err := os.ReadFile(cfg.PrivateKeyPath)
-		if err != nil {
-			log.Fatal("failed open file with pem content")
-		}
-		b, _ = pem.Decode(fileContent)
-	}
-	if b == nil {
-		log.Fatal("failed decode pem format")
-	}
-
-	var privKey interface{}
-	privKey, err = x509.ParsePKCS8PrivateKey(b.Bytes)
+	privKey, err := loadPrivateKey(cfg)
 	if err != nil {
-		privKey, err = x509.ParsePKCS1PrivateKey(b.Bytes)
-		if err != nil {
-			log.Fatal("failed decode private key:", err)
-		}
+		log.Fatal("failed load private key:", err)
 	}
 
 	cryptoService, err := services.NewCryptoService(privKey)
@@ -71,11 +65,10 @@ func main() {
 
 	c := &http.Client{Transport: &retryablehttp.RoundTripper{}}
 
-	redisOpts, err := redis.ParseURL(cfg.Redis.URL)
+	redisClient, err := newRedisClient(cfg.Redis)
 	if err != nil {
-		log.Fatal("failed parse redis url:", err)
+		log.Fatal("failed setup redis client:", err)
 	}
-	redisClient := redis.NewClient(redisOpts)
 	pingTimeout, cancel := context.WithTimeout(context.Background(), time.Second*15)
 	defer cancel()
 	status := redisClient.Ping(pingTimeout)
@@ -87,12 +80,78 @@ func main() {
 	}
 	log.Info("Connected to Redis")
 
-	subscriptionService := services.NewSubscriptionService(
-		cfg.Subscription.MaxConnectionPerUser,
-		cfg.Subscription.ChannelBufferSize,
+	storageCipher, err := setupStorageCipher(cfg, privKey)
+	if err != nil {
+		log.Fatal("failed setup storage encryption:", err)
+	}
+
+	subscriptionService, stopSubscriptionService, err := setupSubscriptionService(cfg, redisClient, storageCipher)
+	if err != nil {
+		log.Fatal("failed setup subscription service:", err)
+	}
+
+	quota := services.Quota{
+		MaxCount: cfg.Quota.MaxCount,
+		MaxBytes: cfg.Quota.MaxBytes,
+		Policy:   services.QuotaPolicy(cfg.Quota.Policy),
+	}
+	if err := quota.Validate(); err != nil {
+		log.Fatal("invalid quota config:", err)
+	}
+
+	eventLog := services.NewEventLog(
+		redisClient,
+		cfg.Redis.KeyPrefix,
+		cfg.Subscription.ReplayLogSize,
+		cfg.Subscription.ReplayLogRetention,
+		services.WithEventLogEncryption(storageCipher),
 	)
 
-	cachingService := services.NewRedisCacheService(redisClient)
+	cachingService := services.NewRedisCacheService(
+		redisClient,
+		services.WithEncryption(storageCipher),
+		services.WithKeyPrefix(cfg.Redis.KeyPrefix),
+		services.WithLegacyKeys(cfg.Redis.LegacyKeys),
+		services.WithQuota(quota),
+		services.WithExpirationEvents(subscriptionService, eventLog),
+	)
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case encryptStorageCmd:
+			runEncryptStorage(cachingService, os.Args[2:])
+			return
+		case migrateCmd:
+			runMigrate(cfg, redisClient, storageCipher, os.Args[2:])
+			return
+		}
+	}
+
+	notificationOpts := []services.NotificationOption{
+		services.WithExpirationBounds(
+			cfg.Redis.MinExpirationDuration,
+			cfg.Redis.MaxExpirationDuration,
+		),
+		services.WithEventLog(eventLog),
+	}
+	handlerOpts := []handlers.PushNotificationHandlerOption{
+		handlers.WithLegacyMessageFormat(cfg.LegacyMessageFormat),
+		handlers.WithEventReplay(eventLog, cfg.Subscription.RetryInterval),
+	}
+	wsOpts := []handlers.WebSocketHandlerOption{}
+	inboxOpts := []services.InboxOption{}
+	if cfg.Subscription.OfflineQueueSize > 0 {
+		offlineQueue := services.NewOfflineQueue(
+			redisClient,
+			cfg.Redis.KeyPrefix,
+			cfg.Subscription.OfflineQueueSize,
+			cfg.Subscription.OfflineQueueTTL,
+		)
+		notificationOpts = append(notificationOpts, services.WithOfflineQueue(offlineQueue))
+		handlerOpts = append(handlerOpts, handlers.WithOfflineQueue(offlineQueue))
+		wsOpts = append(wsOpts, handlers.WithWebSocketOfflineQueue(offlineQueue))
+		inboxOpts = append(inboxOpts, services.WithErasure(offlineQueue))
+	}
+
 	notificationClient := services.NewPushClient(c, cfg.Gateway.Host)
 	notificationService := services.NewNotificationService(
 		notificationClient,
@@ -102,37 +161,286 @@ func main() {
 		cfg.Redis.ExpirationDuration,
 		subscriptionService,
 		cfg.SupportedWebAgents,
+		notificationOpts...,
+	)
+
+	subscribeAuthService := services.NewSubscribeAuth(
+		redisClient,
+		cfg.Redis.KeyPrefix,
+		cfg.SubscribeAuth.TicketTTL,
+		cfg.SubscribeAuth.SessionTTL,
 	)
 
-	authmiddleware, err := setupAuthMiddleware(cfg)
+	inboxOpts = append(inboxOpts,
+		services.WithSyncEvents(subscriptionService, eventLog),
+		services.WithLegacyFormat(cfg.LegacyMessageFormat),
+		services.WithErasure(eventLog, subscribeAuthService),
+	)
+	if s, ok := subscriptionService.(*services.RedisSubscriptionService); ok {
+		inboxOpts = append(inboxOpts, services.WithErasure(s))
+	}
+	inboxService := services.NewInboxService(cachingService, inboxOpts...)
+	idempotencyService := services.NewIdempotencyService(
+		cachingService,
+		cfg.Idempotency.Window,
+		cfg.Idempotency.LockTimeout,
+	)
+
+	authenticator, err := setupAuthenticator(cfg)
 	if err != nil {
 		log.Error("failed to setup auth middleware:", err)
 		return
 	}
+	authmiddleware := authenticator.JWZAuth
 
+	subscribeAuthHandler, err := setupSubscribeAuthHandler(cfg, subscribeAuthService)
+	if err != nil {
+		log.Fatal("invalid subscribe auth config:", err)
+	}
+
+	wsHandler := handlers.NewWebSocketHandler(subscriptionService, inboxService, cfg.Subscription.PingTickerTime,
+		append(wsOpts, handlers.WithReauthentication(authenticator))...)
 	h := rest.NewHandlers(
 		handlers.NewPushNotificationHandler(
 			notificationService,
 			cachingService,
 			subscriptionService,
+			idempotencyService,
 			cfg.Subscription.PingTickerTime,
-			cfg.Redis.ExpirationDuration,
+			handlerOpts...,
 		),
 		handlers.NewKeyHandler(cryptoService),
+		handlers.NewInboxHandler(inboxService),
+		handlers.NewAccountHandler(inboxService, subscriptionService),
+		wsHandler,
+		subscribeAuthHandler,
 		authmiddleware,
+		middleware.SubscribeAuth(authmiddleware, subscribeAuthService, subscribeAuthHandler.CookieName()),
 		cfg.CORS,
 	)
 	r := h.Routes()
 	server := rest.NewServer(r, cfg.Server)
-	err = server.Run(cfg.Server.Port)
-	if errors.Cause(err) == http.ErrServerClosed {
-		log.Info("HTTP server stopped")
-	} else if err != nil {
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- server.Run(cfg.Server.Port)
+	}()
+
+	select {
+	case err = <-serverErr:
 		log.Errorf("HTTP server error: %v", err)
+	case <-ctx.Done():
+		log.Info("Shutting down")
+	}
+	stop()
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.Server.ShutdownTimeout)
+	defer cancel()
+
+	// server waits for in-flight requests, so notifications being sent are saved and pushed.
+	// Streams are never idle, so subscriptions are closed for the server to finish.
+	shutdownErr := make(chan error, 1)
+	go func() {
+		shutdownErr <- server.Close(shutdownCtx)
+	}()
+	closed := subscriptionService.CloseAll(services.CloseReasonServerShutdown)
+	log.Infof("Closed %d subscriptions", closed)
+	if err := <-shutdownErr; err != nil {
+		log.Errorf("failed to stop HTTP server: %v", err)
+	} else {
+		log.Info("HTTP server stopped")
+	}
+	// WebSocket connections are hijacked, the server doesn't wait for them
+	if err := wsHandler.Shutdown(shutdownCtx); err != nil {
+		log.Errorf("failed to close WebSocket connections: %v", err)
+	}
+
+	stopSubscriptionService()
+	if err := redisClient.Close(); err != nil {
+		log.Errorf("failed to close Redis client: %v", err)
+	}
+	if pprofServer != nil {
+		if err := pprofServer.Shutdown(shutdownCtx); err != nil {
+			log.Errorf("failed to stop pprof server: %v", err)
+		}
+	}
+}
+
+// encryptStorageCmd encrypts notifications stored before storage encryption was enabled
+// and re-encrypts values after key rotation.
+const encryptStorageCmd = "encrypt-storage"
+
+func runEncryptStorage(cachingService *services.RedisCache, args []string) {
+	fs := flag.NewFlagSet(encryptStorageCmd, flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "only count values to encrypt")
+	_ = fs.Parse(args)
+
+	stats, err := cachingService.EncryptAll(context.Background(), *dryRun)
+	if err != nil {
+		log.Fatal("failed encrypt storage:", err)
+	}
+	log.Infof("storage encryption finished: scanned %d, encrypted %d, dry run %t",
+		stats.Scanned, stats.Encrypted, *dryRun)
+}
+
+// migrateCmd rewrites notifications stored in legacy format without metadata
+const migrateCmd = "migrate"
+
+func runMigrate(cfg *config.NotificationService, redisClient redis.UniversalClient,
+	storageCipher *services.StorageCipher, args []string) {
+	fs := flag.NewFlagSet(migrateCmd, flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "only count notifications to migrate")
+	batch := fs.Int64("batch", 100, "number of keys scanned per request")
+	rate := fs.Int("rate", 0, "maximal number of notifications migrated per second, 0 disables the limit")
+	_ = fs.Parse(args)
+
+	// legacy notifications are stored under un-namespaced keys
+	cachingService := services.NewRedisCacheService(
+		redisClient,
+		services.WithEncryption(storageCipher),
+		services.WithKeyPrefix(cfg.Redis.KeyPrefix),
+		services.WithLegacyKeys(true),
+	)
+	migrationService := services.NewMigrationService(cachingService, cfg.Redis.ExpirationDuration)
+	stats, err := migrationService.MigrateLegacyFormat(context.Background(), services.MigrationOptions{
+		DryRun:    *dryRun,
+		BatchSize: *batch,
+		Rate:      *rate,
+	})
+	if err != nil {
+		log.Fatal("failed migrate notifications:", err)
+	}
+	log.Infof("migration finished: scanned %d, migrated %d, skipped %d, failed %d, dry run %t",
+		stats.Scanned, stats.Migrated, stats.Skipped, stats.Failed, *dryRun)
+}
+
+// subscriptionService is implemented by local and distributed subscription services
+type subscriptionService interface {
+	Subscribe(userDID string) (<-chan services.NotificationPayload, error)
+	SubscribeWithFilter(userDID string, filter services.SubscriptionFilter) (<-chan services.NotificationPayload, error)
+	Unsubscribe(userDID string, ch <-chan services.NotificationPayload)
+	Notify(userDID string, payload services.NotificationPayload) bool
+	UnsubscribeAll(userDID string) int
+	CloseAll(reason string) int
+	CloseReason(userDID string, ch <-chan services.NotificationPayload) string
+}
+
+// setupSubscriptionService creates subscription service and a function which stops its background work
+func setupSubscriptionService(cfg *config.NotificationService, redisClient redis.UniversalClient,
+	storageCipher *services.StorageCipher) (subscriptionService, func(), error) {
+	policy := services.SlowConsumerPolicy(cfg.Subscription.SlowConsumerPolicy)
+	if err := policy.Validate(); err != nil {
+		return nil, nil, err
+	}
+
+	if !cfg.Subscription.Distributed {
+		return services.NewSubscriptionService(
+			cfg.Subscription.MaxConnectionPerUser,
+			cfg.Subscription.ChannelBufferSize,
+			services.WithSlowConsumerPolicy(policy),
+		), func() {}, nil
+	}
+
+	s := services.NewRedisSubscriptionService(
+		redisClient,
+		cfg.Redis.KeyPrefix,
+		cfg.Subscription.MaxConnectionPerUser,
+		cfg.Subscription.ChannelBufferSize,
+		cfg.Subscription.LeaseTTL,
+		services.WithSlowConsumerPolicy(policy),
+		services.WithSubscriptionEncryption(storageCipher),
+	)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		s.Run(ctx)
+		close(done)
+	}()
+	return s, func() {
+		cancel()
+		<-done
+	}, nil
+}
+
+func loadPrivateKey(cfg *config.NotificationService) (interface{}, error) {
+	var b *pem.Block
+	b, _ = pem.Decode([]byte(cfg.PrivateKey))
+
+	if cfg.PrivateKeyPath != "" && b == nil {
+		fileContent, err := os.ReadFile(cfg.PrivateKeyPath)
+		if err != nil {
+			return nil, errors.New("failed open file with pem content")
+		}
+		b, _ = pem.Decode(fileContent)
+	}
+	if b == nil {
+		return nil, errors.New("failed decode pem format")
+	}
+
+	privKey, err := x509.ParsePKCS8PrivateKey(b.Bytes)
+	if err != nil {
+		return x509.ParsePKCS1PrivateKey(b.Bytes)
+	}
+	return privKey, nil
+}
+
+func setupStorageCipher(cfg *config.NotificationService, privKey interface{}) (*services.StorageCipher, error) {
+	if !cfg.StorageEncryption.Enabled {
+		return nil, nil
+	}
+
+	if len(cfg.StorageEncryption.Keys) == 0 {
+		key, err := services.DeriveStorageKey(privKey)
+		if err != nil {
+			return nil, err
+		}
+		return services.NewStorageCipher(services.DerivedStorageKeyID,
+			map[string][]byte{services.DerivedStorageKeyID: key})
+	}
+
+	keys, err := services.ParseStorageKeys(cfg.StorageEncryption.Keys)
+	if err != nil {
+		return nil, err
+	}
+	return services.NewStorageCipher(cfg.StorageEncryption.ActiveKeyID, keys)
+}
+
+// setupSubscribeAuthHandler enables session cookies if configured. Credentialed requests
+// from any origin could read streams of the user, so origins have to be listed explicitly.
+func setupSubscribeAuthHandler(cfg *config.NotificationService,
+	s *services.SubscribeAuth) (*handlers.SubscribeAuthHandler, error) {
+	if cfg.CORS.AllowCredentials {
+		for _, origin := range cfg.CORS.AllowedOrigins {
+			if strings.Contains(origin, "*") {
+				return nil, errors.Errorf("wildcard origin '%s' isn't allowed with CORS credentials", origin)
+			}
+		}
+	}
+	if !cfg.SubscribeAuth.SessionEnabled {
+		return handlers.NewSubscribeAuthHandler(s), nil
+	}
+
+	var sameSite http.SameSite
+	switch strings.ToLower(cfg.SubscribeAuth.CookieSameSite) {
+	case "strict":
+		sameSite = http.SameSiteStrictMode
+	case "lax":
+		sameSite = http.SameSiteLaxMode
+	case "none":
+		sameSite = http.SameSiteNoneMode
+	default:
+		return nil, errors.Errorf("unknown cookie SameSite mode '%s'", cfg.SubscribeAuth.CookieSameSite)
+	}
+	if !cfg.CORS.AllowCredentials {
+		log.Warn("session cookies are enabled without CORS credentials, only same-origin clients can use them")
 	}
+	return handlers.NewSubscribeAuthHandler(s, handlers.WithSessionCookie(
+		cfg.SubscribeAuth.CookieName,
+		cfg.SubscribeAuth.CookieDomain,
+		sameSite,
+	)), nil
 }
 
-func setupAuthMiddleware(cfg *config.NotificationService) (func(http.Handler) http.Handler, error) {
+func setupAuthenticator(cfg *config.NotificationService) (*middleware.JWZAuthenticator, error) {
 	stateResolvers, err := cfg.GetStateResolvers()
 	if err != nil {
 		return nil, err
@@ -144,6 +452,6 @@ func setupAuthMiddleware(cfg *config.NotificationService) (func(http.Handler) ht
 		middleware.WithJWZGenerationDelay(cfg.AuthenticationMiddleware.JWZGenerationDelay),
 	}
 
-	return middleware.NewJWZAuthMiddleware(stateResolvers,
+	return middleware.NewJWZAuthenticator(stateResolvers,
 		cfg.AuthenticationMiddleware.VerifierDID, opts...)
 }
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"os"
+
+	"github.com/iden3/notification-service/config"
+	"github.com/pkg/errors"
+	"github.com/redis/go-redis/v9"
+)
+
+// newRedisClient creates standalone, sentinel or cluster client.
+// Sentinel is used when master name is set, cluster when cluster mode is enabled.
+func newRedisClient(cfg config.Redis) (redis.UniversalClient, error) {
+	opts := &redis.UniversalOptions{
+		Addrs:            cfg.Addresses,
+		MasterName:       cfg.SentinelMasterName,
+		SentinelPassword: cfg.SentinelPassword,
+		IsClusterMode:    cfg.Cluster,
+		PoolSize:         cfg.PoolSize,
+		MinIdleConns:     cfg.MinIdleConns,
+		PoolTimeout:      cfg.PoolTimeout,
+		DialTimeout:      cfg.DialTimeout,
+		ReadTimeout:      cfg.ReadTimeout,
+		WriteTimeout:     cfg.WriteTimeout,
+	}
+
+	if cfg.URL != "" {
+		urlOpts, err := redis.ParseURL(cfg.URL)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed parse redis url")
+		}
+		if len(opts.Addrs) == 0 {
+			opts.Addrs = []string{urlOpts.Addr}
+		}
+		opts.Username = urlOpts.Username
+		opts.Password = urlOpts.Password
+		opts.DB = urlOpts.DB
+		opts.TLSConfig = urlOpts.TLSConfig
+	}
+	if len(opts.Addrs) == 0 {
+		return nil, errors.New("redis url or addresses are required")
+	}
+	if opts.IsClusterMode && opts.MasterName != "" {
+		return nil, errors.New("redis cluster mode can't be used with sentinel master name")
+	}
+	if opts.IsClusterMode && opts.DB != 0 {
+		return nil, errors.New("redis cluster supports only database 0")
+	}
+
+	if cfg.TLS.Enabled || cfg.TLS.CAFile != "" {
+		if opts.TLSConfig == nil {
+			opts.TLSConfig = &tls.Config{MinVersion: tls.VersionTLS12}
+		}
+		if cfg.TLS.ServerName != "" {
+			opts.TLSConfig.ServerName = cfg.TLS.ServerName
+		}
+		if cfg.TLS.CAFile != "" {
+			pem, err := os.ReadFile(cfg.TLS.CAFile)
+			if err != nil {
+				return nil, errors.Wrap(err, "failed read redis CA file")
+			}
+			pool := x509.NewCertPool()
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, errors.New("no certificates found in redis CA file")
+			}
+			opts.TLSConfig.RootCAs = pool
+		}
+	}
+
+	return redis.NewUniversalClient(opts), nil
+}
@@ -22,6 +22,11 @@ type NotificationService struct {
 	ResolversSettingsPath    string                   `envconfig:"RESOLVERS_SETTINGS_PATH" default:"./resolvers.settings.yaml"`
 	AuthenticationMiddleware AuthenticationMiddleware `envconfig:"AUTH_MIDDLEWARE"`
 	Subscription             Subscription             `envconfig:"SUBSCRIPTION"`
+	SubscribeAuth            SubscribeAuth            `envconfig:"SUBSCRIBE_AUTH"`
+	Idempotency              Idempotency              `envconfig:"IDEMPOTENCY"`
+	StorageEncryption        StorageEncryption        `envconfig:"STORAGE_ENCRYPTION"`
+	Quota                    Quota                    `envconfig:"QUOTA"`
+	LegacyMessageFormat      bool                     `envconfig:"LEGACY_MESSAGE_FORMAT" default:"true"`
 	EnableHTTPPprof          bool                     `envconfig:"ENABLE_HTTP_PPROF" default:"false"`
 	SupportedWebAgents       []string                 `envconfig:"SUPPORTED_WEB_AGENTS"`
 }
@@ -31,6 +36,8 @@ type CORS struct {
 	AllowedOrigins []string `envconfig:"ALLOWED_ORIGINS" default:"https://*,http://*"`
 	AllowedHeaders []string `envconfig:"ALLOWED_HEADERS" default:"Accept,Authorization,Content-Type,X-CSRF-Token"`
 	MaxAge         int      `envconfig:"MAX_AGE" default:"300"`
+	// AllowCredentials allows cross-origin requests with cookies, origins must be listed explicitly
+	AllowCredentials bool `envconfig:"ALLOW_CREDENTIALS" default:"false"`
 }
 
 func (n *NotificationService) GetStateResolvers() (map[string]pubsignals.StateResolver, error) {
@@ -82,6 +89,8 @@ type Server struct {
 	ReadTimeout       time.Duration `envconfig:"READ_TIMEOUT" default:"15s"`
 	IdleTimeout       time.Duration `envconfig:"IDLE_TIMEOUT" default:"120s"`
 	MaxHeaderBytes    int           `envconfig:"MAX_HEADER_BYTES" default:"1048576"`
+	// ShutdownTimeout is how long in-flight requests are awaited on shutdown
+	ShutdownTimeout time.Duration `envconfig:"SHUTDOWN_TIMEOUT" default:"30s"`
 }
 
 // Gateway is public gateway config
@@ -91,8 +100,37 @@ type Gateway struct {
 
 // Redis config for Redis.
 type Redis struct {
-	URL                string        `envconfig:"REDIS_URL" required:"true"`
+	// URL of standalone Redis, also credentials, DB and TLS (rediss://) for sentinel and cluster modes
+	URL string `envconfig:"REDIS_URL"`
+	// Addresses of sentinels or cluster nodes, used instead of URL host
+	Addresses          []string `envconfig:"ADDRESSES"`
+	SentinelMasterName string   `envconfig:"SENTINEL_MASTER_NAME"`
+	SentinelPassword   string   `envconfig:"SENTINEL_PASSWORD"`
+	Cluster            bool     `envconfig:"CLUSTER" default:"false"`
+	TLS                RedisTLS `envconfig:"TLS"`
+	// Pool and timeout settings, zero values use go-redis defaults
+	PoolSize           int           `envconfig:"POOL_SIZE"`
+	MinIdleConns       int           `envconfig:"MIN_IDLE_CONNS"`
+	PoolTimeout        time.Duration `envconfig:"POOL_TIMEOUT"`
+	DialTimeout        time.Duration `envconfig:"DIAL_TIMEOUT"`
+	ReadTimeout        time.Duration `envconfig:"READ_TIMEOUT"`
+	WriteTimeout       time.Duration `envconfig:"WRITE_TIMEOUT"`
 	ExpirationDuration time.Duration `envconfig:"EXPIRATION_DURATION" default:"24h"`
+	// KeyPrefix is namespace of keys, so Redis database can be shared with other services
+	KeyPrefix string `envconfig:"KEY_PREFIX" default:"notification-service"`
+	// LegacyKeys enables reads of un-namespaced keys. Disable when they are expired.
+	LegacyKeys bool `envconfig:"LEGACY_KEYS" default:"true"`
+	// Bounds of notification lifetime requested by sender
+	MinExpirationDuration time.Duration `envconfig:"MIN_EXPIRATION_DURATION" default:"1m"`
+	MaxExpirationDuration time.Duration `envconfig:"MAX_EXPIRATION_DURATION" default:"168h"`
+}
+
+// RedisTLS is TLS config of Redis connection
+type RedisTLS struct {
+	Enabled bool `envconfig:"ENABLED" default:"false"`
+	// CAFile is path to PEM encoded CA certificates of Redis servers
+	CAFile     string `envconfig:"CA_FILE"`
+	ServerName string `envconfig:"SERVER_NAME"`
 }
 
 // AuthenticationMiddleware is config for auth middleware
@@ -107,4 +145,61 @@ type Subscription struct {
 	PingTickerTime       time.Duration `envconfig:"PING_TICKER_TIME" default:"10s"`
 	MaxConnectionPerUser int           `envconfig:"MAX_CONNECTION_PER_USER" default:"10"`
 	ChannelBufferSize    int           `envconfig:"CHANNEL_BUFFER_SIZE" default:"10"`
+	// Distributed delivers notifications to subscriptions open on other replicas through Redis
+	Distributed bool `envconfig:"DISTRIBUTED" default:"false"`
+	// LeaseTTL is how long subscriptions of a crashed replica are counted in the connection limit
+	LeaseTTL time.Duration `envconfig:"LEASE_TTL" default:"30s"`
+	// SlowConsumerPolicy is applied when buffer of subscription is full:
+	// drop_newest, drop_oldest, disconnect or coalesce
+	SlowConsumerPolicy string `envconfig:"SLOW_CONSUMER_POLICY" default:"drop_newest"`
+	// RetryInterval is sent to SSE clients as reconnection delay
+	RetryInterval time.Duration `envconfig:"RETRY_INTERVAL" default:"3s"`
+	// ReplayLogSize is a number of latest events per user replayed after reconnect
+	ReplayLogSize int64 `envconfig:"REPLAY_LOG_SIZE" default:"100"`
+	// ReplayLogRetention is how long events are kept for replay
+	ReplayLogRetention time.Duration `envconfig:"REPLAY_LOG_RETENTION" default:"1h"`
+	// OfflineQueueSize is a number of latest notifications queued for web agents without
+	// open subscriptions, 0 disables the queue
+	OfflineQueueSize int64 `envconfig:"OFFLINE_QUEUE_SIZE" default:"100"`
+	// OfflineQueueTTL is how long the queue is kept after the last queued notification
+	OfflineQueueTTL time.Duration `envconfig:"OFFLINE_QUEUE_TTL" default:"24h"`
+}
+
+// SubscribeAuth holds configuration of subscription credentials for browser EventSource
+type SubscribeAuth struct {
+	// TicketTTL is how long a single-use subscribe ticket is valid
+	TicketTTL time.Duration `envconfig:"TICKET_TTL" default:"30s"`
+	// SessionEnabled enables sessions in HttpOnly cookie
+	SessionEnabled bool          `envconfig:"SESSION_ENABLED" default:"false"`
+	SessionTTL     time.Duration `envconfig:"SESSION_TTL" default:"24h"`
+	CookieName     string        `envconfig:"COOKIE_NAME" default:"subscribe_session"`
+	CookieDomain   string        `envconfig:"COOKIE_DOMAIN"`
+	// CookieSameSite is SameSite mode of the cookie: strict, lax or none
+	CookieSameSite string `envconfig:"COOKIE_SAME_SITE" default:"none"`
+}
+
+// Idempotency is config for deduplication of sender retries
+type Idempotency struct {
+	// Window is how long the first response is stored and replayed
+	Window time.Duration `envconfig:"WINDOW" default:"24h"`
+	// LockTimeout is how long concurrent duplicates wait for the first request
+	LockTimeout time.Duration `envconfig:"LOCK_TIMEOUT" default:"30s"`
+}
+
+// Quota is config of per-user inbox limits. Zero value disables the limit.
+type Quota struct {
+	MaxCount int64 `envconfig:"MAX_COUNT" default:"0"`
+	MaxBytes int64 `envconfig:"MAX_BYTES" default:"0"`
+	// Policy is 'evict' to remove the oldest notifications or 'reject' to reject the new one
+	Policy string `envconfig:"POLICY" default:"evict"`
+}
+
+// StorageEncryption is config for encryption of stored notifications
+type StorageEncryption struct {
+	Enabled bool `envconfig:"ENABLED" default:"false"`
+	// Keys is a list of key encryption keys in 'id:base64 key' format.
+	// Key derived from PRIVATE_KEY is used if keys aren't set.
+	Keys []string `envconfig:"KEYS"`
+	// ActiveKeyID is ID of the key that encrypts new values
+	ActiveKeyID string `envconfig:"ACTIVE_KEY_ID"`
 }
@@ -0,0 +1,128 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/go-chi/render"
+	"github.com/iden3/notification-service/log"
+	"github.com/iden3/notification-service/rest/middleware"
+	"github.com/iden3/notification-service/rest/utils"
+)
+
+// AccountHandler is a handler for export and erasure of data of authenticated user
+type AccountHandler struct {
+	inboxService        accountInboxService
+	subscriptionService accountSubscriptionService
+}
+
+type accountInboxService interface {
+	Export(ctx context.Context, uniqueID string, w io.Writer) (int, error)
+	Erase(ctx context.Context, uniqueID string) (int64, error)
+}
+
+type accountSubscriptionService interface {
+	UnsubscribeAll(userDID string) int
+}
+
+// NewAccountHandler creates new handler for user data export and erasure
+func NewAccountHandler(s accountInboxService, sub accountSubscriptionService) *AccountHandler {
+	return &AccountHandler{
+		inboxService:        s,
+		subscriptionService: sub,
+	}
+}
+
+// Export streams all notifications of authenticated user with metadata as NDJSON
+func (h *AccountHandler) Export(w http.ResponseWriter, r *http.Request) {
+	d, ok := middleware.GetDIDFromContext(r.Context())
+	if !ok || d.String() == "" {
+		utils.ErrorJSON(w, r, http.StatusBadRequest, errors.New("no uniqueID in context"), "can't get uniqueID from context", 0)
+		return
+	}
+	uniqueID := d.String()
+
+	// notifications are loaded before the first write, so the status is sent
+	// only when the export can be started
+	ew := &exportWriter{ResponseWriter: w}
+	exported, err := h.inboxService.Export(r.Context(), uniqueID, ew)
+	audit(r, "export", uniqueID, err, "notifications", exported)
+	switch {
+	case err != nil && !ew.started:
+		utils.ErrorJSON(w, r, http.StatusInternalServerError, err, "failed to export user data", 0)
+	case err != nil:
+		// the status is already sent, the trailing record tells the client the export is incomplete
+		_ = json.NewEncoder(w).Encode(struct {
+			Error string `json:"error"`
+		}{
+			Error: "export is incomplete",
+		})
+	default:
+		ew.start()
+	}
+}
+
+// exportWriter sends export headers with the first write
+type exportWriter struct {
+	http.ResponseWriter
+	started bool
+}
+
+func (w *exportWriter) start() {
+	if w.started {
+		return
+	}
+	w.started = true
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Content-Disposition", `attachment; filename="export.ndjson"`)
+	w.WriteHeader(http.StatusOK)
+}
+
+func (w *exportWriter) Write(p []byte) (int, error) {
+	w.start()
+	return w.ResponseWriter.Write(p)
+}
+
+// Erase removes all notifications, indexes and open subscriptions of authenticated user
+func (h *AccountHandler) Erase(w http.ResponseWriter, r *http.Request) {
+	d, ok := middleware.GetDIDFromContext(r.Context())
+	if !ok || d.String() == "" {
+		utils.ErrorJSON(w, r, http.StatusBadRequest, errors.New("no uniqueID in context"), "can't get uniqueID from context", 0)
+		return
+	}
+	uniqueID := d.String()
+
+	deleted, err := h.inboxService.Erase(r.Context(), uniqueID)
+	if err != nil {
+		audit(r, "erase", uniqueID, err)
+		utils.ErrorJSON(w, r, http.StatusInternalServerError, err, "failed to erase user data", 0)
+		return
+	}
+	closed := h.subscriptionService.UnsubscribeAll(uniqueID)
+	audit(r, "erase", uniqueID, nil, "notifications", deleted, "subscriptions", closed)
+
+	render.Status(r, http.StatusOK)
+	render.JSON(w, r, struct {
+		Deleted int64 `json:"deleted"`
+	}{
+		Deleted: deleted,
+	})
+}
+
+// audit writes audit log record of operation with user data
+func audit(r *http.Request, action, uniqueID string, err error, kv ...interface{}) {
+	kv = append([]interface{}{
+		"audit", true,
+		"action", action,
+		"unique_id", uniqueID,
+		"remote_addr", r.RemoteAddr,
+	}, kv...)
+	if err != nil {
+		log.WithContext(r.Context()).Errorw("user data operation failed", append(kv, "error", err.Error())...)
+		return
+	}
+	log.WithContext(r.Context()).Infow("user data operation", kv...)
+}
@@ -0,0 +1,80 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/iden3/go-iden3-core/v2/w3c"
+	"github.com/iden3/notification-service/rest/middleware"
+	"github.com/stretchr/testify/require"
+)
+
+const testDID = "did:iden3:polygon:amoy:x7Z95VkUuyo6mqraJw2VGwCfqTzdqhM1RVjRHzcpK"
+
+type accountInboxMock struct {
+	export func(w io.Writer) (int, error)
+}
+
+func (m accountInboxMock) Export(_ context.Context, _ string, w io.Writer) (int, error) {
+	return m.export(w)
+}
+
+func (m accountInboxMock) Erase(_ context.Context, _ string) (int64, error) {
+	return 0, nil
+}
+
+type accountSubscriptionMock struct{}
+
+func (accountSubscriptionMock) UnsubscribeAll(_ string) int {
+	return 0
+}
+
+func exportRequest(t *testing.T, inbox accountInboxMock) *httptest.ResponseRecorder {
+	t.Helper()
+	did, err := w3c.ParseDID(testDID)
+	require.NoError(t, err)
+	r := httptest.NewRequest(http.MethodGet, "/api/v2/account/export", nil)
+	r = r.WithContext(middleware.WithDIDContext(r.Context(), *did))
+	w := httptest.NewRecorder()
+	NewAccountHandler(inbox, accountSubscriptionMock{}).Export(w, r)
+	return w
+}
+
+func TestAccountHandler_Export(t *testing.T) {
+	w := exportRequest(t, accountInboxMock{export: func(w io.Writer) (int, error) {
+		_, err := io.WriteString(w, "{\"id\":\"a\"}\n")
+		return 1, err
+	}})
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "application/x-ndjson", w.Header().Get("Content-Type"))
+	require.Equal(t, "{\"id\":\"a\"}\n", w.Body.String())
+
+	// empty export still sends the headers
+	w = exportRequest(t, accountInboxMock{export: func(_ io.Writer) (int, error) {
+		return 0, nil
+	}})
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "application/x-ndjson", w.Header().Get("Content-Type"))
+	require.Empty(t, w.Body.String())
+}
+
+func TestAccountHandler_Export_Failed(t *testing.T) {
+	// nothing is sent before notifications are loaded
+	w := exportRequest(t, accountInboxMock{export: func(_ io.Writer) (int, error) {
+		return 0, errors.New("redis is down")
+	}})
+	require.Equal(t, http.StatusInternalServerError, w.Code)
+	require.Empty(t, w.Header().Get("Content-Disposition"))
+
+	// failure after the status is sent ends the stream with an error record
+	w = exportRequest(t, accountInboxMock{export: func(w io.Writer) (int, error) {
+		_, _ = io.WriteString(w, "{\"id\":\"a\"}\n")
+		return 1, errors.New("failed to encode")
+	}})
+	require.Equal(t, http.StatusOK, w.Code)
+	require.Equal(t, "{\"id\":\"a\"}\n{\"error\":\"export is incomplete\"}\n", w.Body.String())
+}
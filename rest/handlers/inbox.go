@@ -0,0 +1,323 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/render"
+	"github.com/iden3/notification-service/rest/middleware"
+	"github.com/iden3/notification-service/rest/utils"
+	"github.com/iden3/notification-service/services"
+)
+
+const (
+	defaultInboxLimit = 50
+	maxInboxLimit     = 100
+)
+
+// InboxHandler is a handler for inbox of authenticated user
+type InboxHandler struct {
+	inboxService inboxService
+}
+
+type inboxService interface {
+	List(ctx context.Context, uniqueID string, q services.InboxQuery) (services.InboxPage, error)
+	Delete(ctx context.Context, uniqueID, id string) error
+	DeleteAll(ctx context.Context, uniqueID string, f services.InboxDeleteFilter) (int64, error)
+	Ack(ctx context.Context, requesterID, id string) error
+	MarkAsRead(ctx context.Context, uniqueID string, req services.InboxReadRequest) (int64, error)
+	Counts(ctx context.Context, uniqueID string) (services.InboxCounts, error)
+	Usage(ctx context.Context, uniqueID string) (services.InboxUsage, error)
+}
+
+// NewInboxHandler creates new handler for inbox queries
+func NewInboxHandler(s inboxService) *InboxHandler {
+	return &InboxHandler{inboxService: s}
+}
+
+// List returns page of notifications of authenticated user
+func (h *InboxHandler) List(w http.ResponseWriter, r *http.Request) {
+	d, ok := middleware.GetDIDFromContext(r.Context())
+	if !ok || d.String() == "" {
+		utils.ErrorJSON(w, r, http.StatusBadRequest, errors.New("no uniqueID in context"), "can't get uniqueID from context", 0)
+		return
+	}
+
+	q, err := parseInboxQuery(r)
+	if err != nil {
+		utils.ErrorJSON(w, r, http.StatusBadRequest, err, "invalid query", 0)
+		return
+	}
+
+	page, err := h.inboxService.List(r.Context(), d.String(), q)
+	if errors.Is(err, services.ErrInvalidCursor) {
+		utils.ErrorJSON(w, r, http.StatusBadRequest, err, "invalid query", 0)
+		return
+	} else if err != nil {
+		utils.ErrorJSON(w, r, http.StatusInternalServerError, err, "failed to get notifications", 0)
+		return
+	}
+
+	render.Status(r, http.StatusOK)
+	render.JSON(w, r, page)
+}
+
+// Delete removes notification of authenticated user
+func (h *InboxHandler) Delete(w http.ResponseWriter, r *http.Request) {
+	d, ok := middleware.GetDIDFromContext(r.Context())
+	if !ok || d.String() == "" {
+		utils.ErrorJSON(w, r, http.StatusBadRequest, errors.New("no uniqueID in context"), "can't get uniqueID from context", 0)
+		return
+	}
+	idParam := chi.URLParam(r, "id")
+	if idParam == "" {
+		utils.ErrorJSON(w, r, http.StatusBadRequest, errors.New("no id param"), "can't get notification id param", 0)
+		return
+	}
+
+	err := h.inboxService.Delete(r.Context(), d.String(), idParam)
+	switch {
+	case errors.Is(err, services.ErrNotificationNotOwned):
+		utils.ErrorJSON(w, r, http.StatusForbidden, err, "forbidden", 0)
+		return
+	case errors.Is(err, services.ErrNotificationNotFound):
+		utils.ErrorJSON(w, r, http.StatusNotFound, err, "expired", 0)
+		return
+	case err != nil:
+		utils.ErrorJSON(w, r, http.StatusInternalServerError, err, "failed to delete notification", 0)
+		return
+	}
+
+	render.Status(r, http.StatusOK)
+	render.JSON(w, r, struct {
+		Success bool `json:"success"`
+	}{
+		Success: true,
+	})
+}
+
+// DeleteAll removes notifications of authenticated user.
+// Notifications can be filtered by read status and creation time.
+func (h *InboxHandler) DeleteAll(w http.ResponseWriter, r *http.Request) {
+	d, ok := middleware.GetDIDFromContext(r.Context())
+	if !ok || d.String() == "" {
+		utils.ErrorJSON(w, r, http.StatusBadRequest, errors.New("no uniqueID in context"), "can't get uniqueID from context", 0)
+		return
+	}
+
+	f, err := parseInboxDeleteFilter(r)
+	if err != nil {
+		utils.ErrorJSON(w, r, http.StatusBadRequest, err, "invalid query", 0)
+		return
+	}
+
+	deleted, err := h.inboxService.DeleteAll(r.Context(), d.String(), f)
+	if err != nil {
+		utils.ErrorJSON(w, r, http.StatusInternalServerError, err, "failed to delete notifications", 0)
+		return
+	}
+
+	render.Status(r, http.StatusOK)
+	render.JSON(w, r, struct {
+		Deleted int64 `json:"deleted"`
+	}{
+		Deleted: deleted,
+	})
+}
+
+// Ack marks a message as read.
+// Messages stored for uniqueID can be acknowledged only by authenticated owner.
+func (h *InboxHandler) Ack(w http.ResponseWriter, r *http.Request) {
+	idParam := chi.URLParam(r, "id")
+	if idParam == "" {
+		utils.ErrorJSON(w, r, http.StatusBadRequest, errors.New("no id param"), "can't get notification id param", 0)
+		return
+	}
+
+	var requesterID string
+	if d, ok := middleware.GetDIDFromContext(r.Context()); ok {
+		requesterID = d.String()
+	}
+
+	err := h.inboxService.Ack(r.Context(), requesterID, idParam)
+	switch {
+	case errors.Is(err, services.ErrNotificationNotOwned) && requesterID == "":
+		utils.ErrorJSON(w, r, http.StatusUnauthorized, err, "authentication required", 0)
+		return
+	case errors.Is(err, services.ErrNotificationNotOwned):
+		utils.ErrorJSON(w, r, http.StatusForbidden, err, "forbidden", 0)
+		return
+	case errors.Is(err, services.ErrNotificationNotFound):
+		utils.ErrorJSON(w, r, http.StatusNotFound, err, "expired", 0)
+		return
+	case errors.Is(err, services.ErrLegacyNotification):
+		utils.ErrorJSON(w, r, http.StatusUnprocessableEntity, err, "notification without metadata can't be acknowledged", 0)
+		return
+	case err != nil:
+		utils.ErrorJSON(w, r, http.StatusInternalServerError, err, "failed to update notification", 0)
+		return
+	}
+
+	render.Status(r, http.StatusOK)
+	render.JSON(w, r, struct {
+		Success bool `json:"success"`
+	}{
+		Success: true,
+	})
+}
+
+// MarkAsRead marks notifications of authenticated user as read
+func (h *InboxHandler) MarkAsRead(w http.ResponseWriter, r *http.Request) {
+	d, ok := middleware.GetDIDFromContext(r.Context())
+	if !ok || d.String() == "" {
+		utils.ErrorJSON(w, r, http.StatusBadRequest, errors.New("no uniqueID in context"), "can't get uniqueID from context", 0)
+		return
+	}
+
+	var req services.InboxReadRequest
+	if err := render.DecodeJSON(r.Body, &req); err != nil {
+		utils.ErrorJSON(w, r, http.StatusBadRequest, err, "can't bind request", 0)
+		return
+	}
+	if err := req.Validate(); err != nil {
+		utils.ErrorJSON(w, r, http.StatusBadRequest, err, "invalid request", 0)
+		return
+	}
+
+	updated, err := h.inboxService.MarkAsRead(r.Context(), d.String(), req)
+	if errors.Is(err, services.ErrNotificationNotOwned) {
+		utils.ErrorJSON(w, r, http.StatusForbidden, err, "forbidden", 0)
+		return
+	} else if err != nil {
+		utils.ErrorJSON(w, r, http.StatusInternalServerError, err, "failed to update notifications", 0)
+		return
+	}
+
+	render.Status(r, http.StatusOK)
+	render.JSON(w, r, struct {
+		Updated int64 `json:"updated"`
+	}{
+		Updated: updated,
+	})
+}
+
+// Counts returns number of all and unread notifications of authenticated user
+func (h *InboxHandler) Counts(w http.ResponseWriter, r *http.Request) {
+	d, ok := middleware.GetDIDFromContext(r.Context())
+	if !ok || d.String() == "" {
+		utils.ErrorJSON(w, r, http.StatusBadRequest, errors.New("no uniqueID in context"), "can't get uniqueID from context", 0)
+		return
+	}
+
+	counts, err := h.inboxService.Counts(r.Context(), d.String())
+	if err != nil {
+		utils.ErrorJSON(w, r, http.StatusInternalServerError, err, "failed to get counts", 0)
+		return
+	}
+
+	render.Status(r, http.StatusOK)
+	render.JSON(w, r, counts)
+}
+
+// Usage returns number and total size of stored notifications of authenticated user with the quota limits
+func (h *InboxHandler) Usage(w http.ResponseWriter, r *http.Request) {
+	d, ok := middleware.GetDIDFromContext(r.Context())
+	if !ok || d.String() == "" {
+		utils.ErrorJSON(w, r, http.StatusBadRequest, errors.New("no uniqueID in context"), "can't get uniqueID from context", 0)
+		return
+	}
+
+	usage, err := h.inboxService.Usage(r.Context(), d.String())
+	if err != nil {
+		utils.ErrorJSON(w, r, http.StatusInternalServerError, err, "failed to get usage", 0)
+		return
+	}
+
+	render.Status(r, http.StatusOK)
+	render.JSON(w, r, usage)
+}
+
+func parseInboxDeleteFilter(r *http.Request) (services.InboxDeleteFilter, error) {
+	params := r.URL.Query()
+	var f services.InboxDeleteFilter
+
+	if v := params.Get("read"); v != "" {
+		isRead, err := strconv.ParseBool(v)
+		if err != nil {
+			return services.InboxDeleteFilter{}, errors.New("read must be a boolean")
+		}
+		f.IsRead = &isRead
+	}
+
+	var err error
+	if f.Before, err = parseTimeParam(params.Get("before")); err != nil {
+		return services.InboxDeleteFilter{}, fmt.Errorf("before: %w", err)
+	}
+	return f, nil
+}
+
+func parseInboxQuery(r *http.Request) (services.InboxQuery, error) {
+	return parseInboxParams(r.URL.Query())
+}
+
+// parseInboxParams parses inbox query parameters, see InboxHandler.List
+func parseInboxParams(params url.Values) (services.InboxQuery, error) {
+	q := services.InboxQuery{
+		Limit:  defaultInboxLimit,
+		Cursor: params.Get("cursor"),
+		Order:  services.SortOrderDesc,
+	}
+
+	if v := params.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 || limit > maxInboxLimit {
+			return services.InboxQuery{}, fmt.Errorf("limit must be a number between 1 and %d", maxInboxLimit)
+		}
+		q.Limit = limit
+	}
+
+	if v := params.Get("unread"); v != "" {
+		unread, err := strconv.ParseBool(v)
+		if err != nil {
+			return services.InboxQuery{}, errors.New("unread must be a boolean")
+		}
+		q.UnreadOnly = unread
+	}
+
+	var err error
+	if q.Since, err = parseTimeParam(params.Get("since")); err != nil {
+		return services.InboxQuery{}, fmt.Errorf("since: %w", err)
+	}
+	if q.Until, err = parseTimeParam(params.Get("until")); err != nil {
+		return services.InboxQuery{}, fmt.Errorf("until: %w", err)
+	}
+
+	switch order := services.SortOrder(params.Get("sort")); order {
+	case "":
+	case services.SortOrderAsc, services.SortOrderDesc:
+		q.Order = order
+	default:
+		return services.InboxQuery{}, fmt.Errorf("sort must be '%s' or '%s'",
+			services.SortOrderAsc, services.SortOrderDesc)
+	}
+
+	return q, nil
+}
+
+// parseTimeParam parses RFC3339 time. Empty value returns zero time.
+func parseTimeParam(v string) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	t, err := time.Parse(time.RFC3339, v)
+	if err != nil {
+		return time.Time{}, errors.New("time must be in RFC3339 format")
+	}
+	return t, nil
+}
@@ -2,11 +2,15 @@ package handlers
 
 import (
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"log/slog"
+	"net"
 	"net/http"
+	"net/url"
 	"time"
 
 	"github.com/go-chi/chi/v5"
@@ -17,27 +21,83 @@ import (
 	"github.com/iden3/notification-service/services"
 )
 
+const (
+	idempotencyKeyHeader     = "Idempotency-Key"
+	idempotentReplayedHeader = "Idempotent-Replayed"
+	maxIdempotencyKeyLength  = 255
+	// maxSubscriptionFilterValues limits values of all filter parameters of a subscription
+	maxSubscriptionFilterValues = 50
+)
+
 // PushNotificationHandler for sending and fetching push notifications
 type PushNotificationHandler struct {
 	notificationService notificationService
 	cachingService      cachingService
 	subscriptionService subscriptionService
+	idempotencyService  idempotencyService
 	pingTickerTime      time.Duration
-	expirationDuration  time.Duration
+	// legacyFormat enables support of messages stored without metadata
+	legacyFormat bool
+	// eventLog replays events missed by reconnected subscribers
+	eventLog      eventLog
+	retryInterval time.Duration
+	// offlineQueue keeps notifications sent while the user had no subscriptions
+	offlineQueue offlineQueue
+}
+
+// PushNotificationHandlerOption configures PushNotificationHandler optional parameters.
+type PushNotificationHandlerOption func(*PushNotificationHandler)
+
+// WithLegacyMessageFormat enables or disables support of messages stored without metadata.
+// It can be disabled when legacy messages are migrated or expired. Enabled by default.
+func WithLegacyMessageFormat(enabled bool) PushNotificationHandlerOption {
+	return func(h *PushNotificationHandler) {
+		h.legacyFormat = enabled
+	}
+}
+
+// WithEventReplay sends events logged after Last-Event-ID to reconnected subscribers
+// and advises them to reconnect after retryInterval.
+func WithEventReplay(l eventLog, retryInterval time.Duration) PushNotificationHandlerOption {
+	return func(h *PushNotificationHandler) {
+		h.eventLog = l
+		h.retryInterval = retryInterval
+	}
+}
+
+// WithOfflineQueue sends notifications queued while the user had no subscriptions to new subscribers.
+func WithOfflineQueue(q offlineQueue) PushNotificationHandlerOption {
+	return func(h *PushNotificationHandler) {
+		h.offlineQueue = q
+	}
 }
+
 type notificationService interface {
-	SendNotification(ctx context.Context, msg *services.PushNotification) []services.NotificationResult
+	SendNotification(ctx context.Context, msg *services.PushNotification) (
+		results []services.NotificationResult, notificationIDs []string)
+}
+
+type idempotencyService interface {
+	Do(ctx context.Context, sender, key, fingerprint string,
+		fn func() ([]services.NotificationResult, []string)) (rec services.IdempotencyRecord, replayed bool, err error)
 }
 type cachingService interface {
 	Get(ctx context.Context, key string) (interface{}, error)
-	GetAllByPrefix(ctx context.Context, prefix string) (values []interface{}, keys []string, err error)
-	Delete(ctx context.Context, keys ...string) error
-	Set(ctx context.Context, key string, value interface{}, duration time.Duration) error
+	GetAllByUniqueID(ctx context.Context, uniqueID string) (values []interface{}, keys []string, err error)
 }
 
 type subscriptionService interface {
-	Subscribe(userDID string) (<-chan services.NotificationPayload, error)
+	SubscribeWithFilter(userDID string, filter services.SubscriptionFilter) (<-chan services.NotificationPayload, error)
 	Unsubscribe(userDID string, uch <-chan services.NotificationPayload)
+	CloseReason(userDID string, uch <-chan services.NotificationPayload) string
+}
+
+type eventLog interface {
+	Since(ctx context.Context, userDID, lastEventID string) ([]services.NotificationPayload, error)
+}
+
+type offlineQueue interface {
+	Drain(ctx context.Context, userDID string) ([]services.NotificationPayload, error)
 }
 
 // NewPushNotificationHandler create new instance of proxy
@@ -45,19 +105,28 @@ func NewPushNotificationHandler(
 	s notificationService,
 	cs cachingService,
 	sub subscriptionService,
+	idem idempotencyService,
 	pingTickerTime time.Duration,
-	expirationDuration time.Duration,
+	opts ...PushNotificationHandlerOption,
 ) *PushNotificationHandler {
-	return &PushNotificationHandler{
+	h := &PushNotificationHandler{
 		notificationService: s,
 		cachingService:      cs,
 		subscriptionService: sub,
+		idempotencyService:  idem,
 		pingTickerTime:      pingTickerTime,
-		expirationDuration:  expirationDuration,
+		legacyFormat:        true,
+	}
+	for _, opt := range opts {
+		if opt != nil {
+			opt(h)
+		}
 	}
+	return h
 }
 
-// Send proxy notification to matrix sygnal gateway
+// Send proxy notification to matrix sygnal gateway.
+// Retries with the same Idempotency-Key header get the response of the first request.
 func (h *PushNotificationHandler) Send(w http.ResponseWriter, r *http.Request) {
 	var cReq services.PushNotification
 	if err := render.DecodeJSON(r.Body, &cReq); err != nil {
@@ -69,7 +138,40 @@ func (h *PushNotificationHandler) Send(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	resp := h.notificationService.SendNotification(r.Context(), &cReq)
+	var resp []services.NotificationResult
+	idempotencyKey := r.Header.Get(idempotencyKeyHeader)
+	if idempotencyKey == "" {
+		resp, _ = h.notificationService.SendNotification(r.Context(), &cReq)
+	} else {
+		if len(idempotencyKey) > maxIdempotencyKeyLength {
+			utils.ErrorJSON(w, r, http.StatusBadRequest, errors.New("idempotency key is too long"), "invalid request", 0)
+			return
+		}
+		fingerprint, err := requestFingerprint(&cReq)
+		if err != nil {
+			utils.ErrorJSON(w, r, http.StatusInternalServerError, err, "failed proxy notification", 0)
+			return
+		}
+		rec, replayed, err := h.idempotencyService.Do(r.Context(), senderOf(r, &cReq), idempotencyKey, fingerprint,
+			func() ([]services.NotificationResult, []string) {
+				return h.notificationService.SendNotification(r.Context(), &cReq)
+			})
+		switch {
+		case errors.Is(err, services.ErrIdempotencyKeyReused):
+			utils.ErrorJSON(w, r, http.StatusUnprocessableEntity, err, "idempotency key reused", 0)
+			return
+		case errors.Is(err, services.ErrIdempotencyInProgress):
+			utils.ErrorJSON(w, r, http.StatusConflict, err, "request is in progress", 0)
+			return
+		case err != nil:
+			utils.ErrorJSON(w, r, http.StatusInternalServerError, err, "failed proxy notification", 0)
+			return
+		}
+		if replayed {
+			w.Header().Set(idempotentReplayedHeader, "true")
+		}
+		resp = rec.Results
+	}
 
 	respBytes, err := json.Marshal(resp)
 	if err != nil {
@@ -83,6 +185,32 @@ func (h *PushNotificationHandler) Send(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+// senderOf identifies sender to scope idempotency keys.
+// Plain iden3comm messages contain DID of the sender, otherwise client IP is used.
+func senderOf(r *http.Request, msg *services.PushNotification) string {
+	var basicMessage struct {
+		From string `json:"from"`
+	}
+	if err := json.Unmarshal(msg.Message, &basicMessage); err == nil && basicMessage.From != "" {
+		return basicMessage.From
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// requestFingerprint is a hash of the request to detect reuse of idempotency key
+func requestFingerprint(msg *services.PushNotification) (string, error) {
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:]), nil
+}
+
 // Get returns notification by identifier
 // returns only body to keep backward compatibility
 func (h *PushNotificationHandler) Get(w http.ResponseWriter, r *http.Request) {
@@ -115,7 +243,7 @@ func (h *PushNotificationHandler) Get(w http.ResponseWriter, r *http.Request) {
 
 	// old message format doesn't contain metadata
 	var payload []byte
-	if services.IsEmptyMetadata(msg.Metadata) {
+	if h.legacyFormat && services.IsEmptyMetadata(msg.Metadata) {
 		// if true: message has raw format without metadata
 		payload = []byte(respStr)
 	} else {
@@ -173,7 +301,7 @@ func (h *PushNotificationHandler) GetAllMessagesByUniqueID(w http.ResponseWriter
 	}
 	uniqueID := d.String()
 
-	values, keys, err := h.cachingService.GetAllByPrefix(r.Context(), uniqueID)
+	values, keys, err := h.cachingService.GetAllByUniqueID(r.Context(), uniqueID)
 	if err != nil {
 		utils.ErrorJSON(w, r, http.StatusInternalServerError,
 			err, "failed to get notifications", 0)
@@ -214,10 +342,10 @@ func (h *PushNotificationHandler) GetAllMessagesByUniqueID(w http.ResponseWriter
 			return
 		}
 
-		// TODO (illia-korotia): this is temporary fix for old messages without metadata
-		// when all old messages will be expired, we can remove this block
+		// old messages without metadata are supported until they are migrated
+		// with `migrate` command or expired, then legacy format can be disabled
 		body := nContent.Body
-		if services.IsEmptyMetadata(nContent.Metadata) {
+		if h.legacyFormat && services.IsEmptyMetadata(nContent.Metadata) {
 			// old message format without metadata
 			body = []byte(msg)
 		}
@@ -238,60 +366,6 @@ func (h *PushNotificationHandler) GetAllMessagesByUniqueID(w http.ResponseWriter
 	}
 }
 
-// AckMessage marks a message as read
-// works only for messages with metadata
-func (h *PushNotificationHandler) AckMessage(w http.ResponseWriter, r *http.Request) {
-	idParam := chi.URLParam(r, "id")
-	if idParam == "" {
-		utils.ErrorJSON(w, r, http.StatusBadRequest, errors.New("no id param"), "can't get notification id param", 0)
-		return
-	}
-
-	resp, err := h.cachingService.Get(r.Context(), idParam)
-	if err != nil {
-		utils.ErrorJSON(w, r, http.StatusInternalServerError, err, "failed to get notification", 0)
-		return
-	}
-	if resp == nil {
-		utils.ErrorJSON(w, r, http.StatusNotFound, errors.New("notification not found"), "expired", 0)
-		return
-	}
-
-	respStr, ok := resp.(string)
-	if !ok {
-		utils.ErrorJSON(w, r, http.StatusNotFound, errors.New("invalid message from redis"), "error", 0)
-		return
-	}
-
-	var msg services.NotificationContent
-	if err := json.Unmarshal([]byte(respStr), &msg); err != nil {
-		utils.ErrorJSON(w, r, http.StatusInternalServerError, err, "failed to unmarshal notification", 0)
-		return
-	}
-
-	msg.Metadata.ReadAt = time.Now().UTC()
-	msg.Metadata.IsRead = true
-
-	updatedBytes, err := json.Marshal(msg)
-	if err != nil {
-		utils.ErrorJSON(w, r, http.StatusInternalServerError, err, "failed to marshal updated notification", 0)
-		return
-	}
-
-	err = h.cachingService.Set(r.Context(), idParam, updatedBytes, h.expirationDuration)
-	if err != nil {
-		utils.ErrorJSON(w, r, http.StatusInternalServerError, err, "failed to update notification", 0)
-		return
-	}
-
-	render.Status(r, http.StatusOK)
-	render.JSON(w, r, struct {
-		Success bool `json:"success"`
-	}{
-		Success: true,
-	})
-}
-
 func (h *PushNotificationHandler) SubscribeNotifications(w http.ResponseWriter, r *http.Request) {
 	d, ok := middleware.GetDIDFromContext(r.Context())
 	if !ok || d.String() == "" {
@@ -310,14 +384,8 @@ func (h *PushNotificationHandler) SubscribeNotifications(w http.ResponseWriter,
 
 	// since HTTP2 doesn't have limitation of open connections per client,
 	// we limit number of open subscriptions per userDID to prevent memory leak
-	ch, err := h.subscriptionService.Subscribe(userDID)
-	if err != nil && errors.Is(err, services.ErrMaxSubscriptionsReached) {
-		utils.ErrorJSON(w, r, http.StatusTooManyRequests,
-			err, "maximum number of open subscriptions reached", 0)
-		return
-	} else if err != nil {
-		utils.ErrorJSON(w, r, http.StatusInternalServerError,
-			err, "failed to subscribe to notifications", 0)
+	ch, filter, ok := subscribe(w, r, h.subscriptionService, userDID)
+	if !ok {
 		return
 	}
 
@@ -326,19 +394,58 @@ func (h *PushNotificationHandler) SubscribeNotifications(w http.ResponseWriter,
 	pingTicker := time.NewTicker(h.pingTickerTime)
 	defer pingTicker.Stop()
 
+	// stream is closed when the credentials it was opened with expire
+	var authExpired <-chan time.Time
+	if deadline, ok := middleware.GetAuthDeadlineFromContext(r.Context()); ok {
+		authTimer := time.NewTimer(time.Until(deadline))
+		defer authTimer.Stop()
+		authExpired = authTimer.C
+	}
+
 	w.Header().Set("Content-Type", "text/event-stream")
 	w.Header().Set("Cache-Control", "no-cache")
 	w.Header().Set("Connection", "keep-alive")
 
+	if h.retryInterval > 0 {
+		_, _ = fmt.Fprint(w, utils.BuildRetryMessage(h.retryInterval))
+		flusher.Flush()
+	}
+
+	// replay is done after subscribe, so events logged meanwhile are in the channel as well;
+	// lastEventID is used to skip them
+	lastEventID := r.Header.Get("Last-Event-ID")
+	if lastEventID == "" {
+		// EventSource sends the header only on its own reconnects, clients reconnecting
+		// with a new ticket pass the last event ID in the query
+		lastEventID = r.URL.Query().Get("last_event_id")
+	}
+	if lastEventID != "" {
+		lastEventID = h.replayEvents(w, r, userDID, lastEventID, filter)
+		flusher.Flush()
+	}
+	// the queue is drained by unfiltered subscriptions only, so other notifications aren't lost
+	if queued := drainOfflineQueue(r, h.offlineQueue, userDID, filter); len(queued) > 0 {
+		for _, e := range queued {
+			// queued notifications are logged as well, the replayed ones are skipped
+			if lastEventID == "" || e.EventID == "" || services.EventIDAfter(e.EventID, lastEventID) {
+				_, _ = fmt.Fprint(w, utils.BuildEventMessage(e))
+			}
+		}
+		flusher.Flush()
+	}
+
 	for {
 		select {
 		case data, ok := <-ch:
 			if !ok {
 				// unsubscribe channel closed
-				_, _ = fmt.Fprint(w, utils.CloseMessage)
+				_, _ = fmt.Fprint(w, utils.BuildCloseMessage(h.subscriptionService.CloseReason(userDID, ch)))
 				flusher.Flush()
 				return
 			}
+			if lastEventID != "" && data.EventID != "" && !services.EventIDAfter(data.EventID, lastEventID) {
+				continue
+			}
 
 			event := utils.BuildEventMessage(data)
 			_, _ = fmt.Fprint(w, event)
@@ -346,6 +453,10 @@ func (h *PushNotificationHandler) SubscribeNotifications(w http.ResponseWriter,
 		case <-pingTicker.C:
 			_, _ = fmt.Fprint(w, utils.PingMessage)
 			flusher.Flush()
+		case <-authExpired:
+			_, _ = fmt.Fprint(w, utils.BuildCloseMessage(services.CloseReasonAuthExpired))
+			flusher.Flush()
+			return
 		case <-r.Context().Done():
 			log.WithContext(r.Context()).Info(
 				"connection closed",
@@ -358,3 +469,80 @@ func (h *PushNotificationHandler) SubscribeNotifications(w http.ResponseWriter,
 		}
 	}
 }
+
+// subscribe opens subscription of userDID filtered by the query parameters,
+// or replies with error and returns false
+func subscribe(w http.ResponseWriter, r *http.Request,
+	sub subscriptionService, userDID string) (<-chan services.NotificationPayload, services.SubscriptionFilter, bool) {
+	filter, err := parseSubscriptionFilter(r.URL.Query())
+	if err != nil {
+		utils.ErrorJSON(w, r, http.StatusBadRequest, err, "invalid subscription filter", 0)
+		return nil, filter, false
+	}
+	ch, err := sub.SubscribeWithFilter(userDID, filter)
+	if err != nil && errors.Is(err, services.ErrMaxSubscriptionsReached) {
+		utils.ErrorJSON(w, r, http.StatusTooManyRequests,
+			err, "maximum number of open subscriptions reached", 0)
+		return nil, filter, false
+	} else if errors.Is(err, services.ErrSubscriptionsClosed) {
+		utils.ErrorJSON(w, r, http.StatusServiceUnavailable,
+			err, "server is shutting down", 0)
+		return nil, filter, false
+	} else if err != nil {
+		utils.ErrorJSON(w, r, http.StatusInternalServerError,
+			err, "failed to subscribe to notifications", 0)
+		return nil, filter, false
+	}
+	return ch, filter, true
+}
+
+// parseSubscriptionFilter reads repeated type, thid and from query parameters
+func parseSubscriptionFilter(query url.Values) (services.SubscriptionFilter, error) {
+	filter := services.SubscriptionFilter{
+		Types:     query["type"],
+		ThreadIDs: query["thid"],
+		From:      query["from"],
+	}
+	if len(filter.Types)+len(filter.ThreadIDs)+len(filter.From) > maxSubscriptionFilterValues {
+		return services.SubscriptionFilter{}, fmt.Errorf("subscription filter has more than %d values",
+			maxSubscriptionFilterValues)
+	}
+	return filter, nil
+}
+
+// drainOfflineQueue returns notifications queued while the user had no subscriptions.
+// The subscription is opened before, so notifications sent meanwhile aren't queued.
+// Filtered subscriptions don't drain the queue, so notifications they skip aren't lost.
+func drainOfflineQueue(r *http.Request, q offlineQueue, userDID string,
+	filter services.SubscriptionFilter) []services.NotificationPayload {
+	if q == nil || !filter.IsEmpty() {
+		return nil
+	}
+	queued, err := q.Drain(r.Context(), userDID)
+	if err != nil {
+		log.WithContext(r.Context()).Errorf("failed to get queued notifications: %v", err)
+		return nil
+	}
+	return queued
+}
+
+// replayEvents writes events logged after lastEventID which match the filter
+// and returns ID of the last replayed event
+func (h *PushNotificationHandler) replayEvents(w http.ResponseWriter, r *http.Request,
+	userDID, lastEventID string, filter services.SubscriptionFilter) string {
+	if h.eventLog == nil {
+		return lastEventID
+	}
+	events, err := h.eventLog.Since(r.Context(), userDID, lastEventID)
+	if err != nil {
+		log.WithContext(r.Context()).Warnf("failed to replay events after %s: %v", lastEventID, err)
+		return ""
+	}
+	for _, e := range events {
+		if filter.Match(e) {
+			_, _ = fmt.Fprint(w, utils.BuildEventMessage(e))
+		}
+		lastEventID = e.EventID
+	}
+	return lastEventID
+}
@@ -0,0 +1,151 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/render"
+	"github.com/iden3/notification-service/rest/middleware"
+	"github.com/iden3/notification-service/rest/utils"
+	"github.com/iden3/notification-service/services"
+)
+
+const (
+	defaultPollTimeout = 30 * time.Second
+	maxPollTimeout     = 60 * time.Second
+)
+
+// pollEvent is an event of long polling response, the same as SSE event
+type pollEvent struct {
+	Event string      `json:"event"`
+	ID    string      `json:"id,omitempty"`
+	Data  interface{} `json:"data"`
+}
+
+// pollResponse has events received during the poll. Client passes LastEventID
+// as since parameter of the next poll, so events between polls aren't missed.
+type pollResponse struct {
+	Events      []pollEvent `json:"events"`
+	LastEventID string      `json:"last_event_id,omitempty"`
+	// CloseReason is set when subscription was closed by the service
+	CloseReason string `json:"close_reason,omitempty"`
+}
+
+// add appends event unless it was already returned before LastEventID
+func (resp *pollResponse) add(payload services.NotificationPayload) {
+	if resp.LastEventID != "" && payload.EventID != "" &&
+		!services.EventIDAfter(payload.EventID, resp.LastEventID) {
+		return
+	}
+	resp.Events = append(resp.Events, pollEvent{
+		Event: utils.EventName(payload),
+		ID:    payload.EventID,
+		Data:  utils.EventData(payload),
+	})
+	if payload.EventID != "" {
+		resp.LastEventID = payload.EventID
+	}
+}
+
+// Poll is a long polling fallback of SubscribeNotifications for networks which break SSE.
+// It returns events logged after since parameter at once, otherwise waits for new events
+// up to timeout parameter and returns them or empty response. The poll holds a subscription,
+// so it counts to the limit of subscriptions per user.
+func (h *PushNotificationHandler) Poll(w http.ResponseWriter, r *http.Request) {
+	d, ok := middleware.GetDIDFromContext(r.Context())
+	if !ok || d.String() == "" {
+		utils.ErrorJSON(w, r, http.StatusBadRequest,
+			errors.New("no userDID in context"), "can't get userDID from context", 0)
+		return
+	}
+	userDID := d.String()
+
+	timeout := defaultPollTimeout
+	if v := r.URL.Query().Get("timeout"); v != "" {
+		t, err := time.ParseDuration(v)
+		if err != nil || t < 0 {
+			utils.ErrorJSON(w, r, http.StatusBadRequest,
+				errors.New("invalid timeout"), "timeout must be a non-negative duration like 30s", 0)
+			return
+		}
+		timeout = min(t, maxPollTimeout)
+	}
+	// poll isn't held after the credentials expire
+	authExpires := false
+	if deadline, ok := middleware.GetAuthDeadlineFromContext(r.Context()); ok && time.Until(deadline) < timeout {
+		timeout = time.Until(deadline)
+		authExpires = true
+	}
+
+	ch, filter, ok := subscribe(w, r, h.subscriptionService, userDID)
+	if !ok {
+		return
+	}
+	defer h.subscriptionService.Unsubscribe(userDID, ch)
+
+	resp := pollResponse{Events: []pollEvent{}}
+	// replay is done after subscribe, so events logged meanwhile are skipped by LastEventID
+	if since := r.URL.Query().Get("since"); since != "" && h.eventLog != nil {
+		events, err := h.eventLog.Since(r.Context(), userDID, since)
+		if errors.Is(err, services.ErrInvalidEventID) {
+			utils.ErrorJSON(w, r, http.StatusBadRequest, err, "invalid since event id", 0)
+			return
+		} else if err != nil {
+			utils.ErrorJSON(w, r, http.StatusInternalServerError, err, "failed to get events", 0)
+			return
+		}
+		resp.LastEventID = since
+		for _, e := range events {
+			if filter.Match(e) {
+				resp.add(e)
+			} else {
+				// skipped events aren't replayed by the next poll
+				resp.LastEventID = e.EventID
+			}
+		}
+	}
+	for _, e := range drainOfflineQueue(r, h.offlineQueue, userDID, filter) {
+		resp.add(e)
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+wait:
+	for len(resp.Events) == 0 {
+		select {
+		case data, ok := <-ch:
+			if !ok {
+				resp.CloseReason = h.subscriptionService.CloseReason(userDID, ch)
+				break wait
+			}
+			resp.add(data)
+		case <-timer.C:
+			if authExpires {
+				resp.CloseReason = services.CloseReasonAuthExpired
+			}
+			break wait
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	// events which arrived together are returned in one response
+drain:
+	for resp.CloseReason == "" {
+		select {
+		case data, ok := <-ch:
+			if !ok {
+				resp.CloseReason = h.subscriptionService.CloseReason(userDID, ch)
+				break drain
+			}
+			resp.add(data)
+		default:
+			break drain
+		}
+	}
+
+	w.Header().Set("Cache-Control", "no-cache")
+	render.Status(r, http.StatusOK)
+	render.JSON(w, r, resp)
+}
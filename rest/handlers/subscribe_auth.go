@@ -0,0 +1,165 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/render"
+	"github.com/iden3/notification-service/rest/middleware"
+	"github.com/iden3/notification-service/rest/utils"
+	"github.com/iden3/notification-service/services"
+)
+
+type subscribeAuthService interface {
+	IssueTicket(ctx context.Context, userDID string, validUntil time.Time) (string, time.Time, error)
+	IssueSession(ctx context.Context, userDID string, validUntil time.Time) (string, time.Time, error)
+	ResolveSession(ctx context.Context, session string) (string, time.Time, error)
+	RevokeSession(ctx context.Context, session string) error
+}
+
+// SubscribeAuthHandler issues credentials for subscriptions of browsers
+// which can't set Authorization header on EventSource requests
+type SubscribeAuthHandler struct {
+	authService subscribeAuthService
+	cookie      *http.Cookie
+}
+
+// SubscribeAuthHandlerOption configures SubscribeAuthHandler optional parameters.
+type SubscribeAuthHandlerOption func(*SubscribeAuthHandler)
+
+// WithSessionCookie enables sessions in HttpOnly cookie with the name, domain and SameSite mode.
+// Sessions are disabled by default.
+func WithSessionCookie(name, domain string, sameSite http.SameSite) SubscribeAuthHandlerOption {
+	return func(h *SubscribeAuthHandler) {
+		h.cookie = &http.Cookie{
+			Name:     name,
+			Domain:   domain,
+			Path:     "/",
+			Secure:   true,
+			HttpOnly: true,
+			SameSite: sameSite,
+		}
+	}
+}
+
+// NewSubscribeAuthHandler creates new handler of subscribe tickets and sessions
+func NewSubscribeAuthHandler(s subscribeAuthService, opts ...SubscribeAuthHandlerOption) *SubscribeAuthHandler {
+	h := &SubscribeAuthHandler{
+		authService: s,
+	}
+	for _, opt := range opts {
+		if opt != nil {
+			opt(h)
+		}
+	}
+	return h
+}
+
+// CookieName returns name of the session cookie, empty if sessions are disabled
+func (h *SubscribeAuthHandler) CookieName() string {
+	if h.cookie == nil {
+		return ""
+	}
+	return h.cookie.Name
+}
+
+// Ticket issues single-use ticket of authenticated user for the ticket query parameter of subscription
+func (h *SubscribeAuthHandler) Ticket(w http.ResponseWriter, r *http.Request) {
+	d, ok := middleware.GetDIDFromContext(r.Context())
+	if !ok || d.String() == "" {
+		utils.ErrorJSON(w, r, http.StatusBadRequest, errors.New("no userDID in context"), "can't get userDID from context", 0)
+		return
+	}
+
+	// stream opened with the ticket is closed when the JWZ expires
+	validUntil, _ := middleware.GetAuthDeadlineFromContext(r.Context())
+	ticket, expiresAt, err := h.authService.IssueTicket(r.Context(), d.String(), validUntil)
+	if err != nil {
+		utils.ErrorJSON(w, r, http.StatusInternalServerError, err, "failed to issue ticket", 0)
+		return
+	}
+
+	render.Status(r, http.StatusOK)
+	render.JSON(w, r, struct {
+		Ticket    string    `json:"ticket"`
+		ExpiresAt time.Time `json:"expires_at"`
+	}{
+		Ticket:    ticket,
+		ExpiresAt: expiresAt,
+	})
+}
+
+// Session sets session cookie of authenticated user accepted by subscription endpoint
+func (h *SubscribeAuthHandler) Session(w http.ResponseWriter, r *http.Request) {
+	if h.cookie == nil {
+		utils.ErrorJSON(w, r, http.StatusNotFound, errors.New("sessions are disabled"), "session cookies are disabled", 0)
+		return
+	}
+	d, ok := middleware.GetDIDFromContext(r.Context())
+	if !ok || d.String() == "" {
+		utils.ErrorJSON(w, r, http.StatusBadRequest, errors.New("no userDID in context"), "can't get userDID from context", 0)
+		return
+	}
+
+	// session doesn't outlive the JWZ it was issued with
+	validUntil, _ := middleware.GetAuthDeadlineFromContext(r.Context())
+	session, expiresAt, err := h.authService.IssueSession(r.Context(), d.String(), validUntil)
+	if err != nil {
+		utils.ErrorJSON(w, r, http.StatusInternalServerError, err, "failed to issue session", 0)
+		return
+	}
+	c := *h.cookie
+	c.Value = session
+	c.Expires = expiresAt
+	http.SetCookie(w, &c)
+
+	render.Status(r, http.StatusOK)
+	render.JSON(w, r, struct {
+		ExpiresAt time.Time `json:"expires_at"`
+	}{
+		ExpiresAt: expiresAt,
+	})
+}
+
+// DeleteSession revokes session of the cookie and clears the cookie. The cookie is sent
+// by cross-site requests, so only the authenticated owner can revoke the session.
+func (h *SubscribeAuthHandler) DeleteSession(w http.ResponseWriter, r *http.Request) {
+	if h.cookie == nil {
+		utils.ErrorJSON(w, r, http.StatusNotFound, errors.New("sessions are disabled"), "session cookies are disabled", 0)
+		return
+	}
+	d, ok := middleware.GetDIDFromContext(r.Context())
+	if !ok || d.String() == "" {
+		utils.ErrorJSON(w, r, http.StatusBadRequest, errors.New("no userDID in context"), "can't get userDID from context", 0)
+		return
+	}
+	if c, err := r.Cookie(h.cookie.Name); err == nil {
+		owner, _, err := h.authService.ResolveSession(r.Context(), c.Value)
+		switch {
+		case errors.Is(err, services.ErrInvalidSubscribeToken):
+			// expired session is only cleared
+		case err != nil:
+			utils.ErrorJSON(w, r, http.StatusInternalServerError, err, "failed to revoke session", 0)
+			return
+		case owner != d.String():
+			utils.ErrorJSON(w, r, http.StatusForbidden, errors.New("session of another user"), "forbidden", 0)
+			return
+		}
+		if err := h.authService.RevokeSession(r.Context(), c.Value); err != nil {
+			utils.ErrorJSON(w, r, http.StatusInternalServerError, err, "failed to revoke session", 0)
+			return
+		}
+	}
+	c := *h.cookie
+	c.MaxAge = -1
+	http.SetCookie(w, &c)
+
+	render.Status(r, http.StatusOK)
+	render.JSON(w, r, struct {
+		Success bool `json:"success"`
+	}{
+		Success: true,
+	})
+}
@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/iden3/go-iden3-core/v2/w3c"
+	"github.com/iden3/notification-service/rest/middleware"
+	"github.com/iden3/notification-service/services"
+	"github.com/stretchr/testify/require"
+)
+
+type subscribeAuthMock struct {
+	sessions map[string]string
+}
+
+func (m *subscribeAuthMock) IssueTicket(_ context.Context, _ string, _ time.Time) (string, time.Time, error) {
+	return "", time.Time{}, nil
+}
+
+func (m *subscribeAuthMock) IssueSession(_ context.Context, _ string, _ time.Time) (string, time.Time, error) {
+	return "", time.Time{}, nil
+}
+
+func (m *subscribeAuthMock) ResolveSession(_ context.Context, session string) (string, time.Time, error) {
+	owner, ok := m.sessions[session]
+	if !ok {
+		return "", time.Time{}, services.ErrInvalidSubscribeToken
+	}
+	return owner, time.Time{}, nil
+}
+
+func (m *subscribeAuthMock) RevokeSession(_ context.Context, session string) error {
+	delete(m.sessions, session)
+	return nil
+}
+
+func deleteSessionRequest(t *testing.T, h *SubscribeAuthHandler, session string) *httptest.ResponseRecorder {
+	t.Helper()
+	did, err := w3c.ParseDID(testDID)
+	require.NoError(t, err)
+	r := httptest.NewRequest(http.MethodDelete, "/api/v2/subscribe/session", nil)
+	r.AddCookie(&http.Cookie{Name: "session", Value: session})
+	r = r.WithContext(middleware.WithDIDContext(r.Context(), *did))
+	w := httptest.NewRecorder()
+	h.DeleteSession(w, r)
+	return w
+}
+
+func TestSubscribeAuthHandler_DeleteSession(t *testing.T) {
+	s := &subscribeAuthMock{sessions: map[string]string{
+		"own":   testDID,
+		"other": "did:iden3:polygon:amoy:xBdqiqz3yVT79NEAuNaqKSDZ6a5V6q8Ph66i5d2tT",
+	}}
+	h := NewSubscribeAuthHandler(s, WithSessionCookie("session", "", http.SameSiteNoneMode))
+
+	// session of another user isn't revoked
+	w := deleteSessionRequest(t, h, "other")
+	require.Equal(t, http.StatusForbidden, w.Code)
+	require.Contains(t, s.sessions, "other")
+
+	w = deleteSessionRequest(t, h, "own")
+	require.Equal(t, http.StatusOK, w.Code)
+	require.NotContains(t, s.sessions, "own")
+	require.Equal(t, -1, w.Result().Cookies()[0].MaxAge)
+
+	// unknown session is only cleared
+	w = deleteSessionRequest(t, h, "expired")
+	require.Equal(t, http.StatusOK, w.Code)
+
+	// the request must be authenticated
+	w = httptest.NewRecorder()
+	h.DeleteSession(w, httptest.NewRequest(http.MethodDelete, "/api/v2/subscribe/session", nil))
+	require.Equal(t, http.StatusBadRequest, w.Code)
+}
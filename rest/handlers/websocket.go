@@ -0,0 +1,392 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/iden3/go-iden3-core/v2/w3c"
+	"github.com/iden3/notification-service/log"
+	"github.com/iden3/notification-service/rest/middleware"
+	"github.com/iden3/notification-service/rest/utils"
+	"github.com/iden3/notification-service/services"
+)
+
+const (
+	// wsMaxRequestSize limits size of client messages
+	wsMaxRequestSize = 4096
+	wsWriteTimeout   = 10 * time.Second
+)
+
+// WebSocket message types
+const (
+	wsMessageNotification = "notification"
+	wsMessageResponse     = "response"
+	wsMessageError        = "error"
+
+	wsRequestAck   = "ack"
+	wsRequestInbox = "inbox"
+	wsRequestAuth  = "auth"
+)
+
+// wsRequest is a message sent by client
+type wsRequest struct {
+	Type      string `json:"type"`
+	RequestID string `json:"request_id,omitempty"`
+	// ID of notification to acknowledge
+	ID string `json:"id,omitempty"`
+	// Query of inbox request, supports the same parameters as GET /api/v2/inbox
+	Query map[string]string `json:"query,omitempty"`
+	// Token of auth request, a new JWZ extending the connection
+	Token string `json:"token,omitempty"`
+}
+
+// wsMessage is a message sent to client. Responses and errors have ID of the request.
+type wsMessage struct {
+	Type      string      `json:"type"`
+	RequestID string      `json:"request_id,omitempty"`
+	EventID   string      `json:"event_id,omitempty"`
+	Payload   interface{} `json:"payload,omitempty"`
+	Error     string      `json:"error,omitempty"`
+}
+
+// wsReply is a reply to client request. Successful auth request sets a new deadline of the connection.
+type wsReply struct {
+	message         wsMessage
+	reauthenticated bool
+	validUntil      time.Time
+}
+
+type wsAuthenticator interface {
+	Authenticate(ctx context.Context, token string) (w3c.DID, time.Time, error)
+}
+
+// WebSocketHandlerOption configures WebSocketHandler optional parameters.
+type WebSocketHandlerOption func(*WebSocketHandler)
+
+// WithReauthentication allows clients to extend connection with a new JWZ before the current one expires.
+// Connections are closed when the token expires by default.
+func WithReauthentication(a wsAuthenticator) WebSocketHandlerOption {
+	return func(h *WebSocketHandler) {
+		h.authenticator = a
+	}
+}
+
+// WithWebSocketOfflineQueue sends notifications queued while the user had no subscriptions to new connections.
+func WithWebSocketOfflineQueue(q offlineQueue) WebSocketHandlerOption {
+	return func(h *WebSocketHandler) {
+		h.offlineQueue = q
+	}
+}
+
+// WebSocketHandler delivers notifications of authenticated user over WebSocket.
+// Unlike SSE, clients can acknowledge notifications and request inbox over the same connection.
+type WebSocketHandler struct {
+	subscriptionService subscriptionService
+	inboxService        inboxService
+	pingTickerTime      time.Duration
+	upgrader            websocket.Upgrader
+	authenticator       wsAuthenticator
+	offlineQueue        offlineQueue
+
+	// connections are hijacked from the HTTP server, so the server doesn't wait for them on shutdown
+	connLock    sync.Mutex
+	connections sync.WaitGroup
+	closed      bool
+}
+
+// NewWebSocketHandler creates new handler for WebSocket subscriptions
+func NewWebSocketHandler(sub subscriptionService, inbox inboxService,
+	pingTickerTime time.Duration, opts ...WebSocketHandlerOption) *WebSocketHandler {
+	h := &WebSocketHandler{
+		subscriptionService: sub,
+		inboxService:        inbox,
+		pingTickerTime:      pingTickerTime,
+		upgrader: websocket.Upgrader{
+			// any origin is allowed only because /ws requires JWZ in Authorization header,
+			// which browsers never attach on their own, and never uses cookie sessions.
+			// A cross-site page can't open an authenticated connection of the user,
+			// keep the origin check if cookie or ticket based auth is added to this route.
+			CheckOrigin: func(*http.Request) bool { return true },
+		},
+	}
+	for _, opt := range opts {
+		if opt != nil {
+			opt(h)
+		}
+	}
+	return h
+}
+
+// Subscribe upgrades connection to WebSocket and sends notifications of authenticated user.
+// Number of connections per user is limited together with SSE subscriptions.
+func (h *WebSocketHandler) Subscribe(w http.ResponseWriter, r *http.Request) {
+	d, ok := middleware.GetDIDFromContext(r.Context())
+	if !ok || d.String() == "" {
+		utils.ErrorJSON(w, r, http.StatusBadRequest,
+			errors.New("no userDID in context"), "can't get userDID from context", 0)
+		return
+	}
+	userDID := d.String()
+
+	if !h.track() {
+		utils.ErrorJSON(w, r, http.StatusServiceUnavailable,
+			services.ErrSubscriptionsClosed, "server is shutting down", 0)
+		return
+	}
+	defer h.connections.Done()
+
+	ch, filter, ok := subscribe(w, r, h.subscriptionService, userDID)
+	if !ok {
+		return
+	}
+	defer h.subscriptionService.Unsubscribe(userDID, ch)
+
+	conn, err := h.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// upgrader has already replied with error
+		log.WithContext(r.Context()).Warnf("failed to upgrade connection: %v", err)
+		return
+	}
+	defer conn.Close()
+
+	// client has to answer pings, otherwise connection is considered lost
+	conn.SetReadLimit(wsMaxRequestSize)
+	_ = conn.SetReadDeadline(time.Now().Add(2 * h.pingTickerTime))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(2 * h.pingTickerTime))
+	})
+
+	// connection is closed when the token expires unless the client sends a new one
+	authTimer := time.NewTimer(time.Hour)
+	authTimer.Stop()
+	defer authTimer.Stop()
+	if deadline, ok := middleware.GetAuthDeadlineFromContext(r.Context()); ok {
+		authTimer.Reset(time.Until(deadline))
+	}
+
+	// connection supports one concurrent writer, so responses are written by this goroutine
+	replies := make(chan wsReply)
+	done := make(chan struct{})
+	defer close(done)
+	readErr := make(chan error, 1)
+	go func() {
+		readErr <- h.readRequests(r.Context(), conn, userDID, replies, done)
+	}()
+
+	for _, data := range drainOfflineQueue(r, h.offlineQueue, userDID, filter) {
+		if err := h.write(conn, notificationMessage(data)); err != nil {
+			log.WithContext(r.Context()).Infof("connection closed: failed to write message: %v", err)
+			return
+		}
+	}
+
+	pingTicker := time.NewTicker(h.pingTickerTime)
+	defer pingTicker.Stop()
+
+	for {
+		var err error
+		select {
+		case data, ok := <-ch:
+			if !ok {
+				// unsubscribe channel closed
+				_ = conn.WriteControl(websocket.CloseMessage,
+					websocket.FormatCloseMessage(websocket.CloseNormalClosure, h.subscriptionService.CloseReason(userDID, ch)),
+					time.Now().Add(wsWriteTimeout))
+				return
+			}
+			err = h.write(conn, notificationMessage(data))
+		case reply := <-replies:
+			if reply.reauthenticated {
+				authTimer.Stop()
+				if !reply.validUntil.IsZero() {
+					authTimer.Reset(time.Until(reply.validUntil))
+				}
+			}
+			err = h.write(conn, reply.message)
+		case <-pingTicker.C:
+			err = conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteTimeout))
+		case <-authTimer.C:
+			_ = conn.WriteControl(websocket.CloseMessage,
+				websocket.FormatCloseMessage(websocket.CloseNormalClosure, services.CloseReasonAuthExpired),
+				time.Now().Add(wsWriteTimeout))
+			return
+		case err := <-readErr:
+			log.WithContext(r.Context()).Infof("connection closed: %v", err)
+			return
+		}
+		if err != nil {
+			log.WithContext(r.Context()).Infof("connection closed: failed to write message: %v", err)
+			return
+		}
+	}
+}
+
+// Shutdown rejects new connections and waits until open connections are closed or ctx is done.
+// Subscriptions have to be closed before, so handlers send close messages and return.
+func (h *WebSocketHandler) Shutdown(ctx context.Context) error {
+	h.connLock.Lock()
+	h.closed = true
+	h.connLock.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		h.connections.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// track registers a new connection unless the handler is shut down
+func (h *WebSocketHandler) track() bool {
+	h.connLock.Lock()
+	defer h.connLock.Unlock()
+	if h.closed {
+		return false
+	}
+	h.connections.Add(1)
+	return true
+}
+
+// readRequests handles client requests until connection is closed
+func (h *WebSocketHandler) readRequests(ctx context.Context, conn *websocket.Conn,
+	userDID string, replies chan<- wsReply, done <-chan struct{}) error {
+	for {
+		_, b, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+
+		var reply wsReply
+		var req wsRequest
+		if err := json.Unmarshal(b, &req); err != nil {
+			reply.message = wsMessage{Type: wsMessageError, Error: "can't bind request"}
+		} else if req.Type == wsRequestAuth {
+			reply = h.reauthenticate(ctx, userDID, req)
+		} else {
+			reply.message = h.handleRequest(ctx, userDID, req)
+		}
+
+		select {
+		case replies <- reply:
+		case <-done:
+			return nil
+		}
+	}
+}
+
+func (h *WebSocketHandler) handleRequest(ctx context.Context, userDID string, req wsRequest) wsMessage {
+	fail := func(msg string) wsMessage {
+		return wsMessage{Type: wsMessageError, RequestID: req.RequestID, Error: msg}
+	}
+
+	var payload interface{}
+	switch req.Type {
+	case wsRequestAck:
+		if req.ID == "" {
+			return fail("can't get notification id")
+		}
+		err := h.inboxService.Ack(ctx, userDID, req.ID)
+		switch {
+		case errors.Is(err, services.ErrNotificationNotOwned):
+			return fail("forbidden")
+		case errors.Is(err, services.ErrNotificationNotFound):
+			return fail("expired")
+		case errors.Is(err, services.ErrLegacyNotification):
+			return fail("notification without metadata can't be acknowledged")
+		case err != nil:
+			log.WithContext(ctx).Errorf("failed to update notification: %v", err)
+			return fail("failed to update notification")
+		}
+		payload = struct {
+			Success bool `json:"success"`
+		}{
+			Success: true,
+		}
+	case wsRequestInbox:
+		params := url.Values{}
+		for k, v := range req.Query {
+			params.Set(k, v)
+		}
+		q, err := parseInboxParams(params)
+		if err != nil {
+			return fail("invalid query: " + err.Error())
+		}
+		page, err := h.inboxService.List(ctx, userDID, q)
+		if errors.Is(err, services.ErrInvalidCursor) {
+			return fail("invalid query: " + err.Error())
+		} else if err != nil {
+			log.WithContext(ctx).Errorf("failed to get notifications: %v", err)
+			return fail("failed to get notifications")
+		}
+		payload = page
+	default:
+		return fail("unknown request type")
+	}
+
+	return wsMessage{Type: wsMessageResponse, RequestID: req.RequestID, Payload: payload}
+}
+
+// reauthenticate verifies a new token of the connection owner
+func (h *WebSocketHandler) reauthenticate(ctx context.Context, userDID string, req wsRequest) wsReply {
+	fail := func(msg string) wsReply {
+		return wsReply{message: wsMessage{Type: wsMessageError, RequestID: req.RequestID, Error: msg}}
+	}
+	if h.authenticator == nil {
+		return fail("re-authentication isn't supported")
+	}
+	if req.Token == "" {
+		return fail("can't get token")
+	}
+	d, validUntil, err := h.authenticator.Authenticate(ctx, req.Token)
+	if err != nil {
+		return fail("unauthorized: " + err.Error())
+	}
+	if d.String() != userDID {
+		return fail("forbidden")
+	}
+
+	var expiresAt *time.Time
+	if !validUntil.IsZero() {
+		expiresAt = &validUntil
+	}
+	return wsReply{
+		message: wsMessage{
+			Type:      wsMessageResponse,
+			RequestID: req.RequestID,
+			Payload: struct {
+				ExpiresAt *time.Time `json:"expires_at,omitempty"`
+			}{
+				ExpiresAt: expiresAt,
+			},
+		},
+		reauthenticated: true,
+		validUntil:      validUntil,
+	}
+}
+
+// notificationMessage builds message with new notification or subscription event
+func notificationMessage(data services.NotificationPayload) wsMessage {
+	msg := wsMessage{Type: wsMessageNotification, EventID: data.EventID, Payload: utils.EventData(data)}
+	if data.Event != "" {
+		msg.Type = data.Event
+	}
+	return msg
+}
+
+func (h *WebSocketHandler) write(conn *websocket.Conn, msg wsMessage) error {
+	if err := conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout)); err != nil {
+		return err
+	}
+	return conn.WriteJSON(msg)
+}
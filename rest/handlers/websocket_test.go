@@ -0,0 +1,217 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/iden3/go-iden3-core/v2/w3c"
+	"github.com/iden3/notification-service/rest/middleware"
+	"github.com/iden3/notification-service/services"
+	"github.com/stretchr/testify/require"
+)
+
+type wsInboxMock struct {
+	inboxService
+	acked []string
+}
+
+func (m *wsInboxMock) Ack(_ context.Context, requesterID, id string) error {
+	if !services.IsOwnedBy(id, requesterID) {
+		return services.ErrNotificationNotOwned
+	}
+	m.acked = append(m.acked, id)
+	return nil
+}
+
+func (m *wsInboxMock) List(_ context.Context, _ string, q services.InboxQuery) (services.InboxPage, error) {
+	return services.InboxPage{Total: q.Limit}, nil
+}
+
+type wsAuthenticatorMock struct {
+	did        string
+	validUntil time.Time
+}
+
+func (m wsAuthenticatorMock) Authenticate(_ context.Context, token string) (w3c.DID, time.Time, error) {
+	if token != "valid" {
+		return w3c.DID{}, time.Time{}, errors.New("invalid token")
+	}
+	d, err := w3c.ParseDID(m.did)
+	if err != nil {
+		return w3c.DID{}, time.Time{}, err
+	}
+	return *d, m.validUntil, nil
+}
+
+type wsTest struct {
+	h     *WebSocketHandler
+	sub   *services.SubscriptionService
+	inbox *wsInboxMock
+	conn  *websocket.Conn
+}
+
+// dialWebSocket opens connection of testDID authenticated until deadline, zero deadline doesn't expire
+func dialWebSocket(t *testing.T, deadline time.Time, opts ...WebSocketHandlerOption) *wsTest {
+	t.Helper()
+	test := &wsTest{
+		sub:   services.NewSubscriptionService(10, 10),
+		inbox: &wsInboxMock{},
+	}
+	h := NewWebSocketHandler(test.sub, test.inbox, time.Minute, opts...)
+	test.h = h
+	did, err := w3c.ParseDID(testDID)
+	require.NoError(t, err)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := middleware.WithDIDContext(r.Context(), *did)
+		if !deadline.IsZero() {
+			ctx = middleware.WithAuthDeadlineContext(ctx, deadline)
+		}
+		h.Subscribe(w, r.WithContext(ctx))
+	}))
+	t.Cleanup(srv.Close)
+
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http"), nil)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+	test.conn = conn
+	return test
+}
+
+func (test *wsTest) request(t *testing.T, req wsRequest) wsMessage {
+	t.Helper()
+	require.NoError(t, test.conn.WriteJSON(req))
+	return test.read(t)
+}
+
+func (test *wsTest) read(t *testing.T) wsMessage {
+	t.Helper()
+	require.NoError(t, test.conn.SetReadDeadline(time.Now().Add(time.Second)))
+	var msg wsMessage
+	require.NoError(t, test.conn.ReadJSON(&msg))
+	return msg
+}
+
+// closeReason reads messages until the server closes the connection
+func (test *wsTest) closeReason(t *testing.T) string {
+	t.Helper()
+	require.NoError(t, test.conn.SetReadDeadline(time.Now().Add(time.Second)))
+	for {
+		_, _, err := test.conn.ReadMessage()
+		var closeErr *websocket.CloseError
+		if errors.As(err, &closeErr) {
+			require.Equal(t, websocket.CloseNormalClosure, closeErr.Code)
+			return closeErr.Text
+		}
+		require.NoError(t, err)
+	}
+}
+
+func TestWebSocketHandler_Unauthenticated(t *testing.T) {
+	h := NewWebSocketHandler(services.NewSubscriptionService(10, 10), &wsInboxMock{}, time.Minute)
+	w := httptest.NewRecorder()
+	h.Subscribe(w, httptest.NewRequest(http.MethodGet, "/api/v2/ws", nil))
+	require.Equal(t, http.StatusBadRequest, w.Code)
+}
+
+func TestWebSocketHandler_Messages(t *testing.T) {
+	test := dialWebSocket(t, time.Time{})
+
+	require.True(t, test.sub.Notify(testDID, services.NotificationPayload{ID: "1", EventID: "1-0"}))
+	msg := test.read(t)
+	require.Equal(t, wsMessageNotification, msg.Type)
+	require.Equal(t, "1-0", msg.EventID)
+
+	msg = test.request(t, wsRequest{Type: wsRequestAck, RequestID: "1", ID: testDID + "+a"})
+	require.Equal(t, wsMessage{Type: wsMessageResponse, RequestID: "1",
+		Payload: map[string]interface{}{"success": true}}, msg)
+	require.Equal(t, []string{testDID + "+a"}, test.inbox.acked)
+
+	msg = test.request(t, wsRequest{Type: wsRequestAck, RequestID: "2", ID: "did:example:other+a"})
+	require.Equal(t, wsMessage{Type: wsMessageError, RequestID: "2", Error: "forbidden"}, msg)
+
+	msg = test.request(t, wsRequest{Type: wsRequestInbox, RequestID: "3", Query: map[string]string{"limit": "5"}})
+	require.Equal(t, wsMessageResponse, msg.Type)
+	require.Equal(t, "3", msg.RequestID)
+	require.EqualValues(t, 5, msg.Payload.(map[string]interface{})["total"])
+
+	msg = test.request(t, wsRequest{Type: "unknown", RequestID: "4"})
+	require.Equal(t, wsMessage{Type: wsMessageError, RequestID: "4", Error: "unknown request type"}, msg)
+
+	require.NoError(t, test.conn.WriteMessage(websocket.TextMessage, []byte("not json")))
+	require.Equal(t, wsMessage{Type: wsMessageError, Error: "can't bind request"}, test.read(t))
+}
+
+func TestWebSocketHandler_CloseReason(t *testing.T) {
+	test := dialWebSocket(t, time.Time{})
+	require.Equal(t, 1, test.sub.CloseAll(services.CloseReasonServerShutdown))
+	require.Equal(t, services.CloseReasonServerShutdown, test.closeReason(t))
+
+	test = dialWebSocket(t, time.Time{})
+	require.Equal(t, 1, test.sub.UnsubscribeAll(testDID))
+	require.Equal(t, services.CloseReasonUnsubscribed, test.closeReason(t))
+}
+
+func TestWebSocketHandler_AuthExpired(t *testing.T) {
+	test := dialWebSocket(t, time.Now().Add(100*time.Millisecond))
+	require.Equal(t, services.CloseReasonAuthExpired, test.closeReason(t))
+}
+
+func TestWebSocketHandler_Reauthentication(t *testing.T) {
+	validUntil := time.Now().Add(time.Hour).UTC()
+	test := dialWebSocket(t, time.Now().Add(300*time.Millisecond),
+		WithReauthentication(wsAuthenticatorMock{did: testDID, validUntil: validUntil}))
+
+	msg := test.request(t, wsRequest{Type: wsRequestAuth, RequestID: "1", Token: "invalid"})
+	require.Equal(t, wsMessage{Type: wsMessageError, RequestID: "1", Error: "unauthorized: invalid token"}, msg)
+
+	msg = test.request(t, wsRequest{Type: wsRequestAuth, RequestID: "2", Token: "valid"})
+	require.Equal(t, wsMessageResponse, msg.Type)
+	require.Equal(t, validUntil.Format(time.RFC3339Nano), msg.Payload.(map[string]interface{})["expires_at"])
+
+	// the connection outlives the first token
+	require.NoError(t, test.conn.SetReadDeadline(time.Now().Add(time.Second)))
+	_, _, err := test.conn.ReadMessage()
+	var netErr net.Error
+	require.ErrorAs(t, err, &netErr)
+	require.True(t, netErr.Timeout())
+}
+
+func TestWebSocketHandler_ReauthenticationForbidden(t *testing.T) {
+	test := dialWebSocket(t, time.Time{},
+		WithReauthentication(wsAuthenticatorMock{did: "did:iden3:polygon:amoy:xBdqiqz3yVT79NEAuNaqKSDZ6a5V6q8Ph66i5d2tT"}))
+	msg := test.request(t, wsRequest{Type: wsRequestAuth, RequestID: "1", Token: "valid"})
+	require.Equal(t, wsMessage{Type: wsMessageError, RequestID: "1", Error: "forbidden"}, msg)
+
+	// connections without authenticator can't be extended
+	test = dialWebSocket(t, time.Time{})
+	msg = test.request(t, wsRequest{Type: wsRequestAuth, RequestID: "2", Token: "valid"})
+	require.Equal(t, wsMessage{Type: wsMessageError, RequestID: "2", Error: "re-authentication isn't supported"}, msg)
+}
+
+func TestWebSocketHandler_Shutdown(t *testing.T) {
+	test := dialWebSocket(t, time.Time{})
+
+	// open connections are awaited
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	require.ErrorIs(t, test.h.Shutdown(ctx), context.DeadlineExceeded)
+
+	test.sub.CloseAll(services.CloseReasonServerShutdown)
+	require.NoError(t, test.h.Shutdown(context.Background()))
+	require.Equal(t, services.CloseReasonServerShutdown, test.closeReason(t))
+
+	// new connections are rejected
+	w := httptest.NewRecorder()
+	did, err := w3c.ParseDID(testDID)
+	require.NoError(t, err)
+	r := httptest.NewRequest(http.MethodGet, "/api/v2/ws", nil)
+	test.h.Subscribe(w, r.WithContext(middleware.WithDIDContext(r.Context(), *did)))
+	require.Equal(t, http.StatusServiceUnavailable, w.Code)
+}
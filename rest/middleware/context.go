@@ -2,12 +2,15 @@ package middleware
 
 import (
 	"context"
+	"time"
 
 	"github.com/iden3/go-iden3-core/v2/w3c"
 )
 
 type fromDIDKey struct{}
 
+type authDeadlineKey struct{}
+
 // GetDIDFromContext retrieves the fromDID from the request context.
 func GetDIDFromContext(ctx context.Context) (w3c.DID, bool) {
 	did, ok := ctx.Value(fromDIDKey{}).(w3c.DID)
@@ -18,3 +21,15 @@ func GetDIDFromContext(ctx context.Context) (w3c.DID, bool) {
 func WithDIDContext(ctx context.Context, did w3c.DID) context.Context {
 	return context.WithValue(ctx, fromDIDKey{}, did)
 }
+
+// GetAuthDeadlineFromContext retrieves time when credentials of the request expire.
+// Requests without the deadline are authenticated with credentials that don't expire.
+func GetAuthDeadlineFromContext(ctx context.Context) (time.Time, bool) {
+	deadline, ok := ctx.Value(authDeadlineKey{}).(time.Time)
+	return deadline, ok
+}
+
+// WithAuthDeadlineContext adds time when credentials of the request expire to the request context.
+func WithAuthDeadlineContext(ctx context.Context, deadline time.Time) context.Context {
+	return context.WithValue(ctx, authDeadlineKey{}, deadline)
+}
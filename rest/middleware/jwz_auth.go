@@ -1,6 +1,7 @@
 package middleware
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -13,12 +14,14 @@ import (
 	"github.com/iden3/go-iden3-auth/v2/loaders"
 	"github.com/iden3/go-iden3-auth/v2/pubsignals"
 	core "github.com/iden3/go-iden3-core/v2"
+	"github.com/iden3/go-iden3-core/v2/w3c"
 	"github.com/iden3/go-jwz/v2"
 	"github.com/iden3/iden3comm/v2"
 	"github.com/iden3/iden3comm/v2/protocol"
 )
 
-type jwzAuthMiddleware struct {
+// JWZAuthenticator verifies JWZ of authorization response messages
+type JWZAuthenticator struct {
 	verifier    *auth.Verifier
 	verifierDID string
 
@@ -27,26 +30,26 @@ type jwzAuthMiddleware struct {
 	jwzGenerationDelay   time.Duration
 }
 
-// JWZAuthOption configures jwzAuthMiddleware optional parameters.
-type JWZAuthOption func(*jwzAuthMiddleware)
+// JWZAuthOption configures JWZAuthenticator optional parameters.
+type JWZAuthOption func(*JWZAuthenticator)
 
 // WithStateTransitionDelay sets a delay expected between state transitions and their verification.
 func WithStateTransitionDelay(d time.Duration) JWZAuthOption {
-	return func(m *jwzAuthMiddleware) {
+	return func(m *JWZAuthenticator) {
 		m.stateTransitionDelay = d
 	}
 }
 
 // WithProofGenerationDelay sets an expected delay for proof generation.
 func WithProofGenerationDelay(d time.Duration) JWZAuthOption {
-	return func(m *jwzAuthMiddleware) {
+	return func(m *JWZAuthenticator) {
 		m.proofGenerationDelay = d
 	}
 }
 
 // WithJWZGenerationDelay sets an expected delay for JWK generation.
 func WithJWZGenerationDelay(d time.Duration) JWZAuthOption {
-	return func(m *jwzAuthMiddleware) {
+	return func(m *JWZAuthenticator) {
 		m.jwzGenerationDelay = d
 	}
 }
@@ -58,6 +61,19 @@ func NewJWZAuthMiddleware(
 	verifierDID string,
 	opts ...JWZAuthOption,
 ) (func(http.Handler) http.Handler, error) {
+	m, err := NewJWZAuthenticator(resolver, verifierDID, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return m.JWZAuth, nil
+}
+
+// NewJWZAuthenticator creates a JWZ authenticator. JWZAuth method is the authentication middleware.
+func NewJWZAuthenticator(
+	resolver map[string]pubsignals.StateResolver,
+	verifierDID string,
+	opts ...JWZAuthOption,
+) (*JWZAuthenticator, error) {
 	v, err := auth.NewVerifier(
 		loaders.NewEmbeddedKeyLoader(),
 		resolver,
@@ -65,7 +81,7 @@ func NewJWZAuthMiddleware(
 	if err != nil {
 		return nil, err
 	}
-	m := &jwzAuthMiddleware{
+	m := &JWZAuthenticator{
 		verifier:    v,
 		verifierDID: verifierDID,
 	}
@@ -74,10 +90,10 @@ func NewJWZAuthMiddleware(
 			opt(m)
 		}
 	}
-	return m.JWZAuth, nil
+	return m, nil
 }
 
-func (v *jwzAuthMiddleware) getVerifyOpts() []pubsignals.VerifyOpt {
+func (v *JWZAuthenticator) getVerifyOpts() []pubsignals.VerifyOpt {
 	opts := []pubsignals.VerifyOpt{
 		pubsignals.WithAllowExpiredMessages(false),
 	}
@@ -92,7 +108,7 @@ func (v *jwzAuthMiddleware) getVerifyOpts() []pubsignals.VerifyOpt {
 	return opts
 }
 
-func (v *jwzAuthMiddleware) JWZAuth(next http.Handler) http.Handler {
+func (v *JWZAuthenticator) JWZAuth(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		authHeader := r.Header.Get("Authorization")
 		if authHeader == "" {
@@ -107,37 +123,48 @@ func (v *jwzAuthMiddleware) JWZAuth(next http.Handler) http.Handler {
 
 		jwzToken := authHeaderParts[1]
 
-		t, err := v.verifier.VerifyJWZ(r.Context(),
-			jwzToken, v.getVerifyOpts()...)
+		fromDID, validUntil, err := v.Authenticate(r.Context(), jwzToken)
 		if err != nil {
 			http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
 			return
 		}
 
-		if err := v.validateToken(t); err != nil {
-			http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
-			return
-		}
-
-		authPubinputs := &circuits.AuthV2PubSignals{}
-		if err := t.ParsePubSignals(authPubinputs); err != nil {
-			http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
-			return
-		}
-		fromDID, err := core.ParseDIDFromID(*authPubinputs.UserID)
-		if err != nil {
-			http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
-			return
+		ctx := WithDIDContext(r.Context(), fromDID)
+		if !validUntil.IsZero() {
+			ctx = WithAuthDeadlineContext(ctx, validUntil)
 		}
-
-		ctx := WithDIDContext(r.Context(), *fromDID)
 		r = r.WithContext(ctx)
 
 		next.ServeHTTP(w, r)
 	})
 }
 
-func (v *jwzAuthMiddleware) validateRecipient(msg *iden3comm.BasicMessage) error {
+// Authenticate verifies jwzToken and returns DID of the sender and time when the token expires.
+// Zero time is returned if JWZ generation delay isn't set, so tokens don't expire.
+func (v *JWZAuthenticator) Authenticate(ctx context.Context, jwzToken string) (w3c.DID, time.Time, error) {
+	t, err := v.verifier.VerifyJWZ(ctx,
+		jwzToken, v.getVerifyOpts()...)
+	if err != nil {
+		return w3c.DID{}, time.Time{}, err
+	}
+
+	validUntil, err := v.validateToken(t)
+	if err != nil {
+		return w3c.DID{}, time.Time{}, err
+	}
+
+	authPubinputs := &circuits.AuthV2PubSignals{}
+	if err := t.ParsePubSignals(authPubinputs); err != nil {
+		return w3c.DID{}, time.Time{}, err
+	}
+	fromDID, err := core.ParseDIDFromID(*authPubinputs.UserID)
+	if err != nil {
+		return w3c.DID{}, time.Time{}, err
+	}
+	return *fromDID, validUntil, nil
+}
+
+func (v *JWZAuthenticator) validateRecipient(msg *iden3comm.BasicMessage) error {
 	if msg.To != v.verifierDID {
 		return fmt.Errorf("invalid 'to' field in jwz, expected '%s', got '%s'",
 			v.verifierDID, msg.To)
@@ -145,46 +172,44 @@ func (v *jwzAuthMiddleware) validateRecipient(msg *iden3comm.BasicMessage) error
 	return nil
 }
 
-func (v *jwzAuthMiddleware) validateExpiration(msg *iden3comm.BasicMessage) error {
+// validateExpiration returns time when the token expires
+func (v *JWZAuthenticator) validateExpiration(msg *iden3comm.BasicMessage) (time.Time, error) {
 	if v.jwzGenerationDelay == 0 {
-		return nil
+		return time.Time{}, nil
 	}
 
 	if msg.CreatedTime == nil {
-		return errors.New("missing created time in basic message")
+		return time.Time{}, errors.New("missing created time in basic message")
 	}
 
 	createdAt := time.Unix(*msg.CreatedTime, 0)
 	tnow := time.Now().UTC()
 
 	if createdAt.After(tnow.Add(5 * time.Minute)) {
-		return errors.New("jwz has invalid created time in the future")
+		return time.Time{}, errors.New("jwz has invalid created time in the future")
 	}
 
-	if createdAt.Add(v.jwzGenerationDelay).Before(tnow) {
-		return errors.New("jwz has expired")
+	validUntil := createdAt.Add(v.jwzGenerationDelay)
+	if validUntil.Before(tnow) {
+		return time.Time{}, errors.New("jwz has expired")
 	}
-	return nil
+	return validUntil, nil
 }
 
-func (v *jwzAuthMiddleware) validateToken(t *jwz.Token) error {
+func (v *JWZAuthenticator) validateToken(t *jwz.Token) (time.Time, error) {
 	basicMessage := &iden3comm.BasicMessage{}
 	if err := json.Unmarshal(t.GetPayload(), basicMessage); err != nil {
-		return fmt.Errorf("failed to unmarshal basic message: %w", err)
+		return time.Time{}, fmt.Errorf("failed to unmarshal basic message: %w", err)
 	}
 
 	if basicMessage.Type != protocol.AuthorizationResponseMessageType {
-		return fmt.Errorf("invalid message type '%s' expected",
+		return time.Time{}, fmt.Errorf("invalid message type '%s' expected",
 			protocol.AuthorizationResponseMessageType)
 	}
 
 	if err := v.validateRecipient(basicMessage); err != nil {
-		return err
-	}
-
-	if err := v.validateExpiration(basicMessage); err != nil {
-		return err
+		return time.Time{}, err
 	}
 
-	return nil
+	return v.validateExpiration(basicMessage)
 }
@@ -0,0 +1,18 @@
+package middleware
+
+import "net/http"
+
+// OptionalAuth applies auth middleware only to requests with Authorization header.
+// Anonymous requests are passed through without DID in the request context.
+func OptionalAuth(auth func(http.Handler) http.Handler) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		authenticated := auth(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Authorization") == "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			authenticated.ServeHTTP(w, r)
+		})
+	}
+}
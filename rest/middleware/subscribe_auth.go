@@ -0,0 +1,74 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/iden3/go-iden3-core/v2/w3c"
+	"github.com/iden3/notification-service/log"
+	"github.com/iden3/notification-service/services"
+)
+
+// SubscribeTicketParam is a query parameter with single-use subscribe ticket
+const SubscribeTicketParam = "ticket"
+
+type subscribeAuthenticator interface {
+	RedeemTicket(ctx context.Context, ticket string) (string, time.Time, error)
+	ResolveSession(ctx context.Context, session string) (string, time.Time, error)
+}
+
+// SubscribeAuth authenticates subscriptions of browsers which can't set Authorization header.
+// Requests with Authorization header are authenticated by auth, others by single-use ticket
+// in the query or by session cookie. Empty cookieName disables sessions.
+func SubscribeAuth(auth func(http.Handler) http.Handler,
+	a subscribeAuthenticator, cookieName string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		authenticated := auth(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var (
+				userDID    string
+				validUntil time.Time
+				err        error
+			)
+			switch {
+			case r.Header.Get("Authorization") != "":
+				authenticated.ServeHTTP(w, r)
+				return
+			case r.URL.Query().Has(SubscribeTicketParam):
+				userDID, validUntil, err = a.RedeemTicket(r.Context(), r.URL.Query().Get(SubscribeTicketParam))
+			case cookieName != "":
+				c, cerr := r.Cookie(cookieName)
+				if cerr != nil {
+					http.Error(w, "Unauthorized", http.StatusUnauthorized)
+					return
+				}
+				userDID, validUntil, err = a.ResolveSession(r.Context(), c.Value)
+			default:
+				http.Error(w, "Unauthorized", http.StatusUnauthorized)
+				return
+			}
+
+			if errors.Is(err, services.ErrInvalidSubscribeToken) {
+				http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
+				return
+			} else if err != nil {
+				log.WithContext(r.Context()).Errorf("failed to authenticate subscription: %v", err)
+				http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+				return
+			}
+			did, err := w3c.ParseDID(userDID)
+			if err != nil {
+				http.Error(w, "Unauthorized: "+err.Error(), http.StatusUnauthorized)
+				return
+			}
+
+			ctx := WithDIDContext(r.Context(), *did)
+			if !validUntil.IsZero() {
+				ctx = WithAuthDeadlineContext(ctx, validUntil)
+			}
+			next.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
@@ -9,27 +9,44 @@ import (
 	"github.com/go-chi/render"
 	"github.com/iden3/notification-service/config"
 	"github.com/iden3/notification-service/rest/handlers"
+	restmiddleware "github.com/iden3/notification-service/rest/middleware"
 )
 
 // Handlers server handlers
 type Handlers struct {
-	proxyHandler *handlers.PushNotificationHandler
-	keyHandler   *handlers.KeyHandler
+	proxyHandler   *handlers.PushNotificationHandler
+	keyHandler     *handlers.KeyHandler
+	inboxHandler   *handlers.InboxHandler
+	accountHandler *handlers.AccountHandler
+	wsHandler      *handlers.WebSocketHandler
+	ticketHandler  *handlers.SubscribeAuthHandler
 
 	authmiddleware func(http.Handler) http.Handler
-	corsCfg        config.CORS
+	// subscribeAuth accepts subscribe tickets and sessions besides JWZ
+	subscribeAuth func(http.Handler) http.Handler
+	corsCfg       config.CORS
 }
 
 // NewHandlers create handlers.
 func NewHandlers(
 	p *handlers.PushNotificationHandler,
 	k *handlers.KeyHandler,
+	i *handlers.InboxHandler,
+	acc *handlers.AccountHandler,
+	ws *handlers.WebSocketHandler,
+	t *handlers.SubscribeAuthHandler,
 	a func(http.Handler) http.Handler,
+	sa func(http.Handler) http.Handler,
 	corsCfg config.CORS) *Handlers {
 	return &Handlers{
 		proxyHandler:   p,
 		keyHandler:     k,
+		inboxHandler:   i,
+		accountHandler: acc,
+		wsHandler:      ws,
+		ticketHandler:  t,
 		authmiddleware: a,
+		subscribeAuth:  sa,
 		corsCfg:        corsCfg,
 	}
 }
@@ -47,7 +64,7 @@ func (s *Handlers) Routes() chi.Router {
 		AllowedOrigins:   s.corsCfg.AllowedOrigins,
 		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
 		AllowedHeaders:   s.corsCfg.AllowedHeaders,
-		AllowCredentials: false,
+		AllowCredentials: s.corsCfg.AllowCredentials,
 		MaxAge:           s.corsCfg.MaxAge,
 	}))
 
@@ -65,12 +82,44 @@ func (s *Handlers) Routes() chi.Router {
 			Get("/all", s.proxyHandler.GetAllMessagesByUniqueID)
 
 		api.Get("/{id}", s.proxyHandler.Get)
-		api.Post("/{id}/ack", s.proxyHandler.AckMessage)
+		// authentication is required only for messages bound to uniqueID
+		api.With(restmiddleware.OptionalAuth(s.authmiddleware)).
+			Post("/{id}/ack", s.inboxHandler.Ack)
 
-		api.With(s.authmiddleware).
+		// browser EventSource can't set Authorization header, so tickets and sessions are accepted
+		api.With(s.subscribeAuth).
 			Get("/subscribe", s.proxyHandler.SubscribeNotifications)
 	})
 	r.Route("/api/v2", func(api chi.Router) {
+		api.Route("/inbox", func(inbox chi.Router) {
+			inbox.Use(s.authmiddleware)
+			inbox.Get("/", s.inboxHandler.List)
+			inbox.Delete("/", s.inboxHandler.DeleteAll)
+			inbox.Get("/counts", s.inboxHandler.Counts)
+			inbox.Get("/usage", s.inboxHandler.Usage)
+			inbox.Post("/read", s.inboxHandler.MarkAsRead)
+			inbox.Delete("/{id}", s.inboxHandler.Delete)
+		})
+
+		api.Route("/me", func(me chi.Router) {
+			me.Use(s.authmiddleware)
+			me.Get("/export", s.accountHandler.Export)
+			me.Delete("/", s.accountHandler.Erase)
+		})
+
+		api.With(s.authmiddleware).
+			Get("/ws", s.wsHandler.Subscribe)
+
+		// long polling fallback of /api/v1/subscribe for networks which break SSE
+		api.With(s.subscribeAuth).
+			Get("/poll", s.proxyHandler.Poll)
+
+		api.Route("/subscribe", func(sub chi.Router) {
+			sub.With(s.authmiddleware).Post("/ticket", s.ticketHandler.Ticket)
+			sub.With(s.authmiddleware).Post("/session", s.ticketHandler.Session)
+			sub.With(s.authmiddleware).Delete("/session", s.ticketHandler.DeleteSession)
+		})
+
 		api.Get("/{id}", s.proxyHandler.GetV2)
 	})
 
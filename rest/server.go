@@ -23,10 +23,18 @@ func NewServer(router chi.Router, c config.Server) *Server {
 	return &Server{
 		Routes: router,
 		config: c,
+		httpServer: &http.Server{
+			Handler:           router,
+			ReadHeaderTimeout: c.ReadHeaderTimeout,
+			ReadTimeout:       c.ReadTimeout,
+			IdleTimeout:       c.IdleTimeout,
+			MaxHeaderBytes:    c.MaxHeaderBytes,
+		},
 	}
 }
 
-// Close closes connection to the server
+// Close stops accepting connections and waits for in-flight requests until ctx is done.
+// Streams aren't finished by the server, they have to be closed before.
 func (s *Server) Close(ctx context.Context) error {
 	return errors.WithStack(s.httpServer.Shutdown(ctx))
 }
@@ -34,13 +42,6 @@ func (s *Server) Close(ctx context.Context) error {
 // Run server
 func (s *Server) Run(port int) error {
 	log.Infof("Server starting on port %d", port)
-	s.httpServer = &http.Server{
-		Addr:              fmt.Sprintf(":%d", port),
-		Handler:           s.Routes,
-		ReadHeaderTimeout: s.config.ReadHeaderTimeout,
-		ReadTimeout:       s.config.ReadTimeout,
-		IdleTimeout:       s.config.IdleTimeout,
-		MaxHeaderBytes:    s.config.MaxHeaderBytes,
-	}
+	s.httpServer.Addr = fmt.Sprintf(":%d", port)
 	return errors.WithStack(s.httpServer.ListenAndServe())
 }
@@ -2,7 +2,9 @@ package utils
 
 import (
 	"encoding/json"
+	"fmt"
 	"log/slog"
+	"time"
 
 	"github.com/iden3/notification-service/log"
 	"github.com/iden3/notification-service/services"
@@ -10,11 +12,16 @@ import (
 
 const failedMarshalMessage = "event: error\ndata: {\"error\":\"failed to marshal payload\"}\n\n"
 
-// BuildEventMessage builds SSE event message for new notifications
+// BuildEventMessage builds SSE event message for new notifications and inbox changes.
+// Notifications coalesced for slow subscriber are sent as a single event with their number.
 func BuildEventMessage(payload services.NotificationPayload) string {
-	event := "event: new_notifications\n"
+	event := "event: " + EventName(payload) + "\n"
+	data := EventData(payload)
+	if payload.EventID != "" {
+		event += "id: " + payload.EventID + "\n"
+	}
 	message := "data: "
-	d, err := json.Marshal(payload)
+	d, err := json.Marshal(data)
 	if err != nil {
 		log.Error("Error marshaling new notifications", slog.String("error", err.Error()))
 		return failedMarshalMessage
@@ -22,8 +29,51 @@ func BuildEventMessage(payload services.NotificationPayload) string {
 	return event + message + string(d) + "\n\n"
 }
 
+// BuildRetryMessage builds SSE message with reconnection delay for clients
+func BuildRetryMessage(retry time.Duration) string {
+	return fmt.Sprintf("retry: %d\n\n", retry.Milliseconds())
+}
+
 // PingMessage builds SSE ping message
 const PingMessage = "event: ping\ndata: {}\n\n"
 
-// CloseMessage builds SSE close message
-const CloseMessage = "event: close\ndata: {\"reason\":\"unsubscribed\"}\n\n"
+// CoalescedEvent is data of event which replaces notifications coalesced for slow subscriber
+type CoalescedEvent struct {
+	Count int `json:"count"`
+}
+
+// SyncEvent is data of event about notifications read or deleted on another device
+type SyncEvent struct {
+	IDs    []string `json:"ids"`
+	Reason string   `json:"reason,omitempty"`
+}
+
+// EventName returns name of the event sent to subscriber
+func EventName(payload services.NotificationPayload) string {
+	if payload.Event == "" {
+		return "new_notifications"
+	}
+	return payload.Event
+}
+
+// EventData returns data sent to subscriber for the event
+func EventData(payload services.NotificationPayload) interface{} {
+	switch payload.Event {
+	case "":
+		return payload
+	case services.EventNotificationsCoalesced:
+		return CoalescedEvent{Count: payload.Count}
+	default:
+		return SyncEvent{IDs: payload.IDs, Reason: payload.Reason}
+	}
+}
+
+// BuildCloseMessage builds SSE close message with the reason why subscription was closed
+func BuildCloseMessage(reason string) string {
+	d, _ := json.Marshal(struct {
+		Reason string `json:"reason"`
+	}{
+		Reason: reason,
+	})
+	return "event: close\ndata: " + string(d) + "\n\n"
+}
@@ -2,25 +2,101 @@ package services
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"sync"
 	"time"
 
+	"github.com/iden3/notification-service/log"
 	"github.com/redis/go-redis/v9"
 )
 
-const redisStatus = "PONG"
+const (
+	redisStatus = "PONG"
+	// maxUpdateAttempts limits optimistic transaction retries of concurrent updates
+	maxUpdateAttempts = 5
+	// indexBackfillTTL is a minimal lifetime of index backfill marker
+	indexBackfillTTL = 24 * time.Hour
+)
+
+// ErrConcurrentUpdate is returned when value was modified concurrently on every update attempt
+var ErrConcurrentUpdate = errors.New("value was concurrently modified")
 
 // RedisCache for implementation of CacheService
 type RedisCache struct {
-	redisClient *redis.Client
+	redisClient redis.UniversalClient
+	cipher      *StorageCipher
+	keys        keySchema
+	// legacyKeys enables compatibility reads of un-namespaced keys
+	legacyKeys bool
+	quota      Quota
+	// subscriptionService and eventLog get events about expired notifications dropped from the index
+	subscriptionService subscriptionService
+	eventLog            eventLog
+	now                 func() time.Time
+}
+
+// RedisCacheOption configures RedisCache optional parameters.
+type RedisCacheOption func(*RedisCache)
+
+// WithExpirationEvents sends delete events to live subscriptions of the owner when expired
+// notifications are dropped from the index on read, so all devices of the user remove them.
+func WithExpirationEvents(sub subscriptionService, l eventLog) RedisCacheOption {
+	return func(r *RedisCache) {
+		r.subscriptionService = sub
+		r.eventLog = l
+	}
+}
+
+// WithEncryption encrypts stored values. Values are decrypted transparently on read,
+// plaintext values written before encryption was enabled are returned as is.
+func WithEncryption(c *StorageCipher) RedisCacheOption {
+	return func(r *RedisCache) {
+		r.cipher = c
+	}
+}
+
+// WithKeyPrefix stores keys under the prefix, so the service can share Redis database with other services.
+func WithKeyPrefix(prefix string) RedisCacheOption {
+	return func(r *RedisCache) {
+		r.keys = newKeySchema(prefix)
+	}
 }
 
-// NewRedisCacheService for constructing *RedisCacheService
-func NewRedisCacheService(client *redis.Client) *RedisCache {
-	return &RedisCache{
+// WithLegacyKeys enables reads, updates and deletes of un-namespaced keys written
+// before the key namespace was introduced. New values are written to the namespace only.
+func WithLegacyKeys(enabled bool) RedisCacheOption {
+	return func(r *RedisCache) {
+		r.legacyKeys = enabled
+	}
+}
+
+// WithQuota limits notifications stored per uniqueID.
+// Notifications written without the key namespace don't take the quota.
+func WithQuota(q Quota) RedisCacheOption {
+	return func(r *RedisCache) {
+		r.quota = q
+	}
+}
+
+// NewRedisCacheService for constructing *RedisCacheService.
+// client can be standalone, sentinel or cluster client.
+func NewRedisCacheService(client redis.UniversalClient, opts ...RedisCacheOption) *RedisCache {
+	r := &RedisCache{
 		redisClient: client,
+		keys:        newKeySchema(""),
+		now:         time.Now,
 	}
+	for _, opt := range opts {
+		if opt != nil {
+			opt(r)
+		}
+	}
+	return r
 }
 
 // Ping check redis status.
@@ -40,79 +116,1109 @@ func (r RedisCache) Ping(ctx context.Context) error {
 // Get for retrieving value from cache by key.
 // If key doesn't exist in cache return nil, nil.
 func (r RedisCache) Get(ctx context.Context, key string) (interface{}, error) {
-	v, err := r.redisClient.Get(ctx, key).Result()
+	for _, schema := range r.schemas() {
+		v, err := r.redisClient.Get(ctx, schema.value(key)).Result()
+
+		// redis is working. But the value does not exist in cache.
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil { // redis return "real" error.
+			return nil, err
+		}
+
+		return r.decode(key, v)
+	}
+	return nil, nil
+}
+
+func (r RedisCache) Delete(ctx context.Context, keys ...string) error {
+	for _, schema := range r.schemas() {
+		_, err := r.del(ctx, schema.values(keys)...)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Scan get all keys by prefix.
+func (r RedisCache) Scan(ctx context.Context, prefix string) ([]string, error) {
+	var (
+		mu     sync.Mutex
+		values []string
+	)
+
+	// SCAN iterates keys of a single node, so in cluster mode every master is scanned
+	err := r.forEachNode(ctx, func(ctx context.Context, client redis.UniversalClient) error {
+		var cursor uint64
+		for {
+			var keys []string
+			var err error
+			keys, cursor, err = client.Scan(ctx, cursor, prefix, 10).Result()
+			if err != nil {
+				return err
+			}
+			mu.Lock()
+			values = append(values, keys...)
+			mu.Unlock()
+			if cursor == 0 {
+				return nil
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
 
-	// redis is working. But the value does not exist in cache.
-	if err == redis.Nil {
+	return values, nil
+}
+
+// SaveResult has IDs of notifications removed from the inbox when a notification is saved
+type SaveResult struct {
+	// Evicted notifications didn't fit the inbox quota
+	Evicted []string
+	// Expired notifications were dropped from the indexes
+	Expired []string
+}
+
+// SaveNotification stores the notification under key and registers it in the
+// per-uniqueID index, so the inbox can be listed without scanning the keyspace.
+// Returns ErrQuotaExceeded if the notification doesn't fit the inbox quota.
+// Notifications without uniqueID are stored as plain values.
+func (r RedisCache) SaveNotification(ctx context.Context, uniqueID, key string,
+	value interface{}, createdAt time.Time, duration time.Duration) (SaveResult, error) {
+	if uniqueID == "" {
+		return SaveResult{}, r.Set(ctx, key, value, duration)
+	}
+
+	value, err := r.encode(key, value)
+	if err != nil {
+		return SaveResult{}, err
+	}
+	res, err := saveNotificationScript.Run(ctx, r.redisClient,
+		[]string{
+			r.keys.value(key), r.keys.index(uniqueID), r.keys.expiryIndex(uniqueID),
+			r.keys.unreadIndex(uniqueID), r.keys.sizeIndex(uniqueID),
+		},
+		key, value, createdAt.UnixMilli(), createdAt.Add(duration).UnixMilli(), duration.Milliseconds(),
+		r.now().UnixMilli(), r.quota.MaxCount, r.quota.MaxBytes, string(r.quota.Policy),
+	).Slice()
+	if err != nil {
+		return SaveResult{}, err
+	}
+	if saved, _ := res[0].(int64); saved == 0 {
+		return SaveResult{}, ErrQuotaExceeded
+	}
+
+	result := SaveResult{Evicted: scriptStrings(res[1]), Expired: scriptStrings(res[2])}
+	if len(result.Evicted) > 0 {
+		log.WithContext(ctx).Debugf("evicted %d notifications of '%s' to fit inbox quota", len(result.Evicted), uniqueID)
+		// evicted values are already unindexed, the notification is saved even if they
+		// aren't removed and they expire by TTL
+		if _, err = r.del(ctx, r.keys.values(result.Evicted)...); err != nil {
+			log.WithContext(ctx).Warnf("failed to remove evicted notifications of '%s': %v", uniqueID, err)
+		}
+	}
+	return result, nil
+}
+
+// scriptStrings converts array returned by Lua script to strings
+func scriptStrings(v interface{}) []string {
+	values, _ := v.([]interface{})
+	strs := make([]string, 0, len(values))
+	for _, v := range values {
+		if s, ok := v.(string); ok {
+			strs = append(strs, s)
+		}
+	}
+	return strs
+}
+
+// saveNotificationScript stores the notification and adds it to the indexes of uniqueID.
+// Expired notifications are dropped from the indexes first, so they don't take the quota.
+// If the quota is exceeded the oldest notifications are evicted or the notification is rejected.
+// The script touches only KEYS, evicted notifications are unindexed and their values are
+// removed by the caller.
+// Notifications have different expiration time, so the indexes are kept
+// until the latest notification expires.
+// Returns {1, {evicted IDs...}, {expired IDs...}} if the notification is saved and {0} if it's rejected.
+var saveNotificationScript = redis.NewScript(`
+local id, value = ARGV[1], ARGV[2]
+local maxCount, maxBytes = tonumber(ARGV[7]), tonumber(ARGV[8])
+local size = string.len(value)
+
+local function unindex(member)
+	redis.call('ZREM', KEYS[2], member)
+	redis.call('ZREM', KEYS[3], member)
+	redis.call('ZREM', KEYS[4], member)
+	redis.call('HDEL', KEYS[5], member)
+end
+
+local expired = redis.call('ZRANGEBYSCORE', KEYS[3], '-inf', ARGV[6])
+for _, member in ipairs(expired) do
+	unindex(member)
+end
+
+if maxBytes > 0 and size > maxBytes then
+	return {0}
+end
+local count = redis.call('ZCARD', KEYS[2])
+local bytes = 0
+if maxBytes > 0 then
+	for _, v in ipairs(redis.call('HVALS', KEYS[5])) do
+		bytes = bytes + tonumber(v)
+	end
+end
+
+local evicted = {}
+while (maxCount > 0 and count >= maxCount) or (maxBytes > 0 and bytes + size > maxBytes) do
+	if ARGV[9] ~= 'evict' or count == 0 then
+		return {0}
+	end
+	local oldest = redis.call('ZRANGE', KEYS[2], 0, 0)[1]
+	bytes = bytes - tonumber(redis.call('HGET', KEYS[5], oldest) or '0')
+	count = count - 1
+	unindex(oldest)
+	table.insert(evicted, oldest)
+end
+
+redis.call('SET', KEYS[1], value, 'PX', ARGV[5])
+redis.call('ZADD', KEYS[2], ARGV[3], id)
+redis.call('ZADD', KEYS[3], ARGV[4], id)
+redis.call('ZADD', KEYS[4], ARGV[4], id)
+redis.call('HSET', KEYS[5], id, size)
+local latest = redis.call('ZRANGE', KEYS[3], -1, -1, 'WITHSCORES')
+for i = 2, #KEYS do
+	redis.call('PEXPIREAT', KEYS[i], latest[2])
+end
+return {1, evicted, expired}
+`)
+
+// GetAllByUniqueID get all values from the uniqueID index ordered by creation time.
+// Index members that point to expired or removed notifications are cleaned up lazily.
+func (r RedisCache) GetAllByUniqueID(ctx context.Context, uniqueID string) (values []interface{}, keys []string, err error) {
+	var items []indexedValue
+	for _, schema := range r.schemas() {
+		found, err := r.getIndexed(ctx, schema, uniqueID)
+		if err != nil {
+			return nil, nil, err
+		}
+		items = append(items, found...)
+	}
+	if len(items) == 0 {
+		return nil, nil, nil
+	}
+	// legacy and namespaced indexes are merged by creation time
+	sort.SliceStable(items, func(i, j int) bool {
+		return items[i].score < items[j].score
+	})
+
+	values = make([]interface{}, len(items))
+	keys = make([]string, len(items))
+	for i, item := range items {
+		values[i] = item.value
+		keys[i] = item.id
+	}
+	return values, keys, nil
+}
+
+// IndexQuery selects a page of notifications from the uniqueID index
+type IndexQuery struct {
+	// Since and Until limit creation time of notifications, zero value disables the limit
+	Since time.Time
+	Until time.Time
+	// After is a position of the last notification of the previous page
+	After *IndexPosition
+	Desc  bool
+	Limit int64
+}
+
+// IndexPosition is a position of notification in the index ordered by
+// creation time in milliseconds and by ID for the same time
+type IndexPosition struct {
+	CreatedAt int64
+	ID        string
+}
+
+// IndexedNotification is a notification value with its position in the index
+type IndexedNotification struct {
+	IndexPosition
+	Value interface{}
+}
+
+// GetPageByUniqueID returns up to q.Limit notifications of uniqueID from the index.
+// Only members of the page are read, so the cost doesn't depend on the inbox size.
+// more is set if the index has notifications after the page.
+func (r RedisCache) GetPageByUniqueID(ctx context.Context, uniqueID string,
+	q IndexQuery) (page []IndexedNotification, more bool, err error) {
+	type candidate struct {
+		IndexPosition
+		schema keySchema
+	}
+	var candidates []candidate
+	for _, schema := range r.schemas() {
+		if schema == legacyKeySchema {
+			if err := r.backfillIndex(ctx, schema, uniqueID); err != nil {
+				return nil, false, err
+			}
+		}
+		if err := r.removeExpired(ctx, schema, uniqueID); err != nil {
+			return nil, false, err
+		}
+		positions, err := r.rangeIndex(ctx, schema, uniqueID, q)
+		if err != nil {
+			return nil, false, err
+		}
+		for _, p := range positions {
+			candidates = append(candidates, candidate{IndexPosition: p, schema: schema})
+		}
+	}
+	// legacy and namespaced indexes are merged
+	sort.Slice(candidates, func(i, j int) bool {
+		if q.Desc {
+			return candidates[j].IndexPosition.less(candidates[i].IndexPosition)
+		}
+		return candidates[i].IndexPosition.less(candidates[j].IndexPosition)
+	})
+	if int64(len(candidates)) > q.Limit {
+		candidates, more = candidates[:q.Limit], true
+	}
+	if len(candidates) == 0 {
+		return nil, more, nil
+	}
+
+	keys := make([]string, len(candidates))
+	for i, c := range candidates {
+		keys[i] = c.schema.value(c.ID)
+	}
+	values, err := r.mget(ctx, keys...)
+	if err != nil {
+		return nil, false, err
+	}
+	ids := make([]string, len(candidates))
+	for i, c := range candidates {
+		ids[i] = c.ID
+	}
+	if err = r.decodeAll(ids, values); err != nil {
+		return nil, false, err
+	}
+	page = make([]IndexedNotification, 0, len(candidates))
+	for i, v := range values {
+		if v == nil {
+			// notification removed without the index is dropped, the page can be shorter than the limit
+			if err := r.removeFromIndex(ctx, candidates[i].schema, uniqueID, candidates[i].ID); err != nil {
+				return nil, false, err
+			}
+			continue
+		}
+		page = append(page, IndexedNotification{IndexPosition: candidates[i].IndexPosition, Value: v})
+	}
+	return page, more, nil
+}
+
+// rangeIndex returns positions of up to q.Limit+1 notifications of the query from the index of schema
+func (r RedisCache) rangeIndex(ctx context.Context, schema keySchema, uniqueID string,
+	q IndexQuery) ([]IndexPosition, error) {
+	lo, hi := math.Inf(-1), math.Inf(1)
+	if !q.Since.IsZero() {
+		lo = float64(q.Since.UnixMilli())
+	}
+	if !q.Until.IsZero() {
+		hi = float64(q.Until.UnixMilli())
+	}
+	// notifications created at the same millisecond as the cursor are read from the start
+	// and skipped up to the cursor ID
+	var skip int64
+	if q.After != nil {
+		at := float64(q.After.CreatedAt)
+		if q.Desc {
+			hi = math.Min(hi, at)
+		} else {
+			lo = math.Max(lo, at)
+		}
+		if at >= lo && at <= hi {
+			n, err := r.redisClient.ZCount(ctx, schema.index(uniqueID), scoreBound(at), scoreBound(at)).Result()
+			if err != nil {
+				return nil, err
+			}
+			skip = n
+		}
+	}
+	if lo > hi {
 		return nil, nil
 	}
-	if err != nil { // redis return "real" error.
+
+	members, err := r.redisClient.ZRangeArgsWithScores(ctx, redis.ZRangeArgs{
+		Key:     schema.index(uniqueID),
+		Start:   scoreBound(lo),
+		Stop:    scoreBound(hi),
+		ByScore: true,
+		Rev:     q.Desc,
+		Count:   q.Limit + 1 + skip,
+	}).Result()
+	if err != nil {
 		return nil, err
 	}
+	positions := make([]IndexPosition, 0, len(members))
+	for _, m := range members {
+		p := IndexPosition{CreatedAt: int64(m.Score), ID: m.Member.(string)}
+		if q.After != nil && p.CreatedAt == q.After.CreatedAt &&
+			((!q.Desc && p.ID <= q.After.ID) || (q.Desc && p.ID >= q.After.ID)) {
+			continue
+		}
+		positions = append(positions, p)
+	}
+	if int64(len(positions)) > q.Limit+1 {
+		positions = positions[:q.Limit+1]
+	}
+	return positions, nil
+}
 
-	return v, nil
+func (p IndexPosition) less(o IndexPosition) bool {
+	if p.CreatedAt != o.CreatedAt {
+		return p.CreatedAt < o.CreatedAt
+	}
+	return p.ID < o.ID
 }
 
-func (r RedisCache) Delete(ctx context.Context, keys ...string) error {
-	_, err := r.redisClient.Del(ctx, keys...).Result()
+// scoreBound formats sorted set score bound
+func scoreBound(v float64) string {
+	switch {
+	case math.IsInf(v, -1):
+		return "-inf"
+	case math.IsInf(v, 1):
+		return "+inf"
+	}
+	return strconv.FormatInt(int64(v), 10)
+}
+
+type indexedValue struct {
+	id    string
+	score float64
+	value interface{}
+}
+
+func (r RedisCache) getIndexed(ctx context.Context, schema keySchema, uniqueID string) ([]indexedValue, error) {
+	// values of the namespace are indexed on write, only legacy values can miss the index
+	if schema == legacyKeySchema {
+		if err := r.backfillIndex(ctx, schema, uniqueID); err != nil {
+			return nil, err
+		}
+	}
+	if err := r.removeExpired(ctx, schema, uniqueID); err != nil {
+		return nil, err
+	}
+
+	members, err := r.redisClient.ZRangeWithScores(ctx, schema.index(uniqueID), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	if len(members) == 0 {
+		return nil, nil
+	}
+
+	ids := make([]string, len(members))
+	for i, m := range members {
+		ids[i] = m.Member.(string)
+	}
+	all, err := r.mget(ctx, schema.values(ids)...)
+	if err != nil {
+		return nil, err
+	}
+	if err = r.decodeAll(ids, all); err != nil {
+		return nil, err
+	}
+
+	var dead []string
+	items := make([]indexedValue, 0, len(ids))
+	for i, v := range all {
+		if v == nil {
+			dead = append(dead, ids[i])
+			continue
+		}
+		items = append(items, indexedValue{id: ids[i], score: members[i].Score, value: v})
+	}
+	if err = r.removeFromIndex(ctx, schema, uniqueID, dead...); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+// backfillIndex adds notifications of uniqueID stored before the index was introduced
+// to the indexes. The keyspace is scanned once per uniqueID, the marker of the backfill
+// is kept until the backfilled notifications expire.
+func (r RedisCache) backfillIndex(ctx context.Context, schema keySchema, uniqueID string) error {
+	marker := schema.indexBackfill(uniqueID)
+	fresh, err := r.redisClient.SetNX(ctx, marker, r.now().UnixMilli(), indexBackfillTTL).Result()
+	if err != nil || !fresh {
+		return err
+	}
+	if err := r.indexUnindexed(ctx, schema, uniqueID); err != nil {
+		// backfill is retried by the next listing
+		if err := r.redisClient.Del(context.WithoutCancel(ctx), marker).Err(); err != nil {
+			log.WithContext(ctx).Warnf("failed to remove index backfill marker of '%s': %v", uniqueID, err)
+		}
+		return err
+	}
+	ttl, err := r.redisClient.PTTL(ctx, schema.expiryIndex(uniqueID)).Result()
 	if err != nil {
 		return err
 	}
+	if ttl > indexBackfillTTL {
+		return r.redisClient.PExpire(ctx, marker, ttl).Err()
+	}
 	return nil
 }
 
-// GetAllByPrefix get all values by prefix key.
-func (r RedisCache) GetAllByPrefix(ctx context.Context, prefix string) (values []interface{}, keys []string, err error) {
-	searchKey := buildSearchKey(prefix)
+func (r RedisCache) indexUnindexed(ctx context.Context, schema keySchema, uniqueID string) error {
+	found, err := r.Scan(ctx, schema.search(uniqueID))
+	if err != nil || len(found) == 0 {
+		return err
+	}
+	indexed, err := r.redisClient.ZRange(ctx, schema.index(uniqueID), 0, -1).Result()
+	if err != nil {
+		return err
+	}
+	known := make(map[string]struct{}, len(indexed))
+	for _, id := range indexed {
+		known[id] = struct{}{}
+	}
+	for _, k := range found {
+		id := schema.id(k)
+		if _, ok := known[id]; ok {
+			continue
+		}
+		if err := r.indexStored(ctx, schema, uniqueID, id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	keys, err = r.Scan(ctx, searchKey)
+// indexStored adds stored notification id of uniqueID to the indexes of schema.
+// Creation time is taken from metadata, expiration time from TTL of the value.
+// Values without metadata are indexed as read, since they can't be marked as read.
+func (r RedisCache) indexStored(ctx context.Context, schema keySchema, uniqueID, id string) error {
+	key := schema.value(id)
+	var (
+		getCmd *redis.StringCmd
+		ttlCmd *redis.DurationCmd
+	)
+	_, err := r.redisClient.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		getCmd = pipe.Get(ctx, key)
+		ttlCmd = pipe.PTTL(ctx, key)
+		return nil
+	})
+	if errors.Is(err, redis.Nil) {
+		// the value expired in the meantime
+		return nil
+	}
 	if err != nil {
-		return nil, nil, err
+		return err
+	}
+	value, err := r.decode(id, getCmd.Val())
+	if err != nil {
+		return err
+	}
+
+	// values that can't be parsed are indexed as well, so they are listed as before
+	var content NotificationContent
+	_ = json.Unmarshal([]byte(value.(string)), &content)
+	var createdAt int64
+	if !content.Metadata.CreatedAt.IsZero() {
+		createdAt = content.Metadata.CreatedAt.UnixMilli()
 	}
+	expiresAt := "+inf"
+	if ttl := ttlCmd.Val(); ttl > 0 {
+		expiresAt = strconv.FormatInt(r.now().Add(ttl).UnixMilli(), 10)
+	}
+	unread := 0
+	if !IsEmptyMetadata(content.Metadata) && !content.Metadata.IsRead {
+		unread = 1
+	}
+	return indexNotificationScript.Run(ctx, r.redisClient,
+		[]string{
+			schema.index(uniqueID), schema.expiryIndex(uniqueID),
+			schema.unreadIndex(uniqueID), schema.sizeIndex(uniqueID),
+		},
+		id, createdAt, expiresAt, unread, len(getCmd.Val()),
+	).Err()
+}
+
+// indexNotificationScript adds stored notification to the indexes of uniqueID
+// the same way saveNotificationScript does, the indexes are kept until the latest
+// notification expires.
+var indexNotificationScript = redis.NewScript(`
+redis.call('ZADD', KEYS[1], ARGV[2], ARGV[1])
+redis.call('ZADD', KEYS[2], ARGV[3], ARGV[1])
+if ARGV[4] == '1' then
+	redis.call('ZADD', KEYS[3], ARGV[3], ARGV[1])
+end
+redis.call('HSET', KEYS[4], ARGV[1], ARGV[5])
+local latest = redis.call('ZRANGE', KEYS[2], -1, -1, 'WITHSCORES')
+for i = 1, #KEYS do
+	if latest[2] == 'inf' then
+		redis.call('PERSIST', KEYS[i])
+	else
+		redis.call('PEXPIREAT', KEYS[i], latest[2])
+	end
+end
+return 1
+`)
+
+// DeleteNotifications removes notifications of uniqueID together with their index entries.
+// Returns number of removed notifications.
+func (r RedisCache) DeleteNotifications(ctx context.Context, uniqueID string, keys ...string) (int64, error) {
 	if len(keys) == 0 {
-		return nil, nil, nil
+		return 0, nil
+	}
+	var deleted int64
+	for _, schema := range r.schemas() {
+		n, err := r.del(ctx, schema.values(keys)...)
+		if err != nil {
+			return 0, err
+		}
+		if err := r.removeFromIndex(ctx, schema, uniqueID, keys...); err != nil {
+			return 0, err
+		}
+		deleted += n
+	}
+	return deleted, nil
+}
+
+// DeleteAllByUniqueID removes all notifications of uniqueID and its indexes.
+// The keyspace is scanned as well, so notifications missing in the indexes are removed too.
+// Returns number of removed notifications.
+func (r RedisCache) DeleteAllByUniqueID(ctx context.Context, uniqueID string) (int64, error) {
+	var deleted int64
+	for _, schema := range r.schemas() {
+		indexed, err := r.redisClient.ZRange(ctx, schema.index(uniqueID), 0, -1).Result()
+		if err != nil {
+			return 0, err
+		}
+		scanned, err := r.Scan(ctx, schema.search(uniqueID))
+		if err != nil {
+			return 0, err
+		}
+
+		keys := make(map[string]struct{}, len(indexed)+len(scanned))
+		for _, id := range indexed {
+			keys[schema.value(id)] = struct{}{}
+		}
+		for _, k := range scanned {
+			keys[k] = struct{}{}
+		}
+		toDelete := make([]string, 0, len(keys))
+		for k := range keys {
+			toDelete = append(toDelete, k)
+		}
+		if len(toDelete) > 0 {
+			n, err := r.del(ctx, toDelete...)
+			if err != nil {
+				return 0, err
+			}
+			deleted += n
+		}
+
+		_, err = r.del(ctx, schema.index(uniqueID), schema.expiryIndex(uniqueID),
+			schema.unreadIndex(uniqueID), schema.sizeIndex(uniqueID), schema.indexBackfill(uniqueID))
+		if err != nil {
+			return 0, err
+		}
 	}
+	return deleted, nil
+}
+
+// MarkRead removes notifications from unread counter of uniqueID.
+func (r RedisCache) MarkRead(ctx context.Context, uniqueID string, keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	members := make([]interface{}, len(keys))
+	for i, k := range keys {
+		members[i] = k
+	}
+	for _, schema := range r.schemas() {
+		if err := r.redisClient.ZRem(ctx, schema.unreadIndex(uniqueID), members...).Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	values, err = r.redisClient.MGet(ctx, keys...).Result()
+// Counts returns number of all and unread notifications of uniqueID.
+// Both counters are maintained on write, so no notifications are read.
+func (r RedisCache) Counts(ctx context.Context, uniqueID string) (total, unread int64, err error) {
+	// members with expiration time in the past are not counted
+	notExpired := "(" + strconv.FormatInt(r.now().UnixMilli(), 10)
+	var totalCmds, unreadCmds []*redis.IntCmd
+	_, err = r.redisClient.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, schema := range r.schemas() {
+			totalCmds = append(totalCmds, pipe.ZCount(ctx, schema.expiryIndex(uniqueID), notExpired, "+inf"))
+			unreadCmds = append(unreadCmds, pipe.ZCount(ctx, schema.unreadIndex(uniqueID), notExpired, "+inf"))
+		}
+		return nil
+	})
 	if err != nil {
-		return nil, nil, err
+		return 0, 0, err
+	}
+	for i := range totalCmds {
+		total += totalCmds[i].Val()
+		unread += unreadCmds[i].Val()
 	}
+	return total, unread, nil
+}
 
-	return values, keys, nil
+// ScanLegacyIDs calls fn with batches of notification IDs stored under un-namespaced keys.
+// Other keys of the database are skipped, so foreign keys aren't touched.
+func (r RedisCache) ScanLegacyIDs(ctx context.Context, batch int64, fn func(ids []string) error) error {
+	return r.forEachNode(ctx, func(ctx context.Context, client redis.UniversalClient) error {
+		var cursor uint64
+		for {
+			keys, next, err := client.ScanType(ctx, cursor, "*", batch, "string").Result()
+			if err != nil {
+				return err
+			}
+			ids := make([]string, 0, len(keys))
+			for _, k := range keys {
+				if isNotificationID(k) {
+					ids = append(ids, legacyKeySchema.id(k))
+				}
+			}
+			if len(ids) > 0 {
+				if err := fn(ids); err != nil {
+					return err
+				}
+			}
+			cursor = next
+			if cursor == 0 {
+				return nil
+			}
+		}
+	})
 }
 
-// Scan get all keys by prefix.
-func (r RedisCache) Scan(ctx context.Context, prefix string) ([]string, error) {
+// Index registers stored notification id in the indexes of its owner with the current
+// metadata, e.g. after the value was rewritten by migration. Notifications without
+// uniqueID and missing notifications are skipped.
+func (r RedisCache) Index(ctx context.Context, id string) error {
+	owner := ownerOf(id)
+	if owner == "" {
+		return nil
+	}
+	for _, schema := range r.schemas() {
+		n, err := r.redisClient.Exists(ctx, schema.value(id)).Result()
+		if err != nil {
+			return err
+		}
+		if n > 0 {
+			return r.indexStored(ctx, schema, owner, id)
+		}
+	}
+	return nil
+}
+
+// TTL returns remaining lifetime of the value with id, negative if the value doesn't expire.
+// Returns ErrNotificationNotFound if value doesn't exist.
+func (r RedisCache) TTL(ctx context.Context, id string) (time.Duration, error) {
+	key, err := r.existingKey(ctx, id)
+	if err != nil {
+		return 0, err
+	}
+	ttl, err := r.redisClient.PTTL(ctx, key).Result()
+	if err != nil {
+		return 0, err
+	}
+	// go-redis returns -2 if the key doesn't exist and -1 if it doesn't expire
+	if ttl == -2 {
+		return 0, ErrNotificationNotFound
+	}
+	return ttl, nil
+}
+
+// Usage returns number and total size of stored notifications of uniqueID.
+func (r RedisCache) Usage(ctx context.Context, uniqueID string) (InboxUsage, error) {
+	if err := r.removeExpired(ctx, r.keys, uniqueID); err != nil {
+		return InboxUsage{}, err
+	}
 	var (
-		cursor uint64
-		values []string
+		countCmd *redis.IntCmd
+		sizesCmd *redis.StringSliceCmd
 	)
+	_, err := r.redisClient.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		countCmd = pipe.ZCard(ctx, r.keys.index(uniqueID))
+		sizesCmd = pipe.HVals(ctx, r.keys.sizeIndex(uniqueID))
+		return nil
+	})
+	if err != nil {
+		return InboxUsage{}, err
+	}
 
-	for {
-		var keys []string
-		var err error
-		keys, cursor, err = r.redisClient.Scan(ctx, cursor, prefix, 10).Result()
+	usage := InboxUsage{
+		Count:    countCmd.Val(),
+		MaxCount: r.quota.MaxCount,
+		MaxBytes: r.quota.MaxBytes,
+	}
+	for _, v := range sizesCmd.Val() {
+		size, err := strconv.ParseInt(v, 10, 64)
 		if err != nil {
-			return nil, err
+			return InboxUsage{}, err
+		}
+		usage.Bytes += size
+	}
+	return usage, nil
+}
+
+// removeExpired drops index members whose notifications have already expired
+// and publishes their IDs, see WithExpirationEvents.
+func (r RedisCache) removeExpired(ctx context.Context, schema keySchema, uniqueID string) error {
+	expired, err := r.redisClient.ZRangeByScore(ctx, schema.expiryIndex(uniqueID), &redis.ZRangeBy{
+		Min: "-inf",
+		Max: strconv.FormatInt(r.now().UnixMilli(), 10),
+	}).Result()
+	if err != nil {
+		return err
+	}
+	if len(expired) == 0 {
+		return nil
+	}
+	if err := r.removeFromIndex(ctx, schema, uniqueID, expired...); err != nil {
+		return err
+	}
+	publishEvent(ctx, r.subscriptionService, r.eventLog, uniqueID, NewDeletedEvent(expired, DeleteReasonExpired))
+	return nil
+}
+
+func (r RedisCache) removeFromIndex(ctx context.Context, schema keySchema, uniqueID string, keys ...string) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	members := make([]interface{}, len(keys))
+	for i, k := range keys {
+		members[i] = k
+	}
+	_, err := r.redisClient.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZRem(ctx, schema.index(uniqueID), members...)
+		pipe.ZRem(ctx, schema.expiryIndex(uniqueID), members...)
+		pipe.ZRem(ctx, schema.unreadIndex(uniqueID), members...)
+		pipe.HDel(ctx, schema.sizeIndex(uniqueID), keys...)
+		return nil
+	})
+	return err
+}
+
+// Update atomically replaces value of existing key with result of fn keeping TTL of the key.
+// Returns ErrNotificationNotFound if the key doesn't exist.
+func (r RedisCache) Update(ctx context.Context, id string, fn func(value string) (string, error)) error {
+	key, err := r.existingKey(ctx, id)
+	if err != nil {
+		return err
+	}
+	txf := func(tx *redis.Tx) error {
+		v, err := tx.Get(ctx, key).Result()
+		if err == redis.Nil {
+			return ErrNotificationNotFound
+		}
+		if err != nil {
+			return err
+		}
+		plaintext, err := r.decode(id, v)
+		if err != nil {
+			return err
+		}
+		updated, err := fn(plaintext.(string))
+		if err != nil {
+			return err
 		}
-		values = append(values, keys...)
-		if cursor == 0 {
-			break
+		encoded, err := r.encode(id, updated)
+		if err != nil {
+			return err
 		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, key, encoded, redis.KeepTTL)
+			return nil
+		})
+		return err
 	}
 
-	return values, nil
+	for i := 0; i < maxUpdateAttempts; i++ {
+		err := r.redisClient.Watch(ctx, txf, key)
+		if !errors.Is(err, redis.TxFailedErr) {
+			return err
+		}
+	}
+	return ErrConcurrentUpdate
+}
+
+// SetNX put value to cache only if the key doesn't exist.
+// Returns true if the value was set.
+func (r RedisCache) SetNX(ctx context.Context, key string, value interface{}, duration time.Duration) (bool, error) {
+	return r.redisClient.SetNX(ctx, r.keys.value(key), value, duration).Result()
+}
+
+// deleteIfEqualScript removes the key only if it holds the expected value
+var deleteIfEqualScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('DEL', KEYS[1])
+end
+return 0
+`)
+
+// DeleteIfEqual removes key only if it holds value.
+// It's used to release locks that could have been expired and taken by another owner.
+func (r RedisCache) DeleteIfEqual(ctx context.Context, key string, value string) error {
+	return deleteIfEqualScript.Run(ctx, r.redisClient, []string{r.keys.value(key)}, value).Err()
+}
+
+// expireIfEqualScript sets ttl of the key only if it holds the expected value
+var expireIfEqualScript = redis.NewScript(`
+if redis.call('GET', KEYS[1]) == ARGV[1] then
+	return redis.call('PEXPIRE', KEYS[1], ARGV[2])
+end
+return 0
+`)
+
+// ExpireIfEqual sets ttl of key only if it holds value. Returns false if key holds another value.
+// It's used to renew locks which are still held by the owner.
+func (r RedisCache) ExpireIfEqual(ctx context.Context, key string, value string, ttl time.Duration) (bool, error) {
+	return expireIfEqualScript.Run(ctx, r.redisClient, []string{r.keys.value(key)}, value, ttl.Milliseconds()).Bool()
 }
 
 // Set for put value to cache by specific key for some duration period
 func (r RedisCache) Set(ctx context.Context, key string, value interface{}, duration time.Duration) error {
-	err := r.redisClient.Set(ctx, key, value, duration).Err()
+	value, err := r.encode(key, value)
+	if err != nil {
+		return err
+	}
+	err = r.redisClient.Set(ctx, r.keys.value(key), value, duration).Err()
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func buildSearchKey(uniqueID string) string {
-	return fmt.Sprintf("%s+*", uniqueID)
+// EncryptionStats is a result of stored values encryption
+type EncryptionStats struct {
+	Scanned   int
+	Encrypted int
+}
+
+// EncryptAll encrypts plaintext values and re-encrypts values encrypted with a retired key.
+// Only keys of the namespace are encrypted, legacy un-namespaced values expire as is.
+// Values that aren't JSON documents (e.g. lock tokens) are left as is. TTL of values is preserved.
+// With dryRun values are only counted.
+func (r RedisCache) EncryptAll(ctx context.Context, dryRun bool) (EncryptionStats, error) {
+	var stats EncryptionStats
+	if r.cipher == nil {
+		return stats, errors.New("storage encryption is not configured")
+	}
+
+	var mu sync.Mutex
+	err := r.forEachNode(ctx, func(ctx context.Context, client redis.UniversalClient) error {
+		var cursor uint64
+		for {
+			keys, next, err := client.ScanType(ctx, cursor, r.keys.namespace+"*", 100, "string").Result()
+			if err != nil {
+				return err
+			}
+			for _, key := range keys {
+				encrypted, err := r.encryptValue(ctx, key, dryRun)
+				if err != nil {
+					return fmt.Errorf("failed to encrypt '%s': %w", key, err)
+				}
+				mu.Lock()
+				stats.Scanned++
+				if encrypted {
+					stats.Encrypted++
+				}
+				mu.Unlock()
+			}
+			cursor = next
+			if cursor == 0 {
+				return nil
+			}
+		}
+	})
+	if err != nil {
+		return stats, err
+	}
+	return stats, nil
+}
+
+func (r RedisCache) encryptValue(ctx context.Context, key string, dryRun bool) (bool, error) {
+	var encrypted bool
+	txf := func(tx *redis.Tx) error {
+		encrypted = false
+		v, err := tx.Get(ctx, key).Result()
+		if err == redis.Nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if r.cipher.IsCurrent(v) || (!IsEncryptedValue(v) && !json.Valid([]byte(v))) {
+			return nil
+		}
+		encrypted = true
+		if dryRun {
+			return nil
+		}
+		id := []byte(r.keys.id(key))
+		plaintext, err := r.cipher.Decrypt(v, id)
+		if err != nil {
+			return err
+		}
+		updated, err := r.cipher.Encrypt(plaintext, id)
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, key, updated, redis.KeepTTL)
+			return nil
+		})
+		return err
+	}
+
+	for i := 0; i < maxUpdateAttempts; i++ {
+		err := r.redisClient.Watch(ctx, txf, key)
+		if !errors.Is(err, redis.TxFailedErr) {
+			return encrypted, err
+		}
+	}
+	return false, ErrConcurrentUpdate
+}
+
+// schemas returns key schemas to read, the namespaced one goes first
+func (r RedisCache) schemas() []keySchema {
+	if r.legacyKeys {
+		return []keySchema{r.keys, legacyKeySchema}
+	}
+	return []keySchema{r.keys}
+}
+
+// existingKey returns key of the value with id, legacy key is returned only if
+// the namespaced one doesn't exist. Returns ErrNotificationNotFound if value doesn't exist.
+func (r RedisCache) existingKey(ctx context.Context, id string) (string, error) {
+	for _, schema := range r.schemas() {
+		key := schema.value(id)
+		n, err := r.redisClient.Exists(ctx, key).Result()
+		if err != nil {
+			return "", err
+		}
+		if n > 0 {
+			return key, nil
+		}
+	}
+	return "", ErrNotificationNotFound
+}
+
+// forEachNode calls fn for the client or for every master node in cluster mode.
+func (r RedisCache) forEachNode(ctx context.Context, fn func(ctx context.Context, client redis.UniversalClient) error) error {
+	cluster, ok := r.redisClient.(*redis.ClusterClient)
+	if !ok {
+		return fn(ctx, r.redisClient)
+	}
+	return cluster.ForEachMaster(ctx, func(ctx context.Context, client *redis.Client) error {
+		return fn(ctx, client)
+	})
+}
+
+// mget gets values of keys, nil for missing keys.
+// Keys of different notifications belong to different hash slots, in cluster mode
+// MGET is replaced with pipelined GETs routed to their nodes.
+func (r RedisCache) mget(ctx context.Context, keys ...string) ([]interface{}, error) {
+	if _, ok := r.redisClient.(*redis.ClusterClient); !ok {
+		return r.redisClient.MGet(ctx, keys...).Result()
+	}
+	cmds := make([]*redis.StringCmd, len(keys))
+	_, err := r.redisClient.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, k := range keys {
+			cmds[i] = pipe.Get(ctx, k)
+		}
+		return nil
+	})
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	values := make([]interface{}, len(keys))
+	for i, cmd := range cmds {
+		v, err := cmd.Result()
+		if err == redis.Nil {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		values[i] = v
+	}
+	return values, nil
+}
+
+// del removes keys and returns number of removed keys. In cluster mode keys are removed one by one.
+func (r RedisCache) del(ctx context.Context, keys ...string) (int64, error) {
+	if _, ok := r.redisClient.(*redis.ClusterClient); !ok {
+		return r.redisClient.Del(ctx, keys...).Result()
+	}
+	cmds := make([]*redis.IntCmd, len(keys))
+	_, err := r.redisClient.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, k := range keys {
+			cmds[i] = pipe.Del(ctx, k)
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	var deleted int64
+	for _, cmd := range cmds {
+		deleted += cmd.Val()
+	}
+	return deleted, nil
+}
+
+// encode encrypts value stored by id if encryption is enabled.
+// ID is used instead of redis key, so values are readable with any key schema.
+func (r RedisCache) encode(id string, value interface{}) (interface{}, error) {
+	if r.cipher == nil {
+		return value, nil
+	}
+	var plaintext []byte
+	switch v := value.(type) {
+	case []byte:
+		plaintext = v
+	case string:
+		plaintext = []byte(v)
+	default:
+		return nil, fmt.Errorf("can't encrypt value of type %T", value)
+	}
+	return r.cipher.Encrypt(plaintext, []byte(id))
+}
+
+// decode decrypts value stored by id if encryption is enabled
+func (r RedisCache) decode(id string, value string) (interface{}, error) {
+	if r.cipher == nil {
+		return value, nil
+	}
+	plaintext, err := r.cipher.Decrypt(value, []byte(id))
+	if err != nil {
+		return nil, err
+	}
+	return string(plaintext), nil
+}
+
+// decodeAll decrypts MGET results of ids in place
+func (r RedisCache) decodeAll(ids []string, values []interface{}) error {
+	for i, v := range values {
+		s, ok := v.(string)
+		if !ok {
+			continue
+		}
+		decoded, err := r.decode(ids[i], s)
+		if err != nil {
+			return err
+		}
+		values[i] = decoded
+	}
+	return nil
 }
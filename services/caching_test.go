@@ -0,0 +1,555 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/require"
+)
+
+// saveErr drops result of SaveNotification for checking the error
+func saveErr(_ SaveResult, err error) error {
+	return err
+}
+
+func newTestRedisCache(t testing.TB, opts ...RedisCacheOption) (*RedisCache, *miniredis.Miniredis) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { _ = client.Close() })
+	return NewRedisCacheService(client, opts...), mr
+}
+
+func TestRedisCache_GetAllByUniqueID(t *testing.T) {
+	ctx := context.Background()
+	cache, _ := newTestRedisCache(t)
+
+	now := time.Now().UTC()
+	require.NoError(t, saveErr(cache.SaveNotification(ctx, "did:example:1", "did:example:1+b",
+		"second", now, time.Hour)))
+	require.NoError(t, saveErr(cache.SaveNotification(ctx, "did:example:1", "did:example:1+a",
+		"first", now.Add(-time.Minute), time.Hour)))
+	require.NoError(t, saveErr(cache.SaveNotification(ctx, "did:example:2", "did:example:2+c",
+		"foreign", now, time.Hour)))
+
+	values, keys, err := cache.GetAllByUniqueID(ctx, "did:example:1")
+	require.NoError(t, err)
+	require.Equal(t, []string{"did:example:1+a", "did:example:1+b"}, keys)
+	require.Equal(t, []interface{}{"first", "second"}, values)
+}
+
+func TestRedisCache_GetAllByUniqueID_Empty(t *testing.T) {
+	cache, _ := newTestRedisCache(t)
+
+	values, keys, err := cache.GetAllByUniqueID(context.Background(), "did:example:1")
+	require.NoError(t, err)
+	require.Nil(t, values)
+	require.Nil(t, keys)
+}
+
+func TestRedisCache_GetAllByUniqueID_CleansDeadMembers(t *testing.T) {
+	ctx := context.Background()
+	cache, mr := newTestRedisCache(t)
+
+	now := time.Now().UTC()
+	// expiration time of this notification is already in the past
+	require.NoError(t, saveErr(cache.SaveNotification(ctx, "did:example:1", "did:example:1+expired",
+		"expired", now.Add(-2*time.Hour), time.Hour)))
+	require.NoError(t, saveErr(cache.SaveNotification(ctx, "did:example:1", "did:example:1+deleted",
+		"deleted", now, time.Hour)))
+	require.NoError(t, saveErr(cache.SaveNotification(ctx, "did:example:1", "did:example:1+alive",
+		"alive", now, time.Hour)))
+	require.NoError(t, cache.Delete(ctx, "did:example:1+deleted"))
+
+	values, keys, err := cache.GetAllByUniqueID(ctx, "did:example:1")
+	require.NoError(t, err)
+	require.Equal(t, []string{"did:example:1+alive"}, keys)
+	require.Equal(t, []interface{}{"alive"}, values)
+
+	members, err := mr.ZMembers(cache.keys.index("did:example:1"))
+	require.NoError(t, err)
+	require.Equal(t, []string{"did:example:1+alive"}, members)
+	members, err = mr.ZMembers(cache.keys.expiryIndex("did:example:1"))
+	require.NoError(t, err)
+	require.Equal(t, []string{"did:example:1+alive"}, members)
+}
+
+func TestRedisCache_SaveNotification_IndexLifetime(t *testing.T) {
+	ctx := context.Background()
+	cache, mr := newTestRedisCache(t)
+
+	now := time.Now().UTC()
+	require.NoError(t, saveErr(cache.SaveNotification(ctx, "did:example:1", "did:example:1+long",
+		"{}", now, 24*time.Hour)))
+	require.NoError(t, saveErr(cache.SaveNotification(ctx, "did:example:1", "did:example:1+short",
+		"{}", now, 5*time.Minute)))
+
+	// indexes live until the latest notification expires
+	require.InDelta(t, 24*time.Hour, mr.TTL(cache.keys.index("did:example:1")), float64(time.Second))
+	require.InDelta(t, 24*time.Hour, mr.TTL(cache.keys.unreadIndex("did:example:1")), float64(time.Second))
+}
+
+func TestRedisCache_Counts(t *testing.T) {
+	ctx := context.Background()
+	cache, _ := newTestRedisCache(t)
+
+	now := time.Now().UTC()
+	for _, id := range []string{"a", "b", "c", "d"} {
+		require.NoError(t, saveErr(cache.SaveNotification(ctx, "did:example:1", buildMessageKey("did:example:1", id),
+			"{}", now, time.Hour)))
+	}
+	require.NoError(t, saveErr(cache.SaveNotification(ctx, "did:example:1", "did:example:1+expired",
+		"{}", now.Add(-2*time.Hour), time.Hour)))
+
+	require.NoError(t, cache.MarkRead(ctx, "did:example:1", "did:example:1+a"))
+	_, err := cache.DeleteNotifications(ctx, "did:example:1", "did:example:1+b")
+	require.NoError(t, err)
+
+	total, unread, err := cache.Counts(ctx, "did:example:1")
+	require.NoError(t, err)
+	require.EqualValues(t, 3, total)
+	require.EqualValues(t, 2, unread)
+}
+
+func TestRedisCache_Update_KeepsTTL(t *testing.T) {
+	ctx := context.Background()
+	cache, mr := newTestRedisCache(t)
+
+	require.NoError(t, cache.Set(ctx, "key", "old", time.Hour))
+	mr.FastForward(10 * time.Minute)
+
+	err := cache.Update(ctx, "key", func(value string) (string, error) {
+		require.Equal(t, "old", value)
+		return "new", nil
+	})
+	require.NoError(t, err)
+
+	v, err := mr.Get(cache.keys.value("key"))
+	require.NoError(t, err)
+	require.Equal(t, "new", v)
+	require.Equal(t, 50*time.Minute, mr.TTL(cache.keys.value("key")))
+
+	err = cache.Update(ctx, "unknown", func(value string) (string, error) {
+		return value, nil
+	})
+	require.ErrorIs(t, err, ErrNotificationNotFound)
+}
+
+const (
+	benchmarkKeyspaceSize = 1_000_000
+	benchmarkInboxSize    = 20
+)
+
+// newBenchmarkRedisCache connects to BENCHMARK_REDIS_URL when it is set,
+// otherwise in-memory redis is used.
+func newBenchmarkRedisCache(b *testing.B) *RedisCache {
+	u := os.Getenv("BENCHMARK_REDIS_URL")
+	if u == "" {
+		cache, _ := newTestRedisCache(b)
+		return cache
+	}
+	opts, err := redis.ParseURL(u)
+	require.NoError(b, err)
+	client := redis.NewClient(opts)
+	b.Cleanup(func() {
+		_ = client.FlushDB(context.Background()).Err()
+		_ = client.Close()
+	})
+	return NewRedisCacheService(client)
+}
+
+// fillBenchmarkKeyspace creates benchmarkKeyspaceSize notifications, benchmarkInboxSize
+// of them belong to the returned uniqueID.
+func fillBenchmarkKeyspace(b *testing.B, cache *RedisCache) string {
+	ctx := context.Background()
+	const batch = 10_000
+	now := time.Now()
+	for i := 0; i < benchmarkKeyspaceSize; i += batch {
+		_, err := cache.redisClient.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			for j := i; j < i+batch; j++ {
+				pipe.Set(ctx, fmt.Sprintf("did:example:%d+%d", j, j), "{}", time.Hour)
+			}
+			return nil
+		})
+		require.NoError(b, err)
+	}
+
+	uniqueID := "did:example:owner"
+	for i := 0; i < benchmarkInboxSize; i++ {
+		require.NoError(b, saveErr(cache.SaveNotification(ctx, uniqueID,
+			buildMessageKey(uniqueID, fmt.Sprint(i)), "{}", now, time.Hour)))
+	}
+	return uniqueID
+}
+
+// BenchmarkRedisCache_Scan lists the inbox by keyspace SCAN, like before the index was introduced
+func BenchmarkRedisCache_Scan(b *testing.B) {
+	cache := newBenchmarkRedisCache(b)
+	uniqueID := fillBenchmarkKeyspace(b, cache)
+	ctx := context.Background()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		found, err := cache.Scan(ctx, cache.keys.search(uniqueID))
+		require.NoError(b, err)
+		values, err := cache.mget(ctx, found...)
+		require.NoError(b, err)
+		require.Len(b, values, benchmarkInboxSize)
+	}
+}
+
+func BenchmarkRedisCache_GetAllByUniqueID(b *testing.B) {
+	cache := newBenchmarkRedisCache(b)
+	uniqueID := fillBenchmarkKeyspace(b, cache)
+	ctx := context.Background()
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		values, _, err := cache.GetAllByUniqueID(ctx, uniqueID)
+		require.NoError(b, err)
+		require.Len(b, values, benchmarkInboxSize)
+	}
+}
+
+func TestRedisCache_Encryption(t *testing.T) {
+	ctx := context.Background()
+	c, err := NewStorageCipher("k1", map[string][]byte{"k1": bytes.Repeat([]byte{1}, 32)})
+	require.NoError(t, err)
+	cache, mr := newTestRedisCache(t, WithEncryption(c))
+
+	now := time.Now().UTC()
+	require.NoError(t, saveErr(cache.SaveNotification(ctx, "did:example:1", "did:example:1+a",
+		`{"body":"secret"}`, now, time.Hour)))
+	raw, err := mr.Get(cache.keys.value("did:example:1+a"))
+	require.NoError(t, err)
+	require.True(t, IsEncryptedValue(raw))
+
+	// value written before encryption was enabled
+	require.NoError(t, mr.Set(cache.keys.value("did:example:1+plaintext"), `{"body":"plaintext"}`))
+	mr.SetTTL(cache.keys.value("did:example:1+plaintext"), time.Hour)
+	require.NoError(t, mr.Set(cache.keys.value("lock"), "token"))
+
+	v, err := cache.Get(ctx, "did:example:1+a")
+	require.NoError(t, err)
+	require.Equal(t, `{"body":"secret"}`, v)
+	v, err = cache.Get(ctx, "did:example:1+plaintext")
+	require.NoError(t, err)
+	require.Equal(t, `{"body":"plaintext"}`, v)
+
+	values, _, err := cache.GetAllByUniqueID(ctx, "did:example:1")
+	require.NoError(t, err)
+	require.Equal(t, []interface{}{`{"body":"secret"}`}, values)
+
+	require.NoError(t, cache.Update(ctx, "did:example:1+a", func(value string) (string, error) {
+		require.Equal(t, `{"body":"secret"}`, value)
+		return `{"body":"updated"}`, nil
+	}))
+	raw, err = mr.Get(cache.keys.value("did:example:1+a"))
+	require.NoError(t, err)
+	require.True(t, IsEncryptedValue(raw))
+
+	stats, err := cache.EncryptAll(ctx, true)
+	require.NoError(t, err)
+	require.Equal(t, 1, stats.Encrypted)
+	raw, err = mr.Get(cache.keys.value("did:example:1+plaintext"))
+	require.NoError(t, err)
+	require.False(t, IsEncryptedValue(raw))
+
+	stats, err = cache.EncryptAll(ctx, false)
+	require.NoError(t, err)
+	require.Equal(t, 1, stats.Encrypted)
+	raw, err = mr.Get(cache.keys.value("did:example:1+plaintext"))
+	require.NoError(t, err)
+	require.True(t, IsEncryptedValue(raw))
+	require.Equal(t, time.Hour, mr.TTL(cache.keys.value("did:example:1+plaintext")))
+	// values that aren't JSON documents are left as is
+	raw, err = mr.Get(cache.keys.value("lock"))
+	require.NoError(t, err)
+	require.Equal(t, "token", raw)
+
+	v, err = cache.Get(ctx, "did:example:1+plaintext")
+	require.NoError(t, err)
+	require.Equal(t, `{"body":"plaintext"}`, v)
+
+	// ciphertext copied under another key can't be read
+	raw, err = mr.Get(cache.keys.value("did:example:1+a"))
+	require.NoError(t, err)
+	require.NoError(t, mr.Set(cache.keys.value("did:example:1+copy"), raw))
+	_, err = cache.Get(ctx, "did:example:1+copy")
+	require.Error(t, err)
+}
+
+func TestRedisCache_Cluster(t *testing.T) {
+	ctx := context.Background()
+	mr := miniredis.RunT(t)
+	client := redis.NewClusterClient(&redis.ClusterOptions{Addrs: []string{mr.Addr()}})
+	t.Cleanup(func() { _ = client.Close() })
+	cache := NewRedisCacheService(client)
+
+	now := time.Now().UTC()
+	require.NoError(t, saveErr(cache.SaveNotification(ctx, "did:example:1", "did:example:1+a", "first", now, time.Hour)))
+	require.NoError(t, saveErr(cache.SaveNotification(ctx, "did:example:1", "did:example:1+b", "second", now, time.Hour)))
+
+	values, keys, err := cache.GetAllByUniqueID(ctx, "did:example:1")
+	require.NoError(t, err)
+	require.Equal(t, []interface{}{"first", "second"}, values)
+	require.Equal(t, []string{"did:example:1+a", "did:example:1+b"}, keys)
+
+	scanned, err := cache.Scan(ctx, cache.keys.search("did:example:1"))
+	require.NoError(t, err)
+	require.ElementsMatch(t, cache.keys.values(keys), scanned)
+
+	deleted, err := cache.DeleteNotifications(ctx, "did:example:1", keys...)
+	require.NoError(t, err)
+	require.EqualValues(t, 2, deleted)
+	total, _, err := cache.Counts(ctx, "did:example:1")
+	require.NoError(t, err)
+	require.Zero(t, total)
+
+	// evicted values are removed outside of the save script
+	quoted := NewRedisCacheService(client, WithQuota(Quota{MaxCount: 1, Policy: QuotaPolicyEvict}))
+	require.NoError(t, saveErr(quoted.SaveNotification(ctx, "did:example:1", "did:example:1+c", "third", now, time.Hour)))
+	saved, err := quoted.SaveNotification(ctx, "did:example:1", "did:example:1+d", "fourth", now, time.Hour)
+	require.NoError(t, err)
+	require.Equal(t, []string{"did:example:1+c"}, saved.Evicted)
+	require.False(t, mr.Exists(quoted.keys.value("did:example:1+c")))
+}
+
+func TestRedisCache_LegacyKeys(t *testing.T) {
+	ctx := context.Background()
+	cache, mr := newTestRedisCache(t, WithKeyPrefix("notifications"), WithLegacyKeys(true))
+
+	now := time.Now().UTC()
+	// notification written before the namespace was introduced
+	legacy := NewRedisCacheService(cache.redisClient, func(r *RedisCache) { r.keys = legacyKeySchema })
+	require.NoError(t, saveErr(legacy.SaveNotification(ctx, "did:example:1", "did:example:1+old",
+		"old", now.Add(-time.Minute), time.Hour)))
+	require.NoError(t, saveErr(cache.SaveNotification(ctx, "did:example:1", "did:example:1+new",
+		"new", now, time.Hour)))
+	require.True(t, mr.Exists("notifications:v1:{did:example:1}+new"))
+
+	v, err := cache.Get(ctx, "did:example:1+old")
+	require.NoError(t, err)
+	require.Equal(t, "old", v)
+
+	values, keys, err := cache.GetAllByUniqueID(ctx, "did:example:1")
+	require.NoError(t, err)
+	require.Equal(t, []interface{}{"old", "new"}, values)
+	require.Equal(t, []string{"did:example:1+old", "did:example:1+new"}, keys)
+
+	require.NoError(t, cache.Update(ctx, "did:example:1+old", func(string) (string, error) {
+		return "updated", nil
+	}))
+	raw, err := mr.Get("did:example:1+old")
+	require.NoError(t, err)
+	require.Equal(t, "updated", raw)
+
+	total, _, err := cache.Counts(ctx, "did:example:1")
+	require.NoError(t, err)
+	require.EqualValues(t, 2, total)
+
+	deleted, err := cache.DeleteNotifications(ctx, "did:example:1", keys...)
+	require.NoError(t, err)
+	require.EqualValues(t, 2, deleted)
+	require.False(t, mr.Exists("did:example:1+old"))
+
+	// without compatibility reads legacy keys aren't visible
+	require.NoError(t, mr.Set("did:example:1+old", "old"))
+	v, err = NewRedisCacheService(cache.redisClient, WithKeyPrefix("notifications")).Get(ctx, "did:example:1+old")
+	require.NoError(t, err)
+	require.Nil(t, v)
+}
+
+func TestRedisCache_GetPageByUniqueID(t *testing.T) {
+	ctx := context.Background()
+	cache, _ := newTestRedisCache(t)
+	start := time.Now().Truncate(time.Millisecond)
+	// c and d are created at the same millisecond
+	for id, createdAt := range map[string]time.Time{
+		"did:example:1+a": start,
+		"did:example:1+b": start.Add(time.Minute),
+		"did:example:1+c": start.Add(2 * time.Minute),
+		"did:example:1+d": start.Add(2 * time.Minute),
+		"did:example:1+e": start.Add(3 * time.Minute),
+	} {
+		require.NoError(t, saveErr(cache.SaveNotification(ctx, "did:example:1", id, id, createdAt, time.Hour)))
+	}
+
+	pageIDs := func(q IndexQuery) ([]string, bool) {
+		page, more, err := cache.GetPageByUniqueID(ctx, "did:example:1", q)
+		require.NoError(t, err)
+		ids := make([]string, 0, len(page))
+		for _, n := range page {
+			require.Equal(t, n.ID, n.Value)
+			ids = append(ids, n.ID)
+		}
+		return ids, more
+	}
+
+	ids, more := pageIDs(IndexQuery{Limit: 3})
+	require.Equal(t, []string{"did:example:1+a", "did:example:1+b", "did:example:1+c"}, ids)
+	require.True(t, more)
+	ids, more = pageIDs(IndexQuery{Limit: 3, After: &IndexPosition{
+		CreatedAt: start.Add(2 * time.Minute).UnixMilli(), ID: "did:example:1+c"}})
+	require.Equal(t, []string{"did:example:1+d", "did:example:1+e"}, ids)
+	require.False(t, more)
+
+	ids, more = pageIDs(IndexQuery{Limit: 2, Desc: true, After: &IndexPosition{
+		CreatedAt: start.Add(2 * time.Minute).UnixMilli(), ID: "did:example:1+d"}})
+	require.Equal(t, []string{"did:example:1+c", "did:example:1+b"}, ids)
+	require.True(t, more)
+
+	ids, _ = pageIDs(IndexQuery{Limit: 10, Since: start.Add(time.Minute), Until: start.Add(2 * time.Minute)})
+	require.Equal(t, []string{"did:example:1+b", "did:example:1+c", "did:example:1+d"}, ids)
+	// cursor outside of the time range
+	ids, _ = pageIDs(IndexQuery{Limit: 10, Until: start.Add(time.Minute), After: &IndexPosition{
+		CreatedAt: start.Add(2 * time.Minute).UnixMilli(), ID: "did:example:1+c"}})
+	require.Empty(t, ids)
+}
+
+func TestRedisCache_GetAllByUniqueID_BackfillsLegacy(t *testing.T) {
+	ctx := context.Background()
+	cache, mr := newTestRedisCache(t, WithKeyPrefix("notifications"), WithLegacyKeys(true))
+	now := time.Now().UTC()
+	cache.now = func() time.Time { return now }
+
+	// notifications stored before the index was introduced
+	content, err := json.Marshal(NotificationContent{
+		Metadata: NotificationMetadata{CreatedAt: now.Add(-time.Minute), ExpiresAt: now.Add(time.Hour)},
+		Body:     []byte(`{}`),
+	})
+	require.NoError(t, err)
+	require.NoError(t, cache.redisClient.Set(ctx, "did:example:1+old", content, time.Hour).Err())
+	require.NoError(t, cache.redisClient.Set(ctx, "did:example:1+raw", `{"legacy":true}`, 2*time.Hour).Err())
+	require.NoError(t, saveErr(cache.SaveNotification(ctx, "did:example:1", "did:example:1+new",
+		"{}", now, time.Hour)))
+
+	_, keys, err := cache.GetAllByUniqueID(ctx, "did:example:1")
+	require.NoError(t, err)
+	require.Equal(t, []string{"did:example:1+raw", "did:example:1+old", "did:example:1+new"}, keys)
+	indexed, err := mr.ZMembers(legacyKeySchema.index("did:example:1"))
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{"did:example:1+old", "did:example:1+raw"}, indexed)
+	// legacy format can't be marked as read, so it isn't counted as unread
+	total, unread, err := cache.Counts(ctx, "did:example:1")
+	require.NoError(t, err)
+	require.EqualValues(t, 3, total)
+	require.EqualValues(t, 2, unread)
+	// marker outlives the backfilled notifications
+	require.Greater(t, mr.TTL(legacyKeySchema.indexBackfill("did:example:1")), indexBackfillTTL-time.Minute)
+	marker, err := mr.Get(legacyKeySchema.indexBackfill("did:example:1"))
+	require.NoError(t, err)
+	require.Equal(t, fmt.Sprint(now.UnixMilli()), marker)
+
+	// the keyspace is scanned once
+	require.NoError(t, cache.redisClient.Set(ctx, "did:example:1+late", "{}", time.Hour).Err())
+	_, keys, err = cache.GetAllByUniqueID(ctx, "did:example:1")
+	require.NoError(t, err)
+	require.Len(t, keys, 3)
+}
+
+func TestRedisCache_SaveNotification_QuotaEvict(t *testing.T) {
+	ctx := context.Background()
+	cache, mr := newTestRedisCache(t, WithQuota(Quota{MaxCount: 2, MaxBytes: 10, Policy: QuotaPolicyEvict}))
+
+	now := time.Now().UTC()
+	require.NoError(t, saveErr(cache.SaveNotification(ctx, "did:example:1", "did:example:1+a", "aaa", now.Add(-2*time.Minute), time.Hour)))
+	require.NoError(t, saveErr(cache.SaveNotification(ctx, "did:example:1", "did:example:1+b", "bbb", now.Add(-time.Minute), time.Hour)))
+	// count limit evicts the oldest notification
+	saved, err := cache.SaveNotification(ctx, "did:example:1", "did:example:1+c", "ccc", now, time.Hour)
+	require.NoError(t, err)
+	require.Equal(t, []string{"did:example:1+a"}, saved.Evicted)
+	require.False(t, mr.Exists(cache.keys.value("did:example:1+a")))
+
+	// size limit evicts as many notifications as needed
+	saved, err = cache.SaveNotification(ctx, "did:example:1", "did:example:1+d", "dddddddd", now, time.Hour)
+	require.NoError(t, err)
+	require.Equal(t, []string{"did:example:1+b", "did:example:1+c"}, saved.Evicted)
+	_, keys, err := cache.GetAllByUniqueID(ctx, "did:example:1")
+	require.NoError(t, err)
+	require.Equal(t, []string{"did:example:1+d"}, keys)
+
+	usage, err := cache.Usage(ctx, "did:example:1")
+	require.NoError(t, err)
+	require.Equal(t, InboxUsage{Count: 1, Bytes: 8, MaxCount: 2, MaxBytes: 10}, usage)
+
+	// notification larger than the limit can't be stored
+	_, err = cache.SaveNotification(ctx, "did:example:1", "did:example:1+e", "eeeeeeeeeee", now, time.Hour)
+	require.ErrorIs(t, err, ErrQuotaExceeded)
+}
+
+func TestRedisCache_SaveNotification_QuotaReject(t *testing.T) {
+	ctx := context.Background()
+	cache, mr := newTestRedisCache(t, WithQuota(Quota{MaxCount: 1, Policy: QuotaPolicyReject}))
+
+	now := time.Now().UTC()
+	require.NoError(t, saveErr(cache.SaveNotification(ctx, "did:example:1", "did:example:1+a", "{}", now, time.Hour)))
+	_, err := cache.SaveNotification(ctx, "did:example:1", "did:example:1+b", "{}", now, time.Hour)
+	require.ErrorIs(t, err, ErrQuotaExceeded)
+	require.False(t, mr.Exists(cache.keys.value("did:example:1+b")))
+
+	// quota is released by deletion and expiration
+	_, err = cache.DeleteNotifications(ctx, "did:example:1", "did:example:1+a")
+	require.NoError(t, err)
+	require.NoError(t, saveErr(cache.SaveNotification(ctx, "did:example:1", "did:example:1+b", "{}",
+		now.Add(-time.Hour), time.Hour+time.Minute)))
+	cache.now = func() time.Time { return now.Add(2 * time.Minute) }
+	saved, err := cache.SaveNotification(ctx, "did:example:1", "did:example:1+c", "{}", now, time.Hour)
+	require.NoError(t, err)
+	require.Equal(t, []string{"did:example:1+b"}, saved.Expired)
+	require.Empty(t, saved.Evicted)
+}
+
+func TestRedisCache_ExpirationEvents(t *testing.T) {
+	ctx := context.Background()
+	sub := NewSubscriptionService(10, 10)
+	cache, _ := newTestRedisCache(t, WithExpirationEvents(sub, nil))
+	ch, err := sub.Subscribe("did:example:1")
+	require.NoError(t, err)
+
+	now := time.Now().UTC()
+	require.NoError(t, saveErr(cache.SaveNotification(ctx, "did:example:1", "did:example:1+a", "{}", now, time.Minute)))
+	require.NoError(t, saveErr(cache.SaveNotification(ctx, "did:example:1", "did:example:1+b", "{}", now, time.Hour)))
+	cache.now = func() time.Time { return now.Add(2 * time.Minute) }
+
+	// expired notification is dropped from the index on read and subscribers are told
+	_, keys, err := cache.GetAllByUniqueID(ctx, "did:example:1")
+	require.NoError(t, err)
+	require.Equal(t, []string{"did:example:1+b"}, keys)
+	require.Equal(t, []NotificationPayload{NewDeletedEvent([]string{"did:example:1+a"}, DeleteReasonExpired)},
+		receiveAll(ch))
+
+	// nothing is published when nothing expired
+	_, _, err = cache.GetAllByUniqueID(ctx, "did:example:1")
+	require.NoError(t, err)
+	require.Empty(t, receiveAll(ch))
+}
+
+func TestRedisCache_DeleteAllByUniqueID(t *testing.T) {
+	ctx := context.Background()
+	cache, mr := newTestRedisCache(t, WithLegacyKeys(true))
+
+	now := time.Now().UTC()
+	require.NoError(t, saveErr(cache.SaveNotification(ctx, "did:example:1", "did:example:1+a", "{}", now, time.Hour)))
+	require.NoError(t, saveErr(cache.SaveNotification(ctx, "did:example:2", "did:example:2+b", "{}", now, time.Hour)))
+	// notifications missing in the index and stored under legacy keys
+	require.NoError(t, cache.Set(ctx, "did:example:1+c", "{}", time.Hour))
+	require.NoError(t, mr.Set("did:example:1+d", "{}"))
+
+	deleted, err := cache.DeleteAllByUniqueID(ctx, "did:example:1")
+	require.NoError(t, err)
+	require.EqualValues(t, 3, deleted)
+	require.False(t, mr.Exists(cache.keys.index("did:example:1")))
+	require.False(t, mr.Exists(cache.keys.sizeIndex("did:example:1")))
+	require.False(t, mr.Exists("did:example:1+d"))
+
+	values, _, err := cache.GetAllByUniqueID(ctx, "did:example:2")
+	require.NoError(t, err)
+	require.Len(t, values, 1)
+}
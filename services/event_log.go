@@ -0,0 +1,158 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/iden3/notification-service/log"
+	"github.com/redis/go-redis/v9"
+)
+
+// ErrInvalidEventID is returned when event ID wasn't issued by EventLog
+var ErrInvalidEventID = errors.New("invalid event id")
+
+// EventLog is a short log of subscription events per user kept in Redis stream.
+// Stream entry IDs are used as SSE event IDs: they increase monotonically per user,
+// so a reconnected client gets events it missed after its Last-Event-ID.
+type EventLog struct {
+	client    redis.UniversalClient
+	keys      keySchema
+	size      int64
+	retention time.Duration
+	cipher    *StorageCipher
+}
+
+// EventLogOption configures EventLog optional parameters.
+type EventLogOption func(*EventLog)
+
+// WithEventLogEncryption encrypts message attributes kept with logged events,
+// they are stored in plain JSON by default.
+func WithEventLogEncryption(c *StorageCipher) EventLogOption {
+	return func(l *EventLog) {
+		l.cipher = c
+	}
+}
+
+// NewEventLog creates event log keeping up to size latest events of a user for retention duration.
+func NewEventLog(client redis.UniversalClient, keyPrefix string, size int64, retention time.Duration,
+	opts ...EventLogOption) *EventLog {
+	l := &EventLog{
+		client:    client,
+		keys:      newKeySchema(keyPrefix),
+		size:      size,
+		retention: retention,
+	}
+	for _, opt := range opts {
+		if opt != nil {
+			opt(l)
+		}
+	}
+	return l
+}
+
+// Append adds notification event to the log of userDID and returns ID of the event.
+func (l *EventLog) Append(ctx context.Context, userDID string, payload NotificationPayload) (string, error) {
+	b, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+	values := map[string]interface{}{"payload": b}
+	// attributes are kept next to the payload, so replayed events can be filtered
+	if !payload.Attributes.IsEmpty() {
+		attrs, err := encryptJSON(l.cipher, payload.Attributes, []byte(userDID))
+		if err != nil {
+			return "", err
+		}
+		values["attributes"] = attrs
+	}
+	key := l.keys.events(userDID)
+	var idCmd *redis.StringCmd
+	_, err = l.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		idCmd = pipe.XAdd(ctx, &redis.XAddArgs{
+			Stream: key,
+			MaxLen: l.size,
+			Approx: true,
+			Values: values,
+		})
+		pipe.Expire(ctx, key, l.retention)
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return idCmd.Val(), nil
+}
+
+// Since returns events of userDID logged after lastEventID in the order they were logged.
+// Events older than the retention are not returned.
+func (l *EventLog) Since(ctx context.Context, userDID, lastEventID string) ([]NotificationPayload, error) {
+	if _, _, ok := parseEventID(lastEventID); !ok {
+		return nil, ErrInvalidEventID
+	}
+	entries, err := l.client.XRange(ctx, l.keys.events(userDID), lastEventID, "+").Result()
+	if err != nil {
+		return nil, err
+	}
+
+	oldest := time.Now().Add(-l.retention).UnixMilli()
+	events := make([]NotificationPayload, 0, len(entries))
+	for _, e := range entries {
+		if ms, _, _ := parseEventID(e.ID); e.ID == lastEventID || ms < oldest {
+			continue
+		}
+		v, _ := e.Values["payload"].(string)
+		var payload NotificationPayload
+		if err := json.Unmarshal([]byte(v), &payload); err != nil {
+			log.WithContext(ctx).Warnf("invalid event %s in log of user %s: %v", e.ID, userDID, err)
+			continue
+		}
+		if v, ok := e.Values["attributes"].(string); ok {
+			if err := decryptJSON(l.cipher, v, []byte(userDID), &payload.Attributes); err != nil {
+				log.WithContext(ctx).Warnf("invalid attributes of event %s in log of user %s: %v", e.ID, userDID, err)
+			}
+		}
+		payload.EventID = e.ID
+		events = append(events, payload)
+	}
+	return events, nil
+}
+
+// Erase removes all logged events of userDID, so they can't be replayed.
+func (l *EventLog) Erase(ctx context.Context, userDID string) error {
+	return l.client.Del(ctx, l.keys.events(userDID)).Err()
+}
+
+// EventIDAfter reports whether event a was logged after event b.
+// IDs that weren't issued by EventLog are not comparable, true is returned for them.
+func EventIDAfter(a, b string) bool {
+	aMs, aSeq, okA := parseEventID(a)
+	bMs, bSeq, okB := parseEventID(b)
+	if !okA || !okB {
+		return true
+	}
+	if aMs != bMs {
+		return aMs > bMs
+	}
+	return aSeq > bSeq
+}
+
+// parseEventID parses '<milliseconds>-<sequence>' stream entry ID
+func parseEventID(id string) (ms, seq int64, ok bool) {
+	msStr, seqStr, found := strings.Cut(id, "-")
+	if !found {
+		return 0, 0, false
+	}
+	ms, err := strconv.ParseInt(msStr, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	seq, err = strconv.ParseInt(seqStr, 10, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return ms, seq, true
+}
@@ -0,0 +1,150 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestEventLog(t *testing.T, size int64, opts ...EventLogOption) (*EventLog, *miniredis.Miniredis) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { _ = client.Close() })
+	return NewEventLog(client, "test", size, time.Hour, opts...), mr
+}
+
+func TestEventLog_Since(t *testing.T) {
+	l, mr := newTestEventLog(t, 100)
+	ctx := context.Background()
+	userDID := "did:example:123"
+
+	var ids []string
+	for i := 0; i < 3; i++ {
+		id, err := l.Append(ctx, userDID, NotificationPayload{ID: fmt.Sprint(i)})
+		require.NoError(t, err)
+		ids = append(ids, id)
+	}
+	_, err := l.Append(ctx, "did:example:other", NotificationPayload{ID: "other"})
+	require.NoError(t, err)
+	require.True(t, EventIDAfter(ids[1], ids[0]))
+	require.False(t, EventIDAfter(ids[0], ids[1]))
+	require.Greater(t, mr.TTL(l.keys.events(userDID)), time.Duration(0))
+
+	events, err := l.Since(ctx, userDID, ids[0])
+	require.NoError(t, err)
+	require.Equal(t, []NotificationPayload{
+		{ID: "1", EventID: ids[1]},
+		{ID: "2", EventID: ids[2]},
+	}, events)
+
+	events, err = l.Since(ctx, userDID, ids[2])
+	require.NoError(t, err)
+	require.Empty(t, events)
+
+	// events of unknown or trimmed IDs are replayed from the oldest kept event
+	events, err = l.Since(ctx, userDID, "0-1")
+	require.NoError(t, err)
+	require.Len(t, events, 3)
+
+	_, err = l.Since(ctx, userDID, "not an id")
+	require.ErrorIs(t, err, ErrInvalidEventID)
+}
+
+func TestEventLog_Attributes(t *testing.T) {
+	l, _ := newTestEventLog(t, 100)
+	ctx := context.Background()
+	userDID := "did:example:123"
+
+	attrs := NotificationAttributes{Type: "offer", ThreadID: "thread-1", From: "did:example:issuer"}
+	id, err := l.Append(ctx, userDID, NotificationPayload{ID: "1", Attributes: attrs})
+	require.NoError(t, err)
+
+	// attributes aren't part of the payload, but replayed events are filtered by them
+	events, err := l.Since(ctx, userDID, "0-1")
+	require.NoError(t, err)
+	require.Equal(t, []NotificationPayload{{ID: "1", EventID: id, Attributes: attrs}}, events)
+}
+
+func TestEventLog_Encryption(t *testing.T) {
+	c, err := NewStorageCipher("k1", map[string][]byte{"k1": bytes.Repeat([]byte{1}, 32)})
+	require.NoError(t, err)
+	l, _ := newTestEventLog(t, 100, WithEventLogEncryption(c))
+	ctx := context.Background()
+	userDID := "did:example:123"
+
+	// event logged before encryption was enabled
+	plain := NewEventLog(l.client, "test", 100, time.Hour)
+	attrs := NotificationAttributes{Type: "offer", ThreadID: "thread-1", From: "did:example:issuer"}
+	plainID, err := plain.Append(ctx, userDID, NotificationPayload{ID: "1", Attributes: attrs})
+	require.NoError(t, err)
+	id, err := l.Append(ctx, userDID, NotificationPayload{ID: "2", Attributes: attrs})
+	require.NoError(t, err)
+
+	entries, err := l.client.XRange(ctx, l.keys.events(userDID), id, id).Result()
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	require.True(t, IsEncryptedValue(entries[0].Values["attributes"].(string)))
+
+	events, err := l.Since(ctx, userDID, "0-1")
+	require.NoError(t, err)
+	require.Equal(t, []NotificationPayload{
+		{ID: "1", EventID: plainID, Attributes: attrs},
+		{ID: "2", EventID: id, Attributes: attrs},
+	}, events)
+
+	// attributes are bound to the owner
+	require.NoError(t, l.client.XAdd(ctx, &redis.XAddArgs{
+		Stream: l.keys.events("did:example:other"),
+		Values: entries[0].Values,
+	}).Err())
+	events, err = l.Since(ctx, "did:example:other", "0-1")
+	require.NoError(t, err)
+	require.Len(t, events, 1)
+	require.True(t, events[0].Attributes.IsEmpty())
+}
+
+func TestEventLog_Size(t *testing.T) {
+	l, _ := newTestEventLog(t, 2)
+	ctx := context.Background()
+	userDID := "did:example:123"
+
+	for i := 0; i < 5; i++ {
+		_, err := l.Append(ctx, userDID, NotificationPayload{ID: fmt.Sprint(i)})
+		require.NoError(t, err)
+	}
+
+	events, err := l.Since(ctx, userDID, "0-1")
+	require.NoError(t, err)
+	require.Len(t, events, 2)
+	require.Equal(t, "4", events[len(events)-1].ID)
+}
+
+func TestNotificationService_EventLog(t *testing.T) {
+	l, _ := newTestEventLog(t, 100)
+	subscriptions := NewSubscriptionService(10, 10)
+	ns := NewNotificationService(nil, nil, nil, "", time.Hour, subscriptions, nil, WithEventLog(l))
+	userDID := "did:example:123"
+
+	ch, err := subscriptions.Subscribe(userDID)
+	require.NoError(t, err)
+	defer subscriptions.Unsubscribe(userDID, ch)
+
+	// devices of the same user get a single event
+	devices := []Device{{UniqueID: userDID}, {UniqueID: userDID}}
+	ns.notifySubscribers(context.Background(), devices, NotificationPayload{ID: "1"})
+
+	received := <-ch
+	require.Equal(t, "1", received.ID)
+	require.NotEmpty(t, received.EventID)
+	require.Empty(t, ch)
+
+	events, err := l.Since(context.Background(), userDID, "0-1")
+	require.NoError(t, err)
+	require.Equal(t, []NotificationPayload{received}, events)
+}
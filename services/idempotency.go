@@ -0,0 +1,193 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/iden3/notification-service/log"
+)
+
+const idempotencyPollInterval = 100 * time.Millisecond
+
+var (
+	// ErrIdempotencyKeyReused is returned when idempotency key was used for another request
+	ErrIdempotencyKeyReused = errors.New("idempotency key was used with different request")
+	// ErrIdempotencyInProgress is returned when the request with the same idempotency key
+	// is still processed after lock timeout
+	ErrIdempotencyInProgress = errors.New("request with the same idempotency key is in progress")
+)
+
+// IdempotencyRecord is a stored result of the first request with idempotency key
+type IdempotencyRecord struct {
+	Fingerprint     string               `json:"fingerprint"`
+	Results         []NotificationResult `json:"results"`
+	NotificationIDs []string             `json:"notification_ids"`
+}
+
+type idempotencyStorage interface {
+	Get(ctx context.Context, key string) (interface{}, error)
+	Set(ctx context.Context, key string, value interface{}, duration time.Duration) error
+	SetNX(ctx context.Context, key string, value interface{}, duration time.Duration) (bool, error)
+	DeleteIfEqual(ctx context.Context, key string, value string) error
+	ExpireIfEqual(ctx context.Context, key string, value string, ttl time.Duration) (bool, error)
+}
+
+// Idempotency is a service to deduplicate sender retries by idempotency key
+type Idempotency struct {
+	storage     idempotencyStorage
+	window      time.Duration
+	lockTimeout time.Duration
+}
+
+// NewIdempotencyService new instance of idempotency service.
+// Results are stored for window duration, concurrent duplicates wait for lockTimeout.
+// The lock expires in lockTimeout if the replica holding it crashed.
+func NewIdempotencyService(s idempotencyStorage, window, lockTimeout time.Duration) *Idempotency {
+	return &Idempotency{
+		storage:     s,
+		window:      window,
+		lockTimeout: lockTimeout,
+	}
+}
+
+// Do runs fn once per sender and idempotency key. Replays get the record of the first run
+// and replayed flag set. fingerprint identifies request content, so the key can't be
+// reused for another request: senders aren't authenticated, the record is replayed only
+// to the same request. The record is stored only if fn saved a notification,
+// so failed requests are retried by the sender.
+func (i *Idempotency) Do(ctx context.Context, sender, key, fingerprint string,
+	fn func() ([]NotificationResult, []string)) (rec IdempotencyRecord, replayed bool, err error) {
+	recordKey := buildIdempotencyKey(sender, key)
+	lockKey := recordKey + ":lock"
+	token := uuid.NewString()
+
+	deadline := time.Now().Add(i.lockTimeout)
+	for {
+		stored, err := i.lookup(ctx, recordKey, fingerprint)
+		if err != nil {
+			return IdempotencyRecord{}, false, err
+		}
+		if stored != nil {
+			return *stored, true, nil
+		}
+
+		locked, err := i.storage.SetNX(ctx, lockKey, token, i.lockTimeout)
+		if err != nil {
+			return IdempotencyRecord{}, false, err
+		}
+		if locked {
+			break
+		}
+		if time.Now().After(deadline) {
+			return IdempotencyRecord{}, false, ErrIdempotencyInProgress
+		}
+		select {
+		case <-ctx.Done():
+			return IdempotencyRecord{}, false, ctx.Err()
+		case <-time.After(idempotencyPollInterval):
+		}
+	}
+	defer func() {
+		if err := i.storage.DeleteIfEqual(context.WithoutCancel(ctx), lockKey, token); err != nil {
+			log.WithContext(ctx).Warnf("failed to release idempotency lock: %v", err)
+		}
+	}()
+	// pushes have no deadline, the lock must not expire while they are sent
+	stopRenewal := i.keepLock(ctx, lockKey, token)
+	defer stopRenewal()
+
+	// the first request could complete between the record check and the lock
+	stored, err := i.lookup(ctx, recordKey, fingerprint)
+	if err != nil {
+		return IdempotencyRecord{}, false, err
+	}
+	if stored != nil {
+		return *stored, true, nil
+	}
+
+	results, ids := fn()
+	rec = IdempotencyRecord{
+		Fingerprint:     fingerprint,
+		Results:         results,
+		NotificationIDs: ids,
+	}
+	if len(ids) == 0 {
+		// nothing was saved, the key is released with the lock
+		return rec, false, nil
+	}
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return IdempotencyRecord{}, false, fmt.Errorf("failed to marshal idempotency record: %w", err)
+	}
+	// pushes are already sent, so the result is returned even if it can't be stored
+	if err := i.storage.Set(context.WithoutCancel(ctx), recordKey, b, i.window); err != nil {
+		log.WithContext(ctx).Errorf("failed to store idempotency record: %v", err)
+	}
+	return rec, false, nil
+}
+
+// keepLock renews the lock until the returned function is called
+func (i *Idempotency) keepLock(ctx context.Context, lockKey, token string) func() {
+	if i.lockTimeout <= 0 {
+		return func() {}
+	}
+	ctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(i.lockTimeout / 3)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			renewed, err := i.storage.ExpireIfEqual(ctx, lockKey, token, i.lockTimeout)
+			switch {
+			case ctx.Err() != nil:
+				return
+			case err != nil:
+				log.WithContext(ctx).Warnf("failed to renew idempotency lock: %v", err)
+			case !renewed:
+				log.WithContext(ctx).Warnf("idempotency lock expired before the request completed")
+				return
+			}
+		}
+	}()
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+// lookup returns stored record or nil if the key wasn't used yet.
+func (i *Idempotency) lookup(ctx context.Context, recordKey, fingerprint string) (*IdempotencyRecord, error) {
+	v, err := i.storage.Get(ctx, recordKey)
+	if err != nil {
+		return nil, err
+	}
+	if v == nil {
+		return nil, nil
+	}
+	s, ok := v.(string)
+	if !ok {
+		return nil, errors.New("invalid idempotency record from redis")
+	}
+	var rec IdempotencyRecord
+	if err := json.Unmarshal([]byte(s), &rec); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal idempotency record: %w", err)
+	}
+	if rec.Fingerprint != fingerprint {
+		return nil, ErrIdempotencyKeyReused
+	}
+	return &rec, nil
+}
+
+func buildIdempotencyKey(sender, key string) string {
+	return fmt.Sprintf("idempotency:%s:%s", sender, key)
+}
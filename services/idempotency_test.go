@@ -0,0 +1,152 @@
+package services
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestIdempotency_Do_Replay(t *testing.T) {
+	cache, _ := newTestRedisCache(t)
+	service := NewIdempotencyService(cache, time.Hour, time.Second)
+
+	var calls int
+	send := func() ([]NotificationResult, []string) {
+		calls++
+		return []NotificationResult{{Status: NotificationStatusSuccess}}, []string{"did+id"}
+	}
+
+	rec, replayed, err := service.Do(context.Background(), "did:example:sender", "key", "fingerprint", send)
+	require.NoError(t, err)
+	require.False(t, replayed)
+	require.Equal(t, []string{"did+id"}, rec.NotificationIDs)
+
+	rec, replayed, err = service.Do(context.Background(), "did:example:sender", "key", "fingerprint", send)
+	require.NoError(t, err)
+	require.True(t, replayed)
+	require.Equal(t, NotificationStatusSuccess, rec.Results[0].Status)
+	require.Equal(t, []string{"did+id"}, rec.NotificationIDs)
+	require.Equal(t, 1, calls)
+
+	// the key can't be reused with another request
+	_, _, err = service.Do(context.Background(), "did:example:sender", "key", "another fingerprint", send)
+	require.ErrorIs(t, err, ErrIdempotencyKeyReused)
+	require.Equal(t, 1, calls)
+
+	// keys are scoped by sender
+	_, replayed, err = service.Do(context.Background(), "did:example:other", "key", "another fingerprint", send)
+	require.NoError(t, err)
+	require.False(t, replayed)
+	require.Equal(t, 2, calls)
+}
+
+func TestIdempotency_Do_FailureNotStored(t *testing.T) {
+	cache, _ := newTestRedisCache(t)
+	service := NewIdempotencyService(cache, time.Hour, time.Second)
+
+	var calls int
+	send := func() ([]NotificationResult, []string) {
+		calls++
+		if calls == 1 {
+			return []NotificationResult{{Status: NotificationStatusFailed}}, nil
+		}
+		return []NotificationResult{{Status: NotificationStatusSuccess}}, []string{"did+id"}
+	}
+
+	rec, replayed, err := service.Do(context.Background(), "did:example:sender", "key", "fingerprint", send)
+	require.NoError(t, err)
+	require.False(t, replayed)
+	require.Equal(t, NotificationStatusFailed, rec.Results[0].Status)
+
+	// the retry is sent again
+	rec, replayed, err = service.Do(context.Background(), "did:example:sender", "key", "fingerprint", send)
+	require.NoError(t, err)
+	require.False(t, replayed)
+	require.Equal(t, NotificationStatusSuccess, rec.Results[0].Status)
+	require.Equal(t, 2, calls)
+}
+
+func TestIdempotency_Do_ConcurrentDuplicates(t *testing.T) {
+	cache, _ := newTestRedisCache(t)
+	service := NewIdempotencyService(cache, time.Hour, 5*time.Second)
+
+	var calls atomic.Int32
+	send := func() ([]NotificationResult, []string) {
+		calls.Add(1)
+		time.Sleep(200 * time.Millisecond)
+		return []NotificationResult{{Status: NotificationStatusSuccess}}, []string{"did+id"}
+	}
+
+	var (
+		wg       sync.WaitGroup
+		replayed atomic.Int32
+	)
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rec, isReplay, err := service.Do(context.Background(), "did:example:sender", "key", "fingerprint", send)
+			require.NoError(t, err)
+			require.Len(t, rec.Results, 1)
+			if isReplay {
+				replayed.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	require.EqualValues(t, 1, calls.Load())
+	require.EqualValues(t, 4, replayed.Load())
+}
+
+func TestIdempotency_Do_LockRenewed(t *testing.T) {
+	cache, mr := newTestRedisCache(t)
+	service := NewIdempotencyService(cache, time.Hour, 300*time.Millisecond)
+
+	// miniredis expires keys only when its clock is moved
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+	stopClock := make(chan struct{})
+	defer close(stopClock)
+	go func() {
+		for {
+			select {
+			case <-stopClock:
+				return
+			case <-ticker.C:
+				mr.FastForward(10 * time.Millisecond)
+			}
+		}
+	}()
+
+	var calls atomic.Int32
+	send := func() ([]NotificationResult, []string) {
+		calls.Add(1)
+		// the push takes longer than the lock timeout
+		time.Sleep(time.Second)
+		return []NotificationResult{{Status: NotificationStatusSuccess}}, []string{"did+id"}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		_, replayed, err := service.Do(context.Background(), "did:example:sender", "key", "fingerprint", send)
+		require.NoError(t, err)
+		require.False(t, replayed)
+	}()
+
+	// the retry doesn't take the lock of the slow push
+	time.Sleep(500 * time.Millisecond)
+	_, _, err := service.Do(context.Background(), "did:example:sender", "key", "fingerprint", send)
+	require.ErrorIs(t, err, ErrIdempotencyInProgress)
+	<-done
+
+	_, replayed, err := service.Do(context.Background(), "did:example:sender", "key", "fingerprint", send)
+	require.NoError(t, err)
+	require.True(t, replayed)
+	require.EqualValues(t, 1, calls.Load())
+}
@@ -0,0 +1,513 @@
+package services
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+var (
+	// ErrInvalidCursor is returned when pagination cursor can't be decoded
+	ErrInvalidCursor = errors.New("invalid cursor")
+	// ErrNotificationNotFound is returned when notification doesn't exist or has expired
+	ErrNotificationNotFound = errors.New("notification not found")
+	// ErrNotificationNotOwned is returned when notification belongs to another uniqueID
+	ErrNotificationNotOwned = errors.New("notification belongs to another user")
+	// ErrLegacyNotification is returned when notification was stored without metadata
+	ErrLegacyNotification = errors.New("notification has legacy format without metadata")
+)
+
+// SortOrder is an order of inbox items by creation time
+type SortOrder string
+
+const (
+	// SortOrderAsc returns the oldest notifications first
+	SortOrderAsc SortOrder = "asc"
+	// SortOrderDesc returns the newest notifications first
+	SortOrderDesc SortOrder = "desc"
+)
+
+// InboxItem is a stored notification with its identifier
+type InboxItem struct {
+	ID       string               `json:"id"`
+	Body     json.RawMessage      `json:"body"`
+	Metadata NotificationMetadata `json:"metadata"`
+}
+
+// InboxQuery filters and paginates inbox items
+type InboxQuery struct {
+	Limit      int
+	Cursor     string
+	UnreadOnly bool
+	Since      time.Time
+	Until      time.Time
+	Order      SortOrder
+}
+
+// InboxPage is a page of inbox items
+type InboxPage struct {
+	Items      []InboxItem `json:"items"`
+	NextCursor string      `json:"next_cursor,omitempty"`
+	Total      int         `json:"total"`
+	Unread     int         `json:"unread"`
+}
+
+// InboxDeleteFilter selects inbox items to delete. Empty filter selects all items.
+type InboxDeleteFilter struct {
+	IsRead *bool
+	Before time.Time
+}
+
+func (f InboxDeleteFilter) matches(item InboxItem) bool {
+	if f.IsRead != nil && item.Metadata.IsRead != *f.IsRead {
+		return false
+	}
+	if !f.Before.IsZero() && !item.Metadata.CreatedAt.Before(f.Before) {
+		return false
+	}
+	return true
+}
+
+// InboxReadRequest selects notifications to mark as read:
+// either by IDs or all notifications created before the time.
+type InboxReadRequest struct {
+	IDs    []string  `json:"ids"`
+	Before time.Time `json:"before"`
+}
+
+// Validate checks that exactly one selector is set
+func (r InboxReadRequest) Validate() error {
+	if len(r.IDs) == 0 && r.Before.IsZero() {
+		return errors.New("ids or before is required")
+	}
+	if len(r.IDs) != 0 && !r.Before.IsZero() {
+		return errors.New("only one of ids or before can be set")
+	}
+	return nil
+}
+
+// InboxCounts is a number of all and unread notifications
+type InboxCounts struct {
+	Total  int64 `json:"total"`
+	Unread int64 `json:"unread"`
+}
+
+// InboxUsage is a number and total size of stored notifications with the quota limits.
+// Zero limit means the limit is disabled.
+type InboxUsage struct {
+	Count    int64 `json:"count"`
+	Bytes    int64 `json:"bytes"`
+	MaxCount int64 `json:"max_count"`
+	MaxBytes int64 `json:"max_bytes"`
+}
+
+// inboxBatchSize is a number of notifications read from the index at once
+// when the query has no limit or the page is filtered
+const inboxBatchSize = 100
+
+type inboxStorage interface {
+	GetAllByUniqueID(ctx context.Context, uniqueID string) (values []interface{}, keys []string, err error)
+	GetPageByUniqueID(ctx context.Context, uniqueID string, q IndexQuery) (page []IndexedNotification, more bool, err error)
+	DeleteNotifications(ctx context.Context, uniqueID string, keys ...string) (int64, error)
+	Update(ctx context.Context, key string, fn func(value string) (string, error)) error
+	MarkRead(ctx context.Context, uniqueID string, keys ...string) error
+	Counts(ctx context.Context, uniqueID string) (total, unread int64, err error)
+	Usage(ctx context.Context, uniqueID string) (InboxUsage, error)
+	DeleteAllByUniqueID(ctx context.Context, uniqueID string) (int64, error)
+}
+
+// Inbox is a service to query notifications of a uniqueID
+type Inbox struct {
+	storage             inboxStorage
+	subscriptionService subscriptionService
+	eventLog            eventLog
+	// legacyFormat enables support of notifications stored without metadata
+	legacyFormat bool
+	// erasers remove data of the user kept outside of the inbox
+	erasers []userDataEraser
+}
+
+type userDataEraser interface {
+	Erase(ctx context.Context, userDID string) error
+}
+
+// InboxOption configures Inbox optional parameters.
+type InboxOption func(*Inbox)
+
+// WithLegacyFormat enables or disables support of notifications stored without metadata.
+// It can be disabled when legacy notifications are migrated or expired. Enabled by default.
+func WithLegacyFormat(enabled bool) InboxOption {
+	return func(i *Inbox) {
+		i.legacyFormat = enabled
+	}
+}
+
+// WithSyncEvents sends read and delete events to live subscriptions of the owner,
+// so all devices of the user show the same inbox state.
+func WithSyncEvents(sub subscriptionService, l eventLog) InboxOption {
+	return func(i *Inbox) {
+		i.subscriptionService = sub
+		i.eventLog = l
+	}
+}
+
+// WithErasure removes data of the user kept by other services, e.g. the event log,
+// together with notifications when the user erases the account.
+func WithErasure(erasers ...userDataEraser) InboxOption {
+	return func(i *Inbox) {
+		i.erasers = append(i.erasers, erasers...)
+	}
+}
+
+// NewInboxService new instance of inbox service
+func NewInboxService(s inboxStorage, opts ...InboxOption) *Inbox {
+	i := &Inbox{
+		storage:      s,
+		legacyFormat: true,
+	}
+	for _, opt := range opts {
+		if opt != nil {
+			opt(i)
+		}
+	}
+	return i
+}
+
+// List returns a page of notifications of uniqueID ordered by creation time.
+// The page is read from the index starting at the cursor, filters that the index
+// can't apply are evaluated on read notifications. Total and unread counters are
+// calculated for the whole inbox.
+func (i *Inbox) List(ctx context.Context, uniqueID string, q InboxQuery) (InboxPage, error) {
+	after, err := decodeCursor(q.Cursor)
+	if err != nil {
+		return InboxPage{}, err
+	}
+
+	total, unread, err := i.storage.Counts(ctx, uniqueID)
+	if err != nil {
+		return InboxPage{}, err
+	}
+	page := InboxPage{Items: []InboxItem{}, Total: int(total), Unread: int(unread)}
+
+	iq := IndexQuery{
+		Since: q.Since,
+		Until: q.Until,
+		After: after,
+		Desc:  q.Order == SortOrderDesc,
+		Limit: inboxBatchSize,
+	}
+	if q.Limit > 0 && !q.UnreadOnly {
+		iq.Limit = int64(q.Limit)
+	}
+	for {
+		batch, more, err := i.storage.GetPageByUniqueID(ctx, uniqueID, iq)
+		if err != nil {
+			return InboxPage{}, err
+		}
+		for idx, n := range batch {
+			item, err := i.parseItem(n.ID, n.Value)
+			if err != nil {
+				return InboxPage{}, err
+			}
+			if !q.matches(item) {
+				continue
+			}
+			page.Items = append(page.Items, item)
+			if q.Limit > 0 && len(page.Items) == q.Limit {
+				if more || idx < len(batch)-1 {
+					page.NextCursor = encodeCursor(n.IndexPosition)
+				}
+				return page, nil
+			}
+		}
+		if !more || len(batch) == 0 {
+			return page, nil
+		}
+		last := batch[len(batch)-1].IndexPosition
+		iq.After = &last
+	}
+}
+
+// Delete removes notification id owned by uniqueID.
+func (i *Inbox) Delete(ctx context.Context, uniqueID, id string) error {
+	if !IsOwnedBy(id, uniqueID) {
+		return ErrNotificationNotOwned
+	}
+	deleted, err := i.storage.DeleteNotifications(ctx, uniqueID, id)
+	if err != nil {
+		return err
+	}
+	if deleted == 0 {
+		return ErrNotificationNotFound
+	}
+	publishEvent(ctx, i.subscriptionService, i.eventLog, uniqueID,
+		NewDeletedEvent([]string{id}, DeleteReasonDeleted))
+	return nil
+}
+
+// DeleteAll removes notifications of uniqueID selected by filter.
+// Returns number of removed notifications.
+func (i *Inbox) DeleteAll(ctx context.Context, uniqueID string, f InboxDeleteFilter) (int64, error) {
+	all, err := i.load(ctx, uniqueID)
+	if err != nil {
+		return 0, err
+	}
+
+	toDelete := make([]string, 0, len(all))
+	for _, item := range all {
+		if f.matches(item) {
+			toDelete = append(toDelete, item.ID)
+		}
+	}
+	deleted, err := i.storage.DeleteNotifications(ctx, uniqueID, toDelete...)
+	if err != nil {
+		return 0, err
+	}
+	if deleted > 0 {
+		publishEvent(ctx, i.subscriptionService, i.eventLog, uniqueID,
+			NewDeletedEvent(toDelete, DeleteReasonDeleted))
+	}
+	return deleted, nil
+}
+
+// Export writes all notifications of uniqueID with metadata to w as NDJSON, one notification per line.
+// Notifications are loaded before the first write. Returns number of exported notifications.
+func (i *Inbox) Export(ctx context.Context, uniqueID string, w io.Writer) (int, error) {
+	all, err := i.load(ctx, uniqueID)
+	if err != nil {
+		return 0, err
+	}
+	enc := json.NewEncoder(w)
+	for n, item := range all {
+		if err := enc.Encode(item); err != nil {
+			return n, err
+		}
+	}
+	return len(all), nil
+}
+
+// Erase removes all stored notifications of uniqueID together with indexes and counters,
+// including notifications that can't be parsed, and data of the user configured with
+// WithErasure. Returns number of removed notifications.
+func (i *Inbox) Erase(ctx context.Context, uniqueID string) (int64, error) {
+	deleted, err := i.storage.DeleteAllByUniqueID(ctx, uniqueID)
+	if err != nil {
+		return 0, err
+	}
+	for _, e := range i.erasers {
+		if err := e.Erase(ctx, uniqueID); err != nil {
+			return deleted, err
+		}
+	}
+	return deleted, nil
+}
+
+// load returns all notifications of uniqueID
+func (i *Inbox) load(ctx context.Context, uniqueID string) ([]InboxItem, error) {
+	values, keys, err := i.storage.GetAllByUniqueID(ctx, uniqueID)
+	if err != nil {
+		return nil, err
+	}
+	if len(values) != len(keys) {
+		return nil, errors.New("invalid cache state")
+	}
+
+	items := make([]InboxItem, 0, len(keys))
+	for idx := range keys {
+		item, err := i.parseItem(keys[idx], values[idx])
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// Ack marks notification id as read keeping its expiration time.
+// Notifications stored for uniqueID can be acknowledged only by the owner,
+// requesterID is empty for anonymous requests.
+func (i *Inbox) Ack(ctx context.Context, requesterID, id string) error {
+	owner := ownerOf(id)
+	if owner != "" && owner != requesterID {
+		return ErrNotificationNotOwned
+	}
+
+	if err := i.storage.Update(ctx, id, markAsRead); err != nil {
+		return err
+	}
+	if owner == "" {
+		return nil
+	}
+	if err := i.storage.MarkRead(ctx, owner, id); err != nil {
+		return err
+	}
+	publishEvent(ctx, i.subscriptionService, i.eventLog, owner, NewReadEvent([]string{id}))
+	return nil
+}
+
+// MarkAsRead marks notifications of uniqueID as read. Notifications are selected
+// by IDs or by creation time. Returns number of notifications that were unread.
+func (i *Inbox) MarkAsRead(ctx context.Context, uniqueID string, req InboxReadRequest) (int64, error) {
+	ids := req.IDs
+	if len(ids) == 0 {
+		all, err := i.load(ctx, uniqueID)
+		if err != nil {
+			return 0, err
+		}
+		for _, item := range all {
+			if i.legacyFormat && IsEmptyMetadata(item.Metadata) {
+				// legacy notifications can't be marked as read
+				continue
+			}
+			if !item.Metadata.IsRead && item.Metadata.CreatedAt.Before(req.Before) {
+				ids = append(ids, item.ID)
+			}
+		}
+	}
+	for _, id := range ids {
+		if !IsOwnedBy(id, uniqueID) {
+			return 0, ErrNotificationNotOwned
+		}
+	}
+
+	var updated int64
+	read := make([]string, 0, len(ids))
+	changed := make([]string, 0, len(ids))
+	for _, id := range ids {
+		wasUnread := false
+		err := i.storage.Update(ctx, id, func(value string) (string, error) {
+			newValue, err := markAsRead(value)
+			wasUnread = err == nil && newValue != value
+			return newValue, err
+		})
+		switch {
+		// notifications that expired in the meantime or have old format are skipped
+		case errors.Is(err, ErrNotificationNotFound), errors.Is(err, ErrLegacyNotification):
+			continue
+		case err != nil:
+			return updated, err
+		}
+		if wasUnread {
+			updated++
+			changed = append(changed, id)
+		}
+		read = append(read, id)
+	}
+	if err := i.storage.MarkRead(ctx, uniqueID, read...); err != nil {
+		return updated, err
+	}
+	if len(changed) > 0 {
+		publishEvent(ctx, i.subscriptionService, i.eventLog, uniqueID, NewReadEvent(changed))
+	}
+	return updated, nil
+}
+
+// Counts returns number of all and unread notifications of uniqueID.
+func (i *Inbox) Counts(ctx context.Context, uniqueID string) (InboxCounts, error) {
+	total, unread, err := i.storage.Counts(ctx, uniqueID)
+	if err != nil {
+		return InboxCounts{}, err
+	}
+	return InboxCounts{Total: total, Unread: unread}, nil
+}
+
+// Usage returns number and total size of stored notifications of uniqueID with the quota limits.
+func (i *Inbox) Usage(ctx context.Context, uniqueID string) (InboxUsage, error) {
+	return i.storage.Usage(ctx, uniqueID)
+}
+
+// markAsRead sets read metadata of stored notification.
+// Already read notification is returned unchanged.
+func markAsRead(value string) (string, error) {
+	var msg NotificationContent
+	if err := json.Unmarshal([]byte(value), &msg); err != nil {
+		return "", fmt.Errorf("failed to unmarshal notification: %w", err)
+	}
+	if IsEmptyMetadata(msg.Metadata) {
+		return "", ErrLegacyNotification
+	}
+	if msg.Metadata.IsRead {
+		return value, nil
+	}
+
+	msg.Metadata.ReadAt = time.Now().UTC()
+	msg.Metadata.IsRead = true
+	updated, err := json.Marshal(msg)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal updated notification: %w", err)
+	}
+	return string(updated), nil
+}
+
+// IsOwnedBy checks that notification id was stored for uniqueID.
+func IsOwnedBy(id, uniqueID string) bool {
+	return uniqueID != "" && ownerOf(id) == uniqueID
+}
+
+func (q InboxQuery) matches(item InboxItem) bool {
+	if q.UnreadOnly && item.Metadata.IsRead {
+		return false
+	}
+	if !q.Since.IsZero() && item.Metadata.CreatedAt.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && item.Metadata.CreatedAt.After(q.Until) {
+		return false
+	}
+	return true
+}
+
+func (i *Inbox) parseItem(key string, value interface{}) (InboxItem, error) {
+	msg, ok := value.(string)
+	if !ok {
+		return InboxItem{}, errors.New("invalid message from redis")
+	}
+
+	var nContent NotificationContent
+	if err := json.Unmarshal([]byte(msg), &nContent); err != nil {
+		return InboxItem{}, fmt.Errorf("failed to unmarshal notification: %w", err)
+	}
+
+	body := nContent.Body
+	if i.legacyFormat && IsEmptyMetadata(nContent.Metadata) {
+		// old message format without metadata
+		body = []byte(msg)
+	}
+	return InboxItem{
+		ID:       key,
+		Body:     body,
+		Metadata: nContent.Metadata,
+	}, nil
+}
+
+// inboxCursor is a position of the last item of the page in the index.
+// Items created at the same millisecond are ordered by ID.
+type inboxCursor struct {
+	CreatedAt time.Time `json:"t"`
+	ID        string    `json:"id"`
+}
+
+func encodeCursor(p IndexPosition) string {
+	// marshaling of the struct with time and string can't fail
+	b, _ := json.Marshal(inboxCursor{CreatedAt: time.UnixMilli(p.CreatedAt).UTC(), ID: p.ID})
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func decodeCursor(cursor string) (*IndexPosition, error) {
+	if cursor == "" {
+		return nil, nil
+	}
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+	var c inboxCursor
+	if err := json.Unmarshal(b, &c); err != nil || c.ID == "" {
+		return nil, ErrInvalidCursor
+	}
+	return &IndexPosition{CreatedAt: c.CreatedAt.UnixMilli(), ID: c.ID}, nil
+}
@@ -0,0 +1,376 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type InboxStorageMock struct {
+	values []interface{}
+	keys   []string
+	read   []string
+}
+
+func (s *InboxStorageMock) GetAllByUniqueID(_ context.Context, _ string) (values []interface{}, keys []string, err error) {
+	return s.values, s.keys, nil
+}
+
+// GetPageByUniqueID pages notifications the same way the index does
+func (s *InboxStorageMock) GetPageByUniqueID(_ context.Context, _ string,
+	q IndexQuery) ([]IndexedNotification, bool, error) {
+	all := make([]IndexedNotification, 0, len(s.keys))
+	for idx, k := range s.keys {
+		var content NotificationContent
+		if err := json.Unmarshal([]byte(s.values[idx].(string)), &content); err != nil {
+			return nil, false, err
+		}
+		var createdAt int64
+		if !content.Metadata.CreatedAt.IsZero() {
+			createdAt = content.Metadata.CreatedAt.UnixMilli()
+		}
+		all = append(all, IndexedNotification{
+			IndexPosition: IndexPosition{CreatedAt: createdAt, ID: k},
+			Value:         s.values[idx],
+		})
+	}
+	sort.Slice(all, func(i, j int) bool {
+		if q.Desc {
+			return all[j].less(all[i].IndexPosition)
+		}
+		return all[i].less(all[j].IndexPosition)
+	})
+
+	var page []IndexedNotification
+	for _, n := range all {
+		if !q.Since.IsZero() && n.CreatedAt < q.Since.UnixMilli() ||
+			!q.Until.IsZero() && n.CreatedAt > q.Until.UnixMilli() {
+			continue
+		}
+		if q.After != nil && (q.Desc && !n.less(*q.After) || !q.Desc && !q.After.less(n.IndexPosition)) {
+			continue
+		}
+		if int64(len(page)) == q.Limit {
+			return page, true, nil
+		}
+		page = append(page, n)
+	}
+	return page, false, nil
+}
+
+func (s *InboxStorageMock) DeleteNotifications(_ context.Context, _ string, keys ...string) (int64, error) {
+	var deleted int64
+	for _, k := range keys {
+		for idx := range s.keys {
+			if s.keys[idx] == k {
+				s.keys = append(s.keys[:idx], s.keys[idx+1:]...)
+				s.values = append(s.values[:idx], s.values[idx+1:]...)
+				deleted++
+				break
+			}
+		}
+	}
+	return deleted, nil
+}
+
+func (s *InboxStorageMock) Update(_ context.Context, key string, fn func(value string) (string, error)) error {
+	for idx := range s.keys {
+		if s.keys[idx] != key {
+			continue
+		}
+		updated, err := fn(s.values[idx].(string))
+		if err != nil {
+			return err
+		}
+		s.values[idx] = updated
+		return nil
+	}
+	return ErrNotificationNotFound
+}
+
+func (s *InboxStorageMock) MarkRead(_ context.Context, _ string, keys ...string) error {
+	s.read = append(s.read, keys...)
+	return nil
+}
+
+func (s *InboxStorageMock) Counts(_ context.Context, _ string) (total, unread int64, err error) {
+	for _, v := range s.values {
+		var content NotificationContent
+		if err := json.Unmarshal([]byte(v.(string)), &content); err != nil {
+			return 0, 0, err
+		}
+		if !content.Metadata.IsRead {
+			unread++
+		}
+	}
+	return int64(len(s.keys)), unread, nil
+}
+
+func (s *InboxStorageMock) Usage(_ context.Context, _ string) (InboxUsage, error) {
+	return InboxUsage{Count: int64(len(s.keys))}, nil
+}
+
+func (s *InboxStorageMock) DeleteAllByUniqueID(_ context.Context, _ string) (int64, error) {
+	deleted := int64(len(s.keys))
+	s.keys, s.values = nil, nil
+	return deleted, nil
+}
+
+func (s *InboxStorageMock) add(t *testing.T, id string, createdAt time.Time, isRead bool) {
+	b, err := json.Marshal(NotificationContent{
+		Metadata: NotificationMetadata{CreatedAt: createdAt, IsRead: isRead},
+		Body:     json.RawMessage(fmt.Sprintf(`{"id":%q}`, id)),
+	})
+	require.NoError(t, err)
+	s.keys = append(s.keys, id)
+	s.values = append(s.values, string(b))
+}
+
+func itemIDs(items []InboxItem) []string {
+	ids := make([]string, 0, len(items))
+	for _, item := range items {
+		ids = append(ids, item.ID)
+	}
+	return ids
+}
+
+func TestInbox_List_Pagination(t *testing.T) {
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	storage := &InboxStorageMock{}
+	storage.add(t, "c", start.Add(2*time.Minute), false)
+	storage.add(t, "a", start, true)
+	storage.add(t, "b", start.Add(time.Minute), false)
+	storage.add(t, "d", start.Add(2*time.Minute), false)
+	inbox := NewInboxService(storage)
+
+	page, err := inbox.List(context.Background(), "did", InboxQuery{Limit: 3, Order: SortOrderDesc})
+	require.NoError(t, err)
+	require.Equal(t, []string{"d", "c", "b"}, itemIDs(page.Items))
+	require.Equal(t, 4, page.Total)
+	require.Equal(t, 3, page.Unread)
+	require.NotEmpty(t, page.NextCursor)
+
+	page, err = inbox.List(context.Background(), "did", InboxQuery{
+		Limit: 3, Order: SortOrderDesc, Cursor: page.NextCursor})
+	require.NoError(t, err)
+	require.Equal(t, []string{"a"}, itemIDs(page.Items))
+	require.Empty(t, page.NextCursor)
+
+	page, err = inbox.List(context.Background(), "did", InboxQuery{Limit: 2, Order: SortOrderAsc})
+	require.NoError(t, err)
+	require.Equal(t, []string{"a", "b"}, itemIDs(page.Items))
+
+	page, err = inbox.List(context.Background(), "did", InboxQuery{
+		Limit: 2, Order: SortOrderAsc, Cursor: page.NextCursor})
+	require.NoError(t, err)
+	require.Equal(t, []string{"c", "d"}, itemIDs(page.Items))
+	require.Empty(t, page.NextCursor)
+}
+
+func TestInbox_List_Filters(t *testing.T) {
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	storage := &InboxStorageMock{}
+	storage.add(t, "a", start, false)
+	storage.add(t, "b", start.Add(time.Minute), true)
+	storage.add(t, "c", start.Add(2*time.Minute), false)
+	storage.add(t, "d", start.Add(3*time.Minute), false)
+	inbox := NewInboxService(storage)
+
+	page, err := inbox.List(context.Background(), "did", InboxQuery{
+		Order:      SortOrderAsc,
+		UnreadOnly: true,
+		Since:      start.Add(time.Minute),
+		Until:      start.Add(2 * time.Minute),
+	})
+	require.NoError(t, err)
+	require.Equal(t, []string{"c"}, itemIDs(page.Items))
+	require.Equal(t, 4, page.Total)
+	require.Equal(t, 3, page.Unread)
+}
+
+func TestInbox_List_Empty(t *testing.T) {
+	inbox := NewInboxService(&InboxStorageMock{})
+
+	page, err := inbox.List(context.Background(), "did", InboxQuery{Limit: 10})
+	require.NoError(t, err)
+	require.NotNil(t, page.Items)
+	require.Empty(t, page.Items)
+	require.Zero(t, page.Total)
+}
+
+func TestInbox_List_InvalidCursor(t *testing.T) {
+	inbox := NewInboxService(&InboxStorageMock{})
+
+	_, err := inbox.List(context.Background(), "did", InboxQuery{Cursor: "not a cursor"})
+	require.ErrorIs(t, err, ErrInvalidCursor)
+}
+
+func TestInbox_List_LegacyFormat(t *testing.T) {
+	storage := &InboxStorageMock{}
+	storage.keys = append(storage.keys, "legacy")
+	storage.values = append(storage.values, `{"id":"legacy"}`)
+
+	// legacy notification is returned as is
+	page, err := NewInboxService(storage).List(context.Background(), "did", InboxQuery{})
+	require.NoError(t, err)
+	require.Len(t, page.Items, 1)
+	require.JSONEq(t, `{"id":"legacy"}`, string(page.Items[0].Body))
+
+	page, err = NewInboxService(storage, WithLegacyFormat(false)).List(context.Background(), "did", InboxQuery{})
+	require.NoError(t, err)
+	require.Len(t, page.Items, 1)
+	require.Empty(t, page.Items[0].Body)
+}
+
+func TestInbox_Delete(t *testing.T) {
+	storage := &InboxStorageMock{}
+	storage.add(t, "did:example:1+a", time.Now(), false)
+	storage.add(t, "did:example:2+b", time.Now(), false)
+	inbox := NewInboxService(storage)
+
+	err := inbox.Delete(context.Background(), "did:example:1", "did:example:2+b")
+	require.ErrorIs(t, err, ErrNotificationNotOwned)
+	err = inbox.Delete(context.Background(), "did:example:1", "b")
+	require.ErrorIs(t, err, ErrNotificationNotOwned)
+
+	err = inbox.Delete(context.Background(), "did:example:1", "did:example:1+a")
+	require.NoError(t, err)
+	require.Equal(t, []string{"did:example:2+b"}, storage.keys)
+
+	err = inbox.Delete(context.Background(), "did:example:1", "did:example:1+a")
+	require.ErrorIs(t, err, ErrNotificationNotFound)
+}
+
+func TestInbox_DeleteAll(t *testing.T) {
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	storage := &InboxStorageMock{}
+	storage.add(t, "a", start, true)
+	storage.add(t, "b", start.Add(time.Minute), false)
+	storage.add(t, "c", start.Add(2*time.Minute), true)
+	inbox := NewInboxService(storage)
+
+	isRead := true
+	deleted, err := inbox.DeleteAll(context.Background(), "did", InboxDeleteFilter{
+		IsRead: &isRead,
+		Before: start.Add(2 * time.Minute),
+	})
+	require.NoError(t, err)
+	require.EqualValues(t, 1, deleted)
+	require.Equal(t, []string{"b", "c"}, storage.keys)
+
+	deleted, err = inbox.DeleteAll(context.Background(), "did", InboxDeleteFilter{})
+	require.NoError(t, err)
+	require.EqualValues(t, 2, deleted)
+	require.Empty(t, storage.keys)
+}
+
+func TestInbox_Ack(t *testing.T) {
+	storage := &InboxStorageMock{}
+	storage.add(t, "did:example:1+a", time.Now(), false)
+	storage.add(t, "b", time.Now(), false)
+	storage.keys = append(storage.keys, "legacy")
+	storage.values = append(storage.values, `{"id":"legacy"}`)
+	inbox := NewInboxService(storage)
+
+	err := inbox.Ack(context.Background(), "", "did:example:1+a")
+	require.ErrorIs(t, err, ErrNotificationNotOwned)
+	err = inbox.Ack(context.Background(), "did:example:2", "did:example:1+a")
+	require.ErrorIs(t, err, ErrNotificationNotOwned)
+
+	require.NoError(t, inbox.Ack(context.Background(), "did:example:1", "did:example:1+a"))
+	require.NoError(t, inbox.Ack(context.Background(), "", "b"))
+	items, err := inbox.load(context.Background(), "did:example:1")
+	require.NoError(t, err)
+	require.True(t, items[0].Metadata.IsRead)
+	require.False(t, items[0].Metadata.ReadAt.IsZero())
+	require.True(t, items[1].Metadata.IsRead)
+
+	err = inbox.Ack(context.Background(), "", "legacy")
+	require.ErrorIs(t, err, ErrLegacyNotification)
+	err = inbox.Ack(context.Background(), "", "unknown")
+	require.ErrorIs(t, err, ErrNotificationNotFound)
+}
+
+func TestInbox_MarkAsRead(t *testing.T) {
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	storage := &InboxStorageMock{}
+	storage.add(t, "did:example:1+a", start, false)
+	storage.add(t, "did:example:1+b", start.Add(time.Minute), true)
+	storage.add(t, "did:example:1+c", start.Add(2*time.Minute), false)
+	storage.add(t, "did:example:1+d", start.Add(3*time.Minute), false)
+	inbox := NewInboxService(storage)
+
+	_, err := inbox.MarkAsRead(context.Background(), "did:example:1", InboxReadRequest{
+		IDs: []string{"did:example:1+a", "did:example:2+a"},
+	})
+	require.ErrorIs(t, err, ErrNotificationNotOwned)
+
+	updated, err := inbox.MarkAsRead(context.Background(), "did:example:1", InboxReadRequest{
+		IDs: []string{"did:example:1+a", "did:example:1+b", "did:example:1+expired"},
+	})
+	require.NoError(t, err)
+	require.EqualValues(t, 1, updated)
+	require.Equal(t, []string{"did:example:1+a", "did:example:1+b"}, storage.read)
+
+	storage.read = nil
+	updated, err = inbox.MarkAsRead(context.Background(), "did:example:1", InboxReadRequest{
+		Before: start.Add(3 * time.Minute),
+	})
+	require.NoError(t, err)
+	require.EqualValues(t, 1, updated)
+	require.Equal(t, []string{"did:example:1+c"}, storage.read)
+
+	page, err := inbox.List(context.Background(), "did:example:1", InboxQuery{})
+	require.NoError(t, err)
+	require.Equal(t, 1, page.Unread)
+}
+
+func TestInbox_Export(t *testing.T) {
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	storage := &InboxStorageMock{}
+	storage.add(t, "a", start, true)
+	storage.add(t, "b", start.Add(time.Minute), false)
+	inbox := NewInboxService(storage)
+
+	var buf bytes.Buffer
+	exported, err := inbox.Export(context.Background(), "did", &buf)
+	require.NoError(t, err)
+	require.Equal(t, 2, exported)
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 2)
+	var item InboxItem
+	require.NoError(t, json.Unmarshal([]byte(lines[1]), &item))
+	require.Equal(t, "b", item.ID)
+	require.JSONEq(t, `{"id":"b"}`, string(item.Body))
+	require.Equal(t, start.Add(time.Minute), item.Metadata.CreatedAt)
+}
+
+func TestInbox_Erase_EventLog(t *testing.T) {
+	ctx := context.Background()
+	l, _ := newTestEventLog(t, 100)
+	userDID := "did:example:123"
+	first, err := l.Append(ctx, userDID, NotificationPayload{ID: "1"})
+	require.NoError(t, err)
+	_, err = l.Append(ctx, userDID, NotificationPayload{ID: "2"})
+	require.NoError(t, err)
+
+	storage := &InboxStorageMock{}
+	storage.add(t, "did:example:123+a", time.Now(), false)
+	inbox := NewInboxService(storage, WithErasure(l))
+	deleted, err := inbox.Erase(ctx, userDID)
+	require.NoError(t, err)
+	require.EqualValues(t, 1, deleted)
+
+	// erased events can't be replayed to reconnected subscribers
+	events, err := l.Since(ctx, userDID, first)
+	require.NoError(t, err)
+	require.Empty(t, events)
+}
@@ -0,0 +1,132 @@
+package services
+
+import (
+	"strings"
+)
+
+// keySchemaVersion is a part of every namespaced key,
+// so the keys layout can be changed without clashes with stored keys.
+const keySchemaVersion = "v1"
+
+// legacyKeySchema builds un-namespaced keys written before the namespace was introduced
+var legacyKeySchema = keySchema{}
+
+// keySchema maps notification IDs and unique IDs to redis keys.
+// IDs are exposed to clients, keys are internal to RedisCache.
+type keySchema struct {
+	namespace string
+}
+
+func newKeySchema(prefix string) keySchema {
+	namespace := keySchemaVersion + ":"
+	if prefix != "" {
+		namespace = prefix + ":" + namespace
+	}
+	return keySchema{namespace: namespace}
+}
+
+// value returns key of the value with id. Notifications of uniqueID share
+// the hash tag with the uniqueID indexes, so they are in the same cluster slot.
+func (s keySchema) value(id string) string {
+	if s.namespace == "" {
+		return id
+	}
+	if owner, rest, ok := strings.Cut(id, "+"); ok {
+		return s.namespace + "{" + owner + "}+" + rest
+	}
+	return s.namespace + id
+}
+
+func (s keySchema) values(ids []string) []string {
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = s.value(id)
+	}
+	return keys
+}
+
+// id returns ID of the value stored by key
+func (s keySchema) id(key string) string {
+	id := strings.TrimPrefix(key, s.namespace)
+	if s.namespace == "" || !strings.HasPrefix(id, "{") {
+		return id
+	}
+	if owner, rest, ok := strings.Cut(id[1:], "}+"); ok {
+		return owner + "+" + rest
+	}
+	return id
+}
+
+// search returns pattern of keys of all notifications of uniqueID
+func (s keySchema) search(uniqueID string) string {
+	return s.value(uniqueID+"+") + "*"
+}
+
+// index returns key of sorted set with notification IDs scored by creation time
+func (s keySchema) index(uniqueID string) string {
+	return s.namespace + "index:{" + uniqueID + "}"
+}
+
+// expiryIndex returns key of sorted set with notification IDs scored by expiration time
+func (s keySchema) expiryIndex(uniqueID string) string {
+	return s.namespace + "index:expiry:{" + uniqueID + "}"
+}
+
+// unreadIndex returns key of sorted set with unread notification IDs scored by expiration time
+func (s keySchema) unreadIndex(uniqueID string) string {
+	return s.namespace + "index:unread:{" + uniqueID + "}"
+}
+
+// sizeIndex returns key of hash with sizes of notifications in bytes
+func (s keySchema) sizeIndex(uniqueID string) string {
+	return s.namespace + "index:size:{" + uniqueID + "}"
+}
+
+// indexBackfill returns key of marker set when notifications of uniqueID missing in the indexes were indexed
+func (s keySchema) indexBackfill(uniqueID string) string {
+	return s.namespace + "index:backfill:{" + uniqueID + "}"
+}
+
+// subscriptionChannel returns pub/sub channel with notifications and events of uniqueID subscriptions
+func (s keySchema) subscriptionChannel(uniqueID string) string {
+	return s.namespace + "channel:{" + uniqueID + "}"
+}
+
+// subscriptionChannelOwner returns uniqueID of the pub/sub channel
+func (s keySchema) subscriptionChannelOwner(channel string) (string, bool) {
+	owner := strings.TrimPrefix(channel, s.namespace+"channel:{")
+	if owner == channel || !strings.HasSuffix(owner, "}") {
+		return "", false
+	}
+	return strings.TrimSuffix(owner, "}"), true
+}
+
+// subscriptionLeases returns key of sorted set with open subscriptions of uniqueID scored by lease expiration time
+func (s keySchema) subscriptionLeases(uniqueID string) string {
+	return s.namespace + "subscriptions:{" + uniqueID + "}"
+}
+
+// events returns key of stream with subscription events of uniqueID
+func (s keySchema) events(uniqueID string) string {
+	return s.namespace + "events:{" + uniqueID + "}"
+}
+
+// offlineQueue returns key of list with notifications of uniqueID sent while it had no subscriptions
+func (s keySchema) offlineQueue(uniqueID string) string {
+	return s.namespace + "queue:{" + uniqueID + "}"
+}
+
+// subscribeTicket returns key of single-use subscribe ticket with the token hash
+func (s keySchema) subscribeTicket(hash string) string {
+	return s.namespace + "subscribe:ticket:" + hash
+}
+
+// subscribeSession returns key of subscribe session with the token hash
+func (s keySchema) subscribeSession(hash string) string {
+	return s.namespace + "subscribe:session:" + hash
+}
+
+// subscribeGrants returns key of set with ticket and session keys issued to uniqueID
+func (s keySchema) subscribeGrants(uniqueID string) string {
+	return s.namespace + "subscribe:grants:{" + uniqueID + "}"
+}
@@ -0,0 +1,26 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeySchema(t *testing.T) {
+	s := newKeySchema("notifications")
+	for _, tc := range []struct {
+		id  string
+		key string
+	}{
+		{id: "did:example:1+uuid", key: "notifications:v1:{did:example:1}+uuid"},
+		{id: "uuid", key: "notifications:v1:uuid"},
+	} {
+		require.Equal(t, tc.key, s.value(tc.id))
+		require.Equal(t, tc.id, s.id(tc.key))
+		require.Equal(t, tc.id, legacyKeySchema.value(tc.id))
+	}
+	require.Equal(t, "notifications:v1:{did:example:1}+*", s.search("did:example:1"))
+	require.Equal(t, "notifications:v1:index:{did:example:1}", s.index("did:example:1"))
+	require.Equal(t, "did:example:1+*", legacyKeySchema.search("did:example:1"))
+	require.Equal(t, "v1:uuid", newKeySchema("").value("uuid"))
+}
@@ -0,0 +1,180 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/iden3/notification-service/log"
+)
+
+// errAlreadyMigrated aborts update of notification that doesn't have legacy format
+var errAlreadyMigrated = errors.New("notification is already migrated")
+
+type migrationStorage interface {
+	ScanLegacyIDs(ctx context.Context, batch int64, fn func(ids []string) error) error
+	Get(ctx context.Context, key string) (interface{}, error)
+	Update(ctx context.Context, key string, fn func(value string) (string, error)) error
+	TTL(ctx context.Context, key string) (time.Duration, error)
+	Index(ctx context.Context, key string) error
+}
+
+// MigrationOptions configures legacy format migration
+type MigrationOptions struct {
+	// DryRun only counts notifications to migrate
+	DryRun bool
+	// BatchSize is a number of keys scanned per request
+	BatchSize int64
+	// Rate limits number of processed notifications per second, 0 disables the limit
+	Rate int
+}
+
+// MigrationStats is a result of legacy format migration
+type MigrationStats struct {
+	Scanned  int
+	Migrated int
+	Skipped  int
+	Failed   int
+}
+
+// Migration is a service to rewrite notifications stored in legacy format without metadata
+type Migration struct {
+	storage            migrationStorage
+	expirationDuration time.Duration
+}
+
+// NewMigrationService new instance of migration service. expirationDuration is
+// the lifetime legacy notifications were stored with, it's used to restore creation time.
+func NewMigrationService(s migrationStorage, expirationDuration time.Duration) *Migration {
+	return &Migration{
+		storage:            s,
+		expirationDuration: expirationDuration,
+	}
+}
+
+// MigrateLegacyFormat wraps raw bodies of legacy notifications into NotificationContent
+// with synthesized metadata. TTL of notifications is preserved, migrated notifications
+// are indexed with the restored metadata, so they are listed and counted. Failures of single
+// notifications are logged and counted, the migration goes on.
+func (m *Migration) MigrateLegacyFormat(ctx context.Context, opts MigrationOptions) (MigrationStats, error) {
+	var (
+		mu    sync.Mutex
+		stats MigrationStats
+		tick  <-chan time.Time
+	)
+	if opts.Rate > 0 {
+		ticker := time.NewTicker(time.Second / time.Duration(opts.Rate))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	err := m.storage.ScanLegacyIDs(ctx, opts.BatchSize, func(ids []string) error {
+		for _, id := range ids {
+			if tick != nil {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-tick:
+				}
+			}
+
+			migrated, err := m.migrate(ctx, id, opts.DryRun)
+			mu.Lock()
+			stats.Scanned++
+			switch {
+			case err != nil:
+				stats.Failed++
+				log.WithContext(ctx).Errorf("failed to migrate notification '%s': %v", id, err)
+			case migrated:
+				stats.Migrated++
+			default:
+				stats.Skipped++
+			}
+			mu.Unlock()
+		}
+		return nil
+	})
+	return stats, err
+}
+
+func (m *Migration) migrate(ctx context.Context, id string, dryRun bool) (bool, error) {
+	ttl, err := m.storage.TTL(ctx, id)
+	if errors.Is(err, ErrNotificationNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if dryRun {
+		v, err := m.storage.Get(ctx, id)
+		if err != nil || v == nil {
+			return false, err
+		}
+		s, ok := v.(string)
+		if !ok {
+			return false, errors.New("invalid message from redis")
+		}
+		_, ok, err = migrateLegacyValue(s, ttl, m.expirationDuration)
+		return ok, err
+	}
+
+	err = m.storage.Update(ctx, id, func(value string) (string, error) {
+		migrated, ok, err := migrateLegacyValue(value, ttl, m.expirationDuration)
+		if err != nil {
+			return "", err
+		}
+		if !ok {
+			return "", errAlreadyMigrated
+		}
+		return migrated, nil
+	})
+	switch {
+	case errors.Is(err, errAlreadyMigrated), errors.Is(err, ErrNotificationNotFound):
+		return false, nil
+	case err != nil:
+		return false, err
+	}
+	if err := m.storage.Index(ctx, id); err != nil {
+		return false, fmt.Errorf("failed to index migrated notification: %w", err)
+	}
+	return true, nil
+}
+
+// migrateLegacyValue wraps legacy value into NotificationContent. Metadata is restored
+// from the remaining ttl of the value. Returns false if value doesn't have legacy format.
+func migrateLegacyValue(value string, ttl, expirationDuration time.Duration) (string, bool, error) {
+	if !json.Valid([]byte(value)) {
+		return "", false, nil
+	}
+	var content NotificationContent
+	if err := json.Unmarshal([]byte(value), &content); err == nil && !IsEmptyMetadata(content.Metadata) {
+		return "", false, nil
+	}
+
+	now := time.Now().UTC()
+	if ttl <= 0 {
+		ttl = expirationDuration
+	}
+	expiresAt := now.Add(ttl)
+	// legacy notifications were stored for expirationDuration
+	createdAt := expiresAt.Add(-expirationDuration)
+	if createdAt.After(now) {
+		createdAt = now
+	}
+
+	b, err := json.Marshal(NotificationContent{
+		Metadata: NotificationMetadata{
+			CreatedAt: createdAt,
+			ExpiresAt: expiresAt,
+		},
+		Body: json.RawMessage(value),
+	})
+	if err != nil {
+		return "", false, err
+	}
+	return string(b), true, nil
+}
@@ -0,0 +1,74 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMigration_MigrateLegacyFormat(t *testing.T) {
+	ctx := context.Background()
+	cache, mr := newTestRedisCache(t, WithKeyPrefix("notifications"), WithLegacyKeys(true))
+
+	legacyID := buildMessageKey("did:example:1", uuid.NewString())
+	require.NoError(t, mr.Set(legacyID, `{"my_cat":"123321"}`))
+	mr.SetTTL(legacyID, time.Hour)
+	anonymousID := uuid.NewString()
+	require.NoError(t, mr.Set(anonymousID, `{"my_dog":"1"}`))
+	mr.SetTTL(anonymousID, time.Hour)
+	// keys of other services are not touched
+	require.NoError(t, mr.Set("foreign", `{"x":1}`))
+	require.NoError(t, saveErr(cache.SaveNotification(ctx, "did:example:1", buildMessageKey("did:example:1", uuid.NewString()),
+		`{"metadata":{"created_at":"2024-01-01T00:00:00Z"},"body":{}}`, time.Now(), time.Hour)))
+
+	service := NewMigrationService(cache, 24*time.Hour)
+	stats, err := service.MigrateLegacyFormat(ctx, MigrationOptions{DryRun: true, BatchSize: 10})
+	require.NoError(t, err)
+	require.Equal(t, MigrationStats{Scanned: 2, Migrated: 2}, stats)
+	raw, err := mr.Get(legacyID)
+	require.NoError(t, err)
+	require.Equal(t, `{"my_cat":"123321"}`, raw)
+
+	// listing indexes the legacy notification without metadata, so it isn't unread
+	total, unread, err := cache.Counts(ctx, "did:example:1")
+	require.NoError(t, err)
+	require.EqualValues(t, 1, total)
+	require.EqualValues(t, 1, unread)
+	_, _, err = cache.GetAllByUniqueID(ctx, "did:example:1")
+	require.NoError(t, err)
+
+	stats, err = service.MigrateLegacyFormat(ctx, MigrationOptions{BatchSize: 10, Rate: 100})
+	require.NoError(t, err)
+	require.Equal(t, MigrationStats{Scanned: 2, Migrated: 2}, stats)
+
+	raw, err = mr.Get(legacyID)
+	require.NoError(t, err)
+	var content NotificationContent
+	require.NoError(t, json.Unmarshal([]byte(raw), &content))
+	require.JSONEq(t, `{"my_cat":"123321"}`, string(content.Body))
+	require.WithinDuration(t, time.Now().Add(time.Hour), content.Metadata.ExpiresAt, time.Second)
+	require.WithinDuration(t, time.Now().Add(-23*time.Hour), content.Metadata.CreatedAt, time.Second)
+	require.Equal(t, time.Hour, mr.TTL(legacyID))
+
+	// migrated notification is indexed with the restored metadata
+	_, ids, err := cache.GetAllByUniqueID(ctx, "did:example:1")
+	require.NoError(t, err)
+	require.Contains(t, ids, legacyID)
+	total, unread, err = cache.Counts(ctx, "did:example:1")
+	require.NoError(t, err)
+	require.EqualValues(t, 2, total)
+	require.EqualValues(t, 2, unread)
+
+	raw, err = mr.Get("foreign")
+	require.NoError(t, err)
+	require.Equal(t, `{"x":1}`, raw)
+
+	// migrated notifications are skipped
+	stats, err = service.MigrateLegacyFormat(ctx, MigrationOptions{BatchSize: 10})
+	require.NoError(t, err)
+	require.Equal(t, MigrationStats{Scanned: 2, Skipped: 2}, stats)
+}
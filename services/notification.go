@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/url"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
@@ -17,23 +18,39 @@ import (
 type NotificationPayload struct {
 	ID  string `json:"id"`
 	URL string `json:"url"`
+	// Event is a type of subscription event, it's empty for new notification.
+	// Events have no ID and URL of notification.
+	Event string `json:"event,omitempty"`
+	// IDs of notifications read or deleted
+	IDs []string `json:"ids,omitempty"`
+	// Reason why notifications were deleted
+	Reason string `json:"reason,omitempty"`
+	// EventID is an ID of subscription event, it's sent as SSE event ID
+	EventID string `json:"-"`
+	// Count is a number of notifications coalesced into the event for slow subscriber
+	Count int `json:"-"`
+	// Attributes of the message are used to filter subscriptions, they aren't sent to devices
+	Attributes NotificationAttributes `json:"-"`
 }
 
 type NotificationMetadata struct {
 	CreatedAt time.Time `json:"created_at"`
 	ReadAt    time.Time `json:"read_at"`
 	IsRead    bool      `json:"is_read"`
+	ExpiresAt time.Time `json:"expires_at"`
 }
 
-func NewMetadata() NotificationMetadata {
+func NewMetadata(ttl time.Duration) NotificationMetadata {
+	createdAt := time.Now().UTC()
 	return NotificationMetadata{
-		CreatedAt: time.Now().UTC(),
+		CreatedAt: createdAt,
 		IsRead:    false,
+		ExpiresAt: createdAt.Add(ttl),
 	}
 }
 
 func IsEmptyMetadata(m NotificationMetadata) bool {
-	return m.CreatedAt.IsZero() && m.ReadAt.IsZero() && !m.IsRead
+	return m.CreatedAt.IsZero() && m.ReadAt.IsZero() && !m.IsRead && m.ExpiresAt.IsZero()
 }
 
 type NotificationContent struct {
@@ -45,12 +62,25 @@ type NotificationContent struct {
 type PushNotification struct {
 	Message      json.RawMessage `json:"message"`
 	PushMetadata PushMetadata    `json:"metadata"`
+	// TTL is an optional lifetime of the notification in seconds
+	TTL int64 `json:"ttl,omitempty"`
+	// ExpiresAt is an optional expiration time of the notification
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
 }
 
 func (p *PushNotification) Validate() error {
 	if len(p.Message) == 0 {
 		return errors.New("message is required")
 	}
+	if p.TTL < 0 {
+		return errors.New("ttl must be positive")
+	}
+	if p.TTL != 0 && p.ExpiresAt != nil {
+		return errors.New("only one of ttl or expires_at can be set")
+	}
+	if p.ExpiresAt != nil && !p.ExpiresAt.After(time.Now()) {
+		return errors.New("expires_at must be in the future")
+	}
 	if len(p.PushMetadata.Devices) == 0 {
 		return errors.New("at least one device is required")
 	}
@@ -81,6 +111,9 @@ type NotificationResult struct {
 	Device EncryptedDeviceMetadata `json:"device"`
 	Status NotificationStatus      `json:"status"`
 	Reason string                  `json:"reason"`
+	// NotificationID is an ID of notification stored for the device owner,
+	// so sender can check which notifications exist after a retry
+	NotificationID string `json:"notification_id,omitempty"`
 }
 type cryptoService interface {
 	Decrypt(msg []byte) ([]byte, error)
@@ -89,22 +122,64 @@ type cryptoService interface {
 }
 type cachingService interface {
 	Get(ctx context.Context, key string) (interface{}, error)
-	Set(ctx context.Context, key string, value interface{}, duration time.Duration) error
+	SaveNotification(ctx context.Context, uniqueID, key string,
+		value interface{}, createdAt time.Time, duration time.Duration) (SaveResult, error)
+	Counts(ctx context.Context, uniqueID string) (total, unread int64, err error)
 }
 
 type subscriptionService interface {
-	Notify(userDID string, payload NotificationPayload)
+	Notify(userDID string, payload NotificationPayload) bool
+}
+
+type eventLog interface {
+	Append(ctx context.Context, userDID string, payload NotificationPayload) (string, error)
+}
+
+type offlineQueue interface {
+	Push(ctx context.Context, userDID string, payload NotificationPayload) error
 }
 
 // Notification is a service to notification push notification
 type Notification struct {
-	notification        *PushClient
-	cryptoService       cryptoService
-	cachingService      cachingService
-	hostURL             string
-	expirationDuration  time.Duration
-	subscriptionService subscriptionService
-	supportedWebAgents  []string
+	notification          *PushClient
+	cryptoService         cryptoService
+	cachingService        cachingService
+	hostURL               string
+	expirationDuration    time.Duration
+	minExpirationDuration time.Duration
+	maxExpirationDuration time.Duration
+	subscriptionService   subscriptionService
+	eventLog              eventLog
+	offlineQueue          offlineQueue
+	supportedWebAgents    []string
+}
+
+// NotificationOption configures Notification optional parameters.
+type NotificationOption func(*Notification)
+
+// WithExpirationBounds limits lifetime of notifications requested by senders.
+// Zero value disables the bound.
+func WithExpirationBounds(minDuration, maxDuration time.Duration) NotificationOption {
+	return func(n *Notification) {
+		n.minExpirationDuration = minDuration
+		n.maxExpirationDuration = maxDuration
+	}
+}
+
+// WithEventLog logs notifications sent to subscriptions, so clients can get
+// the notifications they missed while reconnecting.
+func WithEventLog(l eventLog) NotificationOption {
+	return func(n *Notification) {
+		n.eventLog = l
+	}
+}
+
+// WithOfflineQueue queues notifications of web agents without open subscriptions,
+// so they are delivered on the next subscription. Notifications are dropped by default.
+func WithOfflineQueue(q offlineQueue) NotificationOption {
+	return func(n *Notification) {
+		n.offlineQueue = q
+	}
 }
 
 // NewNotificationService new instance of notification service
@@ -116,8 +191,9 @@ func NewNotificationService(
 	expirationDuration time.Duration,
 	sub subscriptionService,
 	supportedWebAgents []string,
+	opts ...NotificationOption,
 ) *Notification {
-	return &Notification{
+	ns := &Notification{
 		notification:        n,
 		cryptoService:       c,
 		cachingService:      cs,
@@ -126,14 +202,23 @@ func NewNotificationService(
 		subscriptionService: sub,
 		supportedWebAgents:  supportedWebAgents,
 	}
+	for _, opt := range opts {
+		if opt != nil {
+			opt(ns)
+		}
+	}
+	return ns
 }
 
-// SendNotification sends notification to matrix gateway
-func (ns *Notification) SendNotification(ctx context.Context, msg *PushNotification) []NotificationResult {
+// SendNotification sends notification to matrix gateway.
+// Returns processing result for every device and IDs of stored notifications.
+func (ns *Notification) SendNotification(ctx context.Context, msg *PushNotification) (
+	results []NotificationResult, notificationIDs []string) {
 
 	msgProcessingResult := make([]NotificationResult, 0)
 
 	decryptedMap := make(map[string]EncryptedDeviceMetadata)
+	owners := make(map[string]string)
 
 	devices := make([]Device, 0)
 
@@ -150,15 +235,16 @@ func (ns *Notification) SendNotification(ctx context.Context, msg *PushNotificat
 		}
 		// if device info is valid let's save it's encrypted and decrypted forms
 		decryptedMap[device.Pushkey] = encDeviceInfo
+		owners[device.Pushkey] = device.UniqueID
 		devices = append(devices, device)
 	}
 
 	// if there are no valid decrypted device tokens we must return the result immediately
 	if len(devices) == 0 {
-		return msgProcessingResult
+		return msgProcessingResult, nil
 	}
 
-	rejectedTokens, err := ns.notify(ctx, msg, devices)
+	notificationIDs, rejectedTokens, overQuotaTokens, queuedTokens, err := ns.notify(ctx, msg, devices)
 	if err != nil {
 		// return failed for all devices
 		for _, device := range devices {
@@ -168,7 +254,12 @@ func (ns *Notification) SendNotification(ctx context.Context, msg *PushNotificat
 				Reason: err.Error(),
 			})
 		}
-		return msgProcessingResult
+		return msgProcessingResult, nil
+	}
+
+	savedIDs := make(map[string]string, len(notificationIDs))
+	for _, id := range notificationIDs {
+		savedIDs[ownerOf(id)] = id
 	}
 
 	// response contains decrypted rejected push tokens. We must return encrypted tokens instead,
@@ -176,22 +267,42 @@ func (ns *Notification) SendNotification(ctx context.Context, msg *PushNotificat
 
 	for token, enc := range decryptedMap {
 
+		if contains(overQuotaTokens, token) {
+			msgProcessingResult = append(msgProcessingResult, NotificationResult{
+				Device: enc,
+				Status: NotificationStatusFailed,
+				Reason: NotificationReasonQuotaExceeded,
+			})
+			continue
+		}
+		notificationID := savedIDs[owners[token]]
+		if contains(queuedTokens, token) {
+			msgProcessingResult = append(msgProcessingResult, NotificationResult{
+				Device:         enc,
+				Status:         NotificationStatusQueued,
+				Reason:         NotificationReasonQueued,
+				NotificationID: notificationID,
+			})
+			continue
+		}
 		isRejected := contains(rejectedTokens, token)
 		if isRejected {
 			msgProcessingResult = append(msgProcessingResult, NotificationResult{
-				Device: enc,
-				Status: NotificationStatusRejected,
-				Reason: "Push message could have been rejected by an unstream gateway because they have expired or have never been valid",
+				Device:         enc,
+				Status:         NotificationStatusRejected,
+				Reason:         "Push message could have been rejected by an unstream gateway because they have expired or have never been valid",
+				NotificationID: notificationID,
 			})
 			continue
 		}
 		msgProcessingResult = append(msgProcessingResult, NotificationResult{
-			Device: enc,
-			Status: NotificationStatusSuccess,
+			Device:         enc,
+			Status:         NotificationStatusSuccess,
+			NotificationID: notificationID,
 		})
 	}
 
-	return msgProcessingResult
+	return msgProcessingResult, notificationIDs
 }
 
 func (ns *Notification) decryptDeviceInfo(enc EncryptedDeviceMetadata) (Device, error) {
@@ -215,7 +326,12 @@ func (ns *Notification) decryptDeviceInfo(enc EncryptedDeviceMetadata) (Device,
 	return device, nil
 
 }
-func (ns *Notification) notify(ctx context.Context, push *PushNotification, devices []Device) ([]string, error) {
+
+// notify stores notification for every uniqueID of devices and sends pushes.
+// Returns tokens of devices rejected by gateway, of devices whose inbox quota is exceeded
+// and of web agents whose notification is queued.
+func (ns *Notification) notify(ctx context.Context, push *PushNotification, devices []Device) (
+	ids, rejects, overQuota, queued []string, err error) {
 
 	id := uuid.NewString()
 	idToDevices := make(map[string][]Device)
@@ -224,47 +340,106 @@ func (ns *Notification) notify(ctx context.Context, push *PushNotification, devi
 		idToDevices[key] = append(idToDevices[key], d)
 	}
 
+	ttl := ns.ttl(push)
+	metadata := NewMetadata(ttl)
 	bytesToSave, err := json.Marshal(NotificationContent{
-		Metadata: NewMetadata(),
+		Metadata: metadata,
 		Body:     push.Message,
 	})
 	if err != nil {
-		return nil, errors.New("failed to prepare notification")
+		return nil, nil, nil, nil, errors.New("failed to prepare notification")
 	}
 
-	rejects := []string{}
+	attrs := messageAttributes(push.Message)
+	ids = make([]string, 0, len(idToDevices))
+	rejects = []string{}
 	for saveID, devices := range idToDevices {
 		// save a message to a caching service
-		err = ns.cachingService.Set(ctx, saveID,
-			bytesToSave, ns.expirationDuration)
+		// all devices of the group share the same uniqueID
+		uniqueID := devices[0].UniqueID
+		saved, err := ns.cachingService.SaveNotification(ctx, uniqueID, saveID,
+			bytesToSave, metadata.CreatedAt, ttl)
+		if errors.Is(err, ErrQuotaExceeded) {
+			for _, d := range devices {
+				overQuota = append(overQuota, d.Pushkey)
+			}
+			continue
+		}
 		if err != nil {
 			log.Error(err)
-			return nil, errors.New("failed to save device notification")
+			return nil, nil, nil, nil, errors.New("failed to save device notification")
+		}
+		if len(saved.Evicted) > 0 {
+			publishEvent(ctx, ns.subscriptionService, ns.eventLog, uniqueID,
+				NewDeletedEvent(saved.Evicted, DeleteReasonEvicted))
+		}
+		if len(saved.Expired) > 0 {
+			publishEvent(ctx, ns.subscriptionService, ns.eventLog, uniqueID,
+				NewDeletedEvent(saved.Expired, DeleteReasonExpired))
 		}
 
 		u, err := buildResourceURL(ns.hostURL, saveID)
 		if err != nil {
 			log.Error(err)
-			return nil, errors.New("failed to build notification URL")
+			return nil, nil, nil, nil, errors.New("failed to build notification URL")
 		}
 
 		contentBody := NotificationPayload{
-			ID:  saveID,
-			URL: u,
+			ID:         saveID,
+			URL:        u,
+			Attributes: attrs,
 		}
 
 		webBrowserDevices, otherDevices := ns.classifyDevices(devices)
 
-		ns.notifySubscribers(webBrowserDevices, contentBody)
-		rejectedTokens, err := ns.notification.SendPush(ctx, otherDevices, contentBody)
+		queued = append(queued, ns.notifySubscribers(ctx, webBrowserDevices, contentBody)...)
+		rejectedTokens, err := ns.notification.SendPush(ctx, otherDevices, contentBody, PushOptions{
+			Counts: ns.unreadCounts(ctx, uniqueID),
+			TTL:    ttl,
+		})
 		if err != nil {
 			log.Error(err)
-			return nil, errors.New("failed to notify devices")
+			return nil, nil, nil, nil, errors.New("failed to notify devices")
 
 		}
 		rejects = append(rejects, rejectedTokens...)
+		ids = append(ids, saveID)
+	}
+	return ids, rejects, overQuota, queued, nil
+}
+
+// ttl returns lifetime of the notification requested by sender
+// clamped to the configured bounds. Default lifetime is used if sender didn't request it.
+func (ns *Notification) ttl(push *PushNotification) time.Duration {
+	ttl := ns.expirationDuration
+	switch {
+	case push.ExpiresAt != nil:
+		ttl = time.Until(*push.ExpiresAt)
+	case push.TTL > 0:
+		ttl = time.Duration(push.TTL) * time.Second
+	}
+
+	if ns.minExpirationDuration > 0 && ttl < ns.minExpirationDuration {
+		ttl = ns.minExpirationDuration
+	}
+	if ns.maxExpirationDuration > 0 && ttl > ns.maxExpirationDuration {
+		ttl = ns.maxExpirationDuration
 	}
-	return rejects, nil
+	return ttl
+}
+
+// unreadCounts returns unread counter of uniqueID to be shown as a badge.
+// Push is sent without badge if the counter is not available.
+func (ns *Notification) unreadCounts(ctx context.Context, uniqueID string) *Counts {
+	if uniqueID == "" {
+		return nil
+	}
+	_, unread, err := ns.cachingService.Counts(ctx, uniqueID)
+	if err != nil {
+		log.WithContext(ctx).Warnf("failed to get unread counter: %v", err)
+		return nil
+	}
+	return &Counts{Unread: unread}
 }
 
 func (ns *Notification) classifyDevices(devices []Device) (webBrowserDevices, otherDevices []Device) {
@@ -287,11 +462,36 @@ func (ns *Notification) isWebAgent(appID string) bool {
 	return false
 }
 
-func (ns *Notification) notifySubscribers(devices []Device, payload NotificationPayload) {
+// notifySubscribers sends notification to subscriptions of web agents.
+// Returns tokens of devices whose owner had no subscriptions matching the notification and it was queued.
+func (ns *Notification) notifySubscribers(ctx context.Context, devices []Device, payload NotificationPayload) []string {
+	notified := make(map[string]bool, len(devices))
+	queuedIDs := make(map[string]bool)
+	var queued []string
 	for _, device := range devices {
 		// in case of the web browser pushtoken is uniqueID
-		ns.subscriptionService.Notify(device.UniqueID, payload)
+		if !notified[device.UniqueID] {
+			notified[device.UniqueID] = true
+			event, subscribed := publishEvent(ctx, ns.subscriptionService, ns.eventLog, device.UniqueID, payload)
+			queuedIDs[device.UniqueID] = !subscribed && ns.enqueue(ctx, device.UniqueID, event)
+		}
+		if queuedIDs[device.UniqueID] {
+			queued = append(queued, device.Pushkey)
+		}
+	}
+	return queued
+}
+
+// enqueue adds notification to the offline queue of uniqueID. Returns false if it wasn't queued.
+func (ns *Notification) enqueue(ctx context.Context, uniqueID string, payload NotificationPayload) bool {
+	if ns.offlineQueue == nil || uniqueID == "" {
+		return false
+	}
+	if err := ns.offlineQueue.Push(ctx, uniqueID, payload); err != nil {
+		log.WithContext(ctx).Errorf("failed to queue notification for user %s: %v", uniqueID, err)
+		return false
 	}
+	return true
 }
 
 func buildResourceURL(host, id string) (string, error) {
@@ -310,6 +510,28 @@ func buildMessageKey(uniqueID, id string) string {
 	return fmt.Sprintf("%s+%s", uniqueID, id)
 }
 
+// isNotificationID checks that id was built by buildMessageKey
+func isNotificationID(id string) bool {
+	if owner, rest, ok := strings.Cut(id, "+"); ok {
+		if !strings.HasPrefix(owner, "did:") {
+			return false
+		}
+		id = rest
+	}
+	_, err := uuid.Parse(id)
+	return err == nil
+}
+
+// ownerOf returns uniqueID the message key was built for.
+// Returns empty string for messages without uniqueID.
+func ownerOf(key string) string {
+	uniqueID, _, found := strings.Cut(key, "+")
+	if !found {
+		return ""
+	}
+	return uniqueID
+}
+
 func contains(a []string, x string) bool {
 	for _, n := range a {
 		if x == n {
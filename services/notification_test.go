@@ -41,10 +41,16 @@ func signalSuccessMock(t *testing.T) *httptest.Server {
 }
 
 type RedisMock struct {
+	saved   SaveResult
+	saveErr error
 }
 
-func (r RedisMock) Set(_ context.Context, _ string, _ interface{}, _ time.Duration) error {
-	return nil
+func (r RedisMock) SaveNotification(_ context.Context, _, _ string, _ interface{}, _ time.Time, _ time.Duration) (SaveResult, error) {
+	return r.saved, r.saveErr
+}
+
+func (r RedisMock) Counts(_ context.Context, _ string) (total, unread int64, err error) {
+	return 0, 0, nil
 }
 
 func (r RedisMock) Get(_ context.Context, _ string) (interface{}, error) {
@@ -54,8 +60,9 @@ func (r RedisMock) Get(_ context.Context, _ string) (interface{}, error) {
 type SubscriptionMock struct {
 }
 
-func (s SubscriptionMock) Notify(_ string, _ NotificationPayload) {
+func (s SubscriptionMock) Notify(_ string, _ NotificationPayload) bool {
 	// Mock implementation - do nothing
+	return false
 }
 
 func TestNotificationService_SendNotification(t *testing.T) {
@@ -105,9 +112,11 @@ func TestNotificationService_SendNotification(t *testing.T) {
 		},
 	}
 
-	res := notificationService.SendNotification(context.Background(), msg)
+	res, ids := notificationService.SendNotification(context.Background(), msg)
 	require.Len(t, res, 1)
 	require.Equal(t, NotificationStatusSuccess, res[0].Status)
+	require.Len(t, ids, 1)
+	require.Equal(t, ids[0], res[0].NotificationID)
 
 }
 func TestNotificationService_SendNotificationRejected(t *testing.T) {
@@ -157,7 +166,7 @@ func TestNotificationService_SendNotificationRejected(t *testing.T) {
 		},
 	}
 
-	res := proxy.SendNotification(context.Background(), msg)
+	res, _ := proxy.SendNotification(context.Background(), msg)
 	require.Len(t, res, 1)
 	require.Equal(t, NotificationStatusRejected, res[0].Status)
 
@@ -199,9 +208,77 @@ func TestNotificationService_SendNotificationFailed(t *testing.T) {
 		},
 	}
 
-	res := proxy.SendNotification(context.Background(), msg)
+	res, _ := proxy.SendNotification(context.Background(), msg)
 	require.Len(t, res, 1)
 	require.Equal(t, NotificationStatusFailed, res[0].Status)
 	require.Equal(t, "service couldn't decrypt the device token", res[0].Reason)
 
 }
+
+func TestNotificationService_SendNotificationQuotaExceeded(t *testing.T) {
+
+	privateKey, err := rsa.GenerateKey(rand.Reader, 4096)
+	require.NoError(t, err)
+	cs, err := NewCryptoService(privateKey)
+	require.NoError(t, err)
+
+	notificationService := NewNotificationService(
+		NewPushClient(http.DefaultClient, "http://localhost"),
+		cs,
+		RedisMock{saveErr: ErrQuotaExceeded},
+		"host",
+		time.Hour*24,
+		SubscriptionMock{},
+		[]string{"iden3.web.browser"},
+	)
+
+	encodedDevice, err := json.Marshal(Device{
+		AppID:    "local.id",
+		Pushkey:  mockPushKey,
+		UniqueID: "did:example:1",
+	})
+	require.NoError(t, err)
+	ciphertext, err := notificationService.cryptoService.Encrypt(encodedDevice)
+	require.NoError(t, err)
+
+	msg := &PushNotification{
+		Message: []byte(`{"my_cat": "123321"}`),
+		PushMetadata: PushMetadata{
+			Devices: []EncryptedDeviceMetadata{
+				{
+					Ciphertext: base64.StdEncoding.EncodeToString(ciphertext),
+					Alg:        rsaAlg,
+				},
+			},
+		},
+	}
+
+	res, ids := notificationService.SendNotification(context.Background(), msg)
+	require.Len(t, res, 1)
+	require.Equal(t, NotificationStatusFailed, res[0].Status)
+	require.Equal(t, NotificationReasonQuotaExceeded, res[0].Reason)
+	require.Empty(t, ids)
+}
+
+func TestNotificationService_TTL(t *testing.T) {
+	ns := NewNotificationService(nil, nil, RedisMock{}, "host", time.Hour*24,
+		SubscriptionMock{}, nil, WithExpirationBounds(time.Minute, time.Hour*24*7))
+
+	expiresAt := time.Now().Add(time.Hour)
+	tests := []struct {
+		name     string
+		push     PushNotification
+		expected time.Duration
+	}{
+		{name: "default", push: PushNotification{}, expected: time.Hour * 24},
+		{name: "ttl", push: PushNotification{TTL: 300}, expected: 5 * time.Minute},
+		{name: "ttl below min", push: PushNotification{TTL: 1}, expected: time.Minute},
+		{name: "ttl above max", push: PushNotification{TTL: 3600 * 24 * 30}, expected: time.Hour * 24 * 7},
+		{name: "expires_at", push: PushNotification{ExpiresAt: &expiresAt}, expected: time.Hour},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			require.InDelta(t, tt.expected, ns.ttl(&tt.push), float64(time.Second))
+		})
+	}
+}
@@ -0,0 +1,89 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/iden3/notification-service/log"
+	"github.com/redis/go-redis/v9"
+)
+
+// NotificationReasonQueued is a NotificationResult reason for notifications of web agents
+// queued because the owner had no open subscriptions
+const NotificationReasonQueued = "no open subscriptions, notification is queued for the next subscription"
+
+// queuedNotification is a notification kept in the offline queue with its event ID
+type queuedNotification struct {
+	Payload NotificationPayload `json:"payload"`
+	EventID string              `json:"event_id,omitempty"`
+}
+
+// OfflineQueue keeps notifications of web agents sent while the user had no open subscriptions.
+// The queue is drained by the next subscription of the user, so the notifications aren't
+// lost when the browser is closed.
+type OfflineQueue struct {
+	client redis.UniversalClient
+	keys   keySchema
+	size   int64
+	ttl    time.Duration
+}
+
+// NewOfflineQueue creates queue keeping up to size latest notifications of a user.
+// The queue of a user expires in ttl after the last notification.
+func NewOfflineQueue(client redis.UniversalClient, keyPrefix string, size int64, ttl time.Duration) *OfflineQueue {
+	return &OfflineQueue{
+		client: client,
+		keys:   newKeySchema(keyPrefix),
+		size:   size,
+		ttl:    ttl,
+	}
+}
+
+// Push adds notification to the queue of userDID, the oldest notifications
+// are dropped when the queue is full.
+func (q *OfflineQueue) Push(ctx context.Context, userDID string, payload NotificationPayload) error {
+	b, err := json.Marshal(queuedNotification{Payload: payload, EventID: payload.EventID})
+	if err != nil {
+		return err
+	}
+	key := q.keys.offlineQueue(userDID)
+	_, err = q.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.RPush(ctx, key, b)
+		pipe.LTrim(ctx, key, -q.size, -1)
+		pipe.Expire(ctx, key, q.ttl)
+		return nil
+	})
+	return err
+}
+
+// Drain removes and returns queued notifications of userDID in the order they were sent
+func (q *OfflineQueue) Drain(ctx context.Context, userDID string) ([]NotificationPayload, error) {
+	key := q.keys.offlineQueue(userDID)
+	var rangeCmd *redis.StringSliceCmd
+	_, err := q.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		rangeCmd = pipe.LRange(ctx, key, 0, -1)
+		pipe.Del(ctx, key)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	payloads := make([]NotificationPayload, 0, len(rangeCmd.Val()))
+	for _, v := range rangeCmd.Val() {
+		var n queuedNotification
+		if err := json.Unmarshal([]byte(v), &n); err != nil {
+			log.WithContext(ctx).Warnf("invalid notification in offline queue of user %s: %v", userDID, err)
+			continue
+		}
+		n.Payload.EventID = n.EventID
+		payloads = append(payloads, n.Payload)
+	}
+	return payloads, nil
+}
+
+// Erase removes queued notifications of userDID
+func (q *OfflineQueue) Erase(ctx context.Context, userDID string) error {
+	return q.client.Del(ctx, q.keys.offlineQueue(userDID)).Err()
+}
@@ -0,0 +1,172 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestOfflineQueue(t *testing.T, size int64) (*OfflineQueue, *miniredis.Miniredis) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { _ = client.Close() })
+	return NewOfflineQueue(client, "test", size, time.Hour), mr
+}
+
+func TestOfflineQueue(t *testing.T) {
+	q, mr := newTestOfflineQueue(t, 2)
+	ctx := context.Background()
+	userDID := "did:example:123"
+
+	for i := 0; i < 3; i++ {
+		require.NoError(t, q.Push(ctx, userDID, NotificationPayload{ID: fmt.Sprint(i), EventID: fmt.Sprintf("%d-0", i)}))
+	}
+	require.Greater(t, mr.TTL(q.keys.offlineQueue(userDID)), time.Duration(0))
+
+	// the oldest notification is dropped from the full queue
+	queued, err := q.Drain(ctx, userDID)
+	require.NoError(t, err)
+	require.Equal(t, []NotificationPayload{
+		{ID: "1", EventID: "1-0"},
+		{ID: "2", EventID: "2-0"},
+	}, queued)
+
+	queued, err = q.Drain(ctx, userDID)
+	require.NoError(t, err)
+	require.Empty(t, queued)
+}
+
+func TestOfflineQueue_Erase(t *testing.T) {
+	q, _ := newTestOfflineQueue(t, 2)
+	ctx := context.Background()
+
+	require.NoError(t, q.Push(ctx, "did:example:123", NotificationPayload{ID: "1", EventID: "1-0"}))
+	require.NoError(t, q.Push(ctx, "did:example:456", NotificationPayload{ID: "2", EventID: "2-0"}))
+	require.NoError(t, q.Erase(ctx, "did:example:123"))
+
+	queued, err := q.Drain(ctx, "did:example:123")
+	require.NoError(t, err)
+	require.Empty(t, queued)
+	// queues of other users are kept
+	queued, err = q.Drain(ctx, "did:example:456")
+	require.NoError(t, err)
+	require.Equal(t, []NotificationPayload{{ID: "2", EventID: "2-0"}}, queued)
+}
+
+func TestNotificationService_OfflineQueue(t *testing.T) {
+	q, _ := newTestOfflineQueue(t, 100)
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	cs, err := NewCryptoService(privateKey)
+	require.NoError(t, err)
+	sub := &subscriptionRecorder{offline: map[string]bool{"did:example:offline": true}}
+
+	notificationService := NewNotificationService(
+		NewPushClient(http.DefaultClient, "http://localhost"),
+		cs,
+		RedisMock{},
+		"http://host",
+		time.Hour*24,
+		sub,
+		[]string{"iden3.web.browser"},
+		WithOfflineQueue(q),
+	)
+
+	var devices []EncryptedDeviceMetadata
+	for _, uniqueID := range []string{"did:example:online", "did:example:offline"} {
+		encodedDevice, err := json.Marshal(Device{
+			AppID:    "iden3.web.browser",
+			Pushkey:  uniqueID,
+			UniqueID: uniqueID,
+		})
+		require.NoError(t, err)
+		ciphertext, err := cs.Encrypt(encodedDevice)
+		require.NoError(t, err)
+		devices = append(devices, EncryptedDeviceMetadata{
+			Ciphertext: base64.StdEncoding.EncodeToString(ciphertext),
+			Alg:        rsaAlg,
+		})
+	}
+
+	res, ids := notificationService.SendNotification(context.Background(), &PushNotification{
+		Message:      []byte(`{}`),
+		PushMetadata: PushMetadata{Devices: devices},
+	})
+	require.Len(t, ids, 2)
+	statuses := make(map[string]NotificationResult, len(res))
+	for _, r := range res {
+		statuses[r.Device.Ciphertext] = r
+	}
+	require.Equal(t, NotificationStatusSuccess, statuses[devices[0].Ciphertext].Status)
+	require.Equal(t, NotificationStatusQueued, statuses[devices[1].Ciphertext].Status)
+	require.Equal(t, NotificationReasonQueued, statuses[devices[1].Ciphertext].Reason)
+
+	// only notification of the user without subscriptions is queued
+	queued, err := q.Drain(context.Background(), "did:example:online")
+	require.NoError(t, err)
+	require.Empty(t, queued)
+	queued, err = q.Drain(context.Background(), "did:example:offline")
+	require.NoError(t, err)
+	require.Len(t, queued, 1)
+	require.Equal(t, "did:example:offline", ownerOf(queued[0].ID))
+}
+
+func TestNotificationService_OfflineQueue_OtherNode(t *testing.T) {
+	q, mr := newTestOfflineQueue(t, 100)
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	cs, err := NewCryptoService(privateKey)
+	require.NoError(t, err)
+	sub := newTestRedisSubscriptionService(t, mr, 10)
+	uniqueID := "did:example:remote"
+
+	// subscriber connected to another cluster node holds a lease,
+	// but PUBLISH on this node doesn't count it
+	_, err = mr.ZAdd(sub.keys.subscriptionLeases(uniqueID),
+		float64(time.Now().Add(time.Minute).UnixMilli()), "other-node")
+	require.NoError(t, err)
+
+	notificationService := NewNotificationService(
+		NewPushClient(http.DefaultClient, "http://localhost"),
+		cs,
+		RedisMock{},
+		"http://host",
+		time.Hour*24,
+		sub,
+		[]string{"iden3.web.browser"},
+		WithOfflineQueue(q),
+	)
+	encodedDevice, err := json.Marshal(Device{
+		AppID:    "iden3.web.browser",
+		Pushkey:  uniqueID,
+		UniqueID: uniqueID,
+	})
+	require.NoError(t, err)
+	ciphertext, err := cs.Encrypt(encodedDevice)
+	require.NoError(t, err)
+
+	res, _ := notificationService.SendNotification(context.Background(), &PushNotification{
+		Message: []byte(`{}`),
+		PushMetadata: PushMetadata{Devices: []EncryptedDeviceMetadata{{
+			Ciphertext: base64.StdEncoding.EncodeToString(ciphertext),
+			Alg:        rsaAlg,
+		}}},
+	})
+	require.Len(t, res, 1)
+	require.Equal(t, NotificationStatusSuccess, res[0].Status)
+
+	// delivered notification isn't replayed on the next subscribe
+	queued, err := q.Drain(context.Background(), uniqueID)
+	require.NoError(t, err)
+	require.Empty(t, queued)
+}
@@ -7,7 +7,9 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/iden3/notification-service/log"
 	"github.com/pkg/errors"
@@ -16,8 +18,21 @@ import (
 const path = "/_matrix/push/v1/notify"
 
 type notification struct {
-	Devices []Device `json:"devices"`
-	Content Content  `json:"content"`
+	Devices []notificationDevice `json:"devices"`
+	Content Content              `json:"content"`
+	Counts  *Counts              `json:"counts,omitempty"`
+}
+
+// notificationDevice is a device of matrix message with pusher data
+type notificationDevice struct {
+	Device
+	Data *deviceData `json:"data,omitempty"`
+}
+
+// deviceData is pusher data of the device. Sygnal uses default payload
+// as the base of the message sent to push provider.
+type deviceData struct {
+	DefaultPayload map[string]interface{} `json:"default_payload,omitempty"`
 }
 
 // NotificationStatus is a notification status
@@ -30,6 +45,9 @@ const (
 	NotificationStatusRejected NotificationStatus = "rejected"
 	// NotificationStatusFailed is for pushes that were not sent
 	NotificationStatusFailed NotificationStatus = "failed"
+	// NotificationStatusQueued is for web agents without open subscriptions,
+	// notification is delivered on the next subscription
+	NotificationStatusQueued NotificationStatus = "queued"
 )
 
 // Device info
@@ -44,6 +62,11 @@ type Content struct {
 	Body []byte `json:"body"`
 }
 
+// Counts for matrix message. Unread count is used by push providers as app badge
+type Counts struct {
+	Unread int64 `json:"unread"`
+}
+
 // PushClient to send push to matrix
 type PushClient struct {
 	conn *http.Client
@@ -63,8 +86,18 @@ func NewPushClient(conn *http.Client, url string) *PushClient {
 	}
 }
 
+// PushOptions are optional parameters of push message
+type PushOptions struct {
+	// Counts is omitted from the message when nil
+	Counts *Counts
+	// TTL is passed to push providers in default payload of devices, so outdated pushes
+	// are not delivered. Zero value means that provider default is used.
+	TTL time.Duration
+}
+
 // SendPush send push notification in json format to devices.
-func (c *PushClient) SendPush(ctx context.Context, listDevices []Device, payload NotificationPayload) ([]string, error) {
+func (c *PushClient) SendPush(ctx context.Context, listDevices []Device,
+	payload NotificationPayload, opts PushOptions) ([]string, error) {
 	if len(listDevices) == 0 {
 		return nil, nil
 	}
@@ -74,12 +107,21 @@ func (c *PushClient) SendPush(ctx context.Context, listDevices []Device, payload
 		return nil, err
 	}
 
+	devices := make([]notificationDevice, len(listDevices))
+	for i, d := range listDevices {
+		devices[i] = notificationDevice{Device: d}
+		if opts.TTL > 0 {
+			devices[i].Data = &deviceData{DefaultPayload: expirationPayload(opts.TTL)}
+		}
+	}
+
 	reqData := struct {
 		Notification notification `json:"notification"`
 	}{
 		Notification: notification{
-			Devices: listDevices,
+			Devices: devices,
 			Content: Content{Body: payloadBytes},
+			Counts:  opts.Counts,
 		},
 	}
 
@@ -121,3 +163,24 @@ func (c *PushClient) SendPush(ctx context.Context, listDevices []Device, payload
 
 	return pushResult.Rejected, nil
 }
+
+// expirationPayload returns FCM message options which make providers drop the push
+// after ttl: Android TTL, APNs expiration time for iOS and Web Push TTL.
+func expirationPayload(ttl time.Duration) map[string]interface{} {
+	seconds := int64(ttl.Seconds())
+	return map[string]interface{}{
+		"android": map[string]interface{}{
+			"ttl": fmt.Sprintf("%ds", seconds),
+		},
+		"apns": map[string]interface{}{
+			"headers": map[string]string{
+				"apns-expiration": strconv.FormatInt(time.Now().Add(ttl).Unix(), 10),
+			},
+		},
+		"webpush": map[string]interface{}{
+			"headers": map[string]string{
+				"TTL": strconv.FormatInt(seconds, 10),
+			},
+		},
+	}
+}
@@ -0,0 +1,71 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPushClient_SendPush_TTL(t *testing.T) {
+	requests := make(chan []byte, 2)
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		requests <- b
+		_, _ = w.Write([]byte(`{"rejected":[]}`))
+	}))
+	t.Cleanup(gateway.Close)
+	client := NewPushClient(gateway.Client(), gateway.URL)
+	devices := []Device{{AppID: "app", Pushkey: "key", UniqueID: "did:example:1"}}
+
+	type request struct {
+		Notification struct {
+			Devices []struct {
+				AppID   string `json:"app_id"`
+				Pushkey string `json:"pushkey"`
+				Data    *struct {
+					DefaultPayload struct {
+						Android struct {
+							TTL string `json:"ttl"`
+						} `json:"android"`
+						APNS struct {
+							Headers map[string]string `json:"headers"`
+						} `json:"apns"`
+						Webpush struct {
+							Headers map[string]string `json:"headers"`
+						} `json:"webpush"`
+					} `json:"default_payload"`
+				} `json:"data"`
+			} `json:"devices"`
+		} `json:"notification"`
+	}
+
+	_, err := client.SendPush(context.Background(), devices, NotificationPayload{ID: "1"},
+		PushOptions{TTL: 5 * time.Minute})
+	require.NoError(t, err)
+	var req request
+	require.NoError(t, json.Unmarshal(<-requests, &req))
+	require.Len(t, req.Notification.Devices, 1)
+	device := req.Notification.Devices[0]
+	require.Equal(t, "app", device.AppID)
+	require.Equal(t, "key", device.Pushkey)
+	require.NotNil(t, device.Data)
+	require.Equal(t, "300s", device.Data.DefaultPayload.Android.TTL)
+	require.Equal(t, "300", device.Data.DefaultPayload.Webpush.Headers["TTL"])
+	expiration, err := strconv.ParseInt(device.Data.DefaultPayload.APNS.Headers["apns-expiration"], 10, 64)
+	require.NoError(t, err)
+	require.InDelta(t, time.Now().Add(5*time.Minute).Unix(), expiration, 5)
+
+	// provider defaults are used without TTL
+	_, err = client.SendPush(context.Background(), devices, NotificationPayload{ID: "2"}, PushOptions{})
+	require.NoError(t, err)
+	req = request{}
+	require.NoError(t, json.Unmarshal(<-requests, &req))
+	require.Nil(t, req.Notification.Devices[0].Data)
+}
@@ -0,0 +1,43 @@
+package services
+
+import (
+	"errors"
+)
+
+// QuotaPolicy defines what happens to a new notification when inbox quota is exceeded
+type QuotaPolicy string
+
+const (
+	// QuotaPolicyEvict removes the oldest notifications to fit the new one
+	QuotaPolicyEvict QuotaPolicy = "evict"
+	// QuotaPolicyReject rejects the new notification
+	QuotaPolicyReject QuotaPolicy = "reject"
+
+	// NotificationReasonQuotaExceeded is a NotificationResult reason for notifications
+	// rejected because inbox of the device owner is full
+	NotificationReasonQuotaExceeded = "inbox quota exceeded"
+)
+
+// ErrQuotaExceeded is returned when notification doesn't fit inbox quota
+var ErrQuotaExceeded = errors.New("inbox quota exceeded")
+
+// Quota limits number and total size of stored notifications per uniqueID.
+// Zero value of a limit disables it.
+type Quota struct {
+	MaxCount int64
+	MaxBytes int64
+	Policy   QuotaPolicy
+}
+
+// Validate checks the quota policy
+func (q Quota) Validate() error {
+	if q.MaxCount < 0 || q.MaxBytes < 0 {
+		return errors.New("quota limits must be positive")
+	}
+	switch q.Policy {
+	case QuotaPolicyEvict, QuotaPolicyReject:
+		return nil
+	default:
+		return errors.New("quota policy must be 'evict' or 'reject'")
+	}
+}
@@ -0,0 +1,518 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/iden3/notification-service/log"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	subscriptionEventNotification = "notification"
+	subscriptionEventClose        = "close"
+
+	// redisOperationTimeout limits redis calls of methods without context
+	redisOperationTimeout = 5 * time.Second
+)
+
+// subscriptionEvent is a message published to the subscription channel of uniqueID
+type subscriptionEvent struct {
+	Type    string `json:"type"`
+	EventID string `json:"event_id,omitempty"`
+	// Attributes are used by replicas to filter subscriptions, they are
+	// sent as EncryptedAttributes if encryption is enabled
+	Attributes          *NotificationAttributes `json:"attributes,omitempty"`
+	EncryptedAttributes string                  `json:"encrypted_attributes,omitempty"`
+	Payload             *NotificationPayload    `json:"payload,omitempty"`
+}
+
+type subscriptionLease struct {
+	userDID string
+	id      string
+}
+
+// userChannel tracks the replica subscription to the channel of a user
+type userChannel struct {
+	// subscriptions is a number of local subscriptions of the user
+	subscriptions int
+	// ready is closed when redis confirmed the subscription or it failed with err
+	ready chan struct{}
+	err   error
+	// closing is closed when the channel is unsubscribed in redis
+	closing chan struct{}
+}
+
+// RedisSubscriptionService delivers notifications to subscriptions open on any replica.
+// Notifications are published to the per-uniqueID Redis channel, every replica relays them
+// to its local subscriptions. Every open subscription holds a lease in Redis, so the limit
+// of subscriptions per user is shared by all replicas. Leases of crashed replicas expire.
+// Leases carry filters of subscriptions, so the publishing replica knows whether any
+// subscription matches the notification.
+type RedisSubscriptionService struct {
+	local  *SubscriptionService
+	client redis.UniversalClient
+	pubsub *redis.PubSub
+	keys   keySchema
+	cipher *StorageCipher
+
+	maxSubscriptionsPerUser int
+	leaseTTL                time.Duration
+
+	lock     sync.Mutex
+	leases   map[<-chan NotificationPayload]subscriptionLease
+	channels map[string]*userChannel
+	// confirmations are waiting for redis to confirm subscription to the channel
+	confirmations map[string][]chan struct{}
+}
+
+// NewRedisSubscriptionService creates subscription service shared by replicas.
+// Run must be called to relay published notifications.
+func NewRedisSubscriptionService(
+	client redis.UniversalClient,
+	keyPrefix string,
+	maxSubscriptionsPerUser int,
+	channelBufferSize int,
+	leaseTTL time.Duration,
+	opts ...SubscriptionOption,
+) *RedisSubscriptionService {
+	// the limit is checked by leases
+	local := NewSubscriptionService(0, channelBufferSize, opts...)
+	return &RedisSubscriptionService{
+		local:  local,
+		client: client,
+		pubsub: client.Subscribe(context.Background()),
+		keys:   newKeySchema(keyPrefix),
+		cipher: local.cipher,
+
+		maxSubscriptionsPerUser: maxSubscriptionsPerUser,
+		leaseTTL:                leaseTTL,
+
+		leases:        make(map[<-chan NotificationPayload]subscriptionLease),
+		channels:      make(map[string]*userChannel),
+		confirmations: make(map[string][]chan struct{}),
+	}
+}
+
+// acquireLeaseScript adds subscription lease if the user has less than ARGV[4] open subscriptions.
+// Zero limit allows unlimited subscriptions.
+var acquireLeaseScript = redis.NewScript(`
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', ARGV[2])
+local limit = tonumber(ARGV[4])
+if limit > 0 and redis.call('ZCARD', KEYS[1]) >= limit then
+	return 0
+end
+redis.call('ZADD', KEYS[1], ARGV[3], ARGV[1])
+redis.call('PEXPIREAT', KEYS[1], ARGV[3])
+return 1
+`)
+
+func (s *RedisSubscriptionService) Subscribe(userDID string) (<-chan NotificationPayload, error) {
+	return s.SubscribeWithFilter(userDID, SubscriptionFilter{})
+}
+
+// SubscribeWithFilter opens subscription of userDID which gets only notifications matching the filter
+func (s *RedisSubscriptionService) SubscribeWithFilter(userDID string,
+	filter SubscriptionFilter) (<-chan NotificationPayload, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisOperationTimeout)
+	defer cancel()
+
+	id, err := s.leaseID(userDID, filter)
+	if err != nil {
+		return nil, err
+	}
+	lease := subscriptionLease{userDID: userDID, id: id}
+	now := time.Now()
+	acquired, err := acquireLeaseScript.Run(ctx, s.client, []string{s.keys.subscriptionLeases(userDID)},
+		lease.id, now.UnixMilli(), now.Add(s.leaseTTL).UnixMilli(), s.maxSubscriptionsPerUser).Bool()
+	if err != nil {
+		return nil, err
+	}
+	if !acquired {
+		return nil, fmt.Errorf("%w: allowed connections: %v",
+			ErrMaxSubscriptionsReached, s.maxSubscriptionsPerUser)
+	}
+
+	if err := s.listen(ctx, userDID); err != nil {
+		s.releaseLease(ctx, lease)
+		return nil, err
+	}
+	ch, err := s.local.SubscribeWithFilter(userDID, filter)
+	if err != nil {
+		s.unlisten(userDID)
+		s.releaseLease(ctx, lease)
+		return nil, err
+	}
+
+	s.lock.Lock()
+	s.leases[ch] = lease
+	s.lock.Unlock()
+	return ch, nil
+}
+
+// listen subscribes the replica to the channel of userDID, so published notifications
+// are relayed to local subscriptions. The first subscription of the user waits until
+// redis confirms the channel subscription, the others wait for the first one.
+// Every successful call must be paired with unlisten.
+func (s *RedisSubscriptionService) listen(ctx context.Context, userDID string) error {
+	s.lock.Lock()
+	uc := s.channels[userDID]
+	// the channel of the last unsubscribed subscription is being released
+	for uc != nil && uc.closing != nil {
+		closing := uc.closing
+		s.lock.Unlock()
+		select {
+		case <-closing:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		s.lock.Lock()
+		uc = s.channels[userDID]
+	}
+	first := uc == nil
+	if first {
+		uc = &userChannel{ready: make(chan struct{})}
+		s.channels[userDID] = uc
+	}
+	uc.subscriptions++
+	s.lock.Unlock()
+
+	if first {
+		uc.err = s.subscribeChannel(ctx, s.keys.subscriptionChannel(userDID))
+		close(uc.ready)
+	} else {
+		select {
+		case <-uc.ready:
+		case <-ctx.Done():
+			s.unlisten(userDID)
+			return ctx.Err()
+		}
+	}
+	if uc.err != nil {
+		s.unlisten(userDID)
+		return uc.err
+	}
+	return nil
+}
+
+// unlisten unsubscribes the replica from the channel of userDID
+// when the last local subscription of the user is gone
+func (s *RedisSubscriptionService) unlisten(userDID string) {
+	s.lock.Lock()
+	uc := s.channels[userDID]
+	uc.subscriptions--
+	if uc.subscriptions > 0 {
+		s.lock.Unlock()
+		return
+	}
+	uc.closing = make(chan struct{})
+	s.lock.Unlock()
+
+	// the context of the subscription could be done already
+	ctx, cancel := context.WithTimeout(context.Background(), redisOperationTimeout)
+	defer cancel()
+	// failed subscription is unsubscribed as well, redis could have applied it
+	if err := s.pubsub.Unsubscribe(ctx, s.keys.subscriptionChannel(userDID)); err != nil {
+		log.Errorf("failed to unsubscribe from channel of user %s: %v", userDID, err)
+	}
+
+	s.lock.Lock()
+	delete(s.channels, userDID)
+	close(uc.closing)
+	s.lock.Unlock()
+}
+
+// subscribeChannel subscribes pubsub to the channel and waits until Run receives the confirmation
+func (s *RedisSubscriptionService) subscribeChannel(ctx context.Context, channel string) error {
+	confirmed := make(chan struct{})
+	s.lock.Lock()
+	s.confirmations[channel] = append(s.confirmations[channel], confirmed)
+	s.lock.Unlock()
+	defer s.dropConfirmation(channel, confirmed)
+
+	if err := s.pubsub.Subscribe(ctx, channel); err != nil {
+		return err
+	}
+	select {
+	case <-confirmed:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("subscription to channel isn't confirmed: %w", ctx.Err())
+	}
+}
+
+func (s *RedisSubscriptionService) dropConfirmation(channel string, confirmed chan struct{}) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	waiting := s.confirmations[channel]
+	for i, c := range waiting {
+		if c == confirmed {
+			waiting = append(waiting[:i], waiting[i+1:]...)
+			break
+		}
+	}
+	if len(waiting) == 0 {
+		delete(s.confirmations, channel)
+		return
+	}
+	s.confirmations[channel] = waiting
+}
+
+// confirm notifies subscriptions waiting for the channel
+func (s *RedisSubscriptionService) confirm(channel string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, c := range s.confirmations[channel] {
+		close(c)
+	}
+	delete(s.confirmations, channel)
+}
+
+func (s *RedisSubscriptionService) Unsubscribe(userDID string, ch <-chan NotificationPayload) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisOperationTimeout)
+	defer cancel()
+
+	s.local.Unsubscribe(userDID, ch)
+
+	s.lock.Lock()
+	lease, ok := s.leases[ch]
+	delete(s.leases, ch)
+	s.lock.Unlock()
+	if !ok {
+		return
+	}
+	s.releaseLease(ctx, lease)
+	s.unlisten(userDID)
+}
+
+// CloseAll closes subscriptions of all users on this replica and rejects new subscriptions.
+// Leases are released when the subscriptions are unsubscribed.
+func (s *RedisSubscriptionService) CloseAll(reason string) int {
+	return s.local.CloseAll(reason)
+}
+
+// CloseReason returns why the subscription channel was closed by the service
+func (s *RedisSubscriptionService) CloseReason(userDID string, ch <-chan NotificationPayload) string {
+	return s.local.CloseReason(userDID, ch)
+}
+
+// Notify publishes notification to subscriptions of userDID on all replicas.
+// Returns false if no subscription of the user on any replica matches the payload.
+func (s *RedisSubscriptionService) Notify(userDID string, payload NotificationPayload) bool {
+	// replicas listen to the channel only while they have subscriptions of the user
+	event := subscriptionEvent{
+		Type:    subscriptionEventNotification,
+		EventID: payload.EventID,
+		Payload: &payload,
+	}
+	switch {
+	case payload.Attributes.IsEmpty():
+	case s.cipher == nil:
+		event.Attributes = &payload.Attributes
+	default:
+		attrs, err := encryptJSON(s.cipher, payload.Attributes, []byte(userDID))
+		if err != nil {
+			// filtered subscriptions won't match the notification
+			log.Errorf("failed to encrypt attributes of notification for user %s: %v", userDID, err)
+		}
+		event.EncryptedAttributes = attrs
+	}
+	if err := s.publish(userDID, event); err != nil {
+		return false
+	}
+	// in cluster mode PUBLISH counts only subscribers of the node which took it,
+	// so the delivery is decided by leases of open subscriptions
+	return s.matchLeases(userDID, payload)
+}
+
+// matchLeases reports whether filter of any open subscription of userDID matches payload.
+// Subscriptions are assumed to match if their leases can't be loaded.
+func (s *RedisSubscriptionService) matchLeases(userDID string, payload NotificationPayload) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), redisOperationTimeout)
+	defer cancel()
+
+	ids, err := s.client.ZRangeByScore(ctx, s.keys.subscriptionLeases(userDID), &redis.ZRangeBy{
+		Min: fmt.Sprint(time.Now().UnixMilli()),
+		Max: "+inf",
+	}).Result()
+	if err != nil {
+		log.Errorf("failed to load subscription leases of user %s: %v", userDID, err)
+		return true
+	}
+	for _, id := range ids {
+		filter, err := s.leaseFilter(userDID, id)
+		if err != nil {
+			log.Warnf("invalid filter of subscription lease of user %s: %v", userDID, err)
+			return true
+		}
+		if filter.Match(payload) {
+			return true
+		}
+	}
+	return false
+}
+
+// UnsubscribeAll closes subscriptions of userDID on all replicas.
+// Returns number of subscriptions open at the moment.
+func (s *RedisSubscriptionService) UnsubscribeAll(userDID string) int {
+	ctx, cancel := context.WithTimeout(context.Background(), redisOperationTimeout)
+	defer cancel()
+
+	open, err := s.client.ZCount(ctx, s.keys.subscriptionLeases(userDID),
+		fmt.Sprint(time.Now().UnixMilli()), "+inf").Result()
+	if err != nil {
+		log.Errorf("failed to count subscriptions of user %s: %v", userDID, err)
+	}
+	_ = s.publish(userDID, subscriptionEvent{Type: subscriptionEventClose})
+	return int(open)
+}
+
+// Erase removes subscription leases of userDID. Subscriptions still open are closed
+// by UnsubscribeAll, leases are removed for subscriptions of crashed replicas as well.
+func (s *RedisSubscriptionService) Erase(ctx context.Context, userDID string) error {
+	return s.client.Del(ctx, s.keys.subscriptionLeases(userDID)).Err()
+}
+
+// publish sends event to the channel of userDID. Errors are logged, so callers
+// which don't need the result can ignore them.
+func (s *RedisSubscriptionService) publish(userDID string, event subscriptionEvent) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisOperationTimeout)
+	defer cancel()
+
+	b, err := json.Marshal(event)
+	if err != nil {
+		log.Errorf("failed to marshal subscription event: %v", err)
+		return err
+	}
+	if err := s.client.Publish(ctx, s.keys.subscriptionChannel(userDID), b).Err(); err != nil {
+		log.Errorf("failed to publish %s event for user %s: %v", event.Type, userDID, err)
+		return err
+	}
+	return nil
+}
+
+// Run relays published events to local subscriptions and renews leases
+// of local subscriptions until ctx is done.
+func (s *RedisSubscriptionService) Run(ctx context.Context) {
+	renew := time.NewTicker(s.leaseTTL / 3)
+	defer renew.Stop()
+	defer func() {
+		if err := s.pubsub.Close(); err != nil {
+			log.Errorf("failed to close pubsub: %v", err)
+		}
+	}()
+
+	// subscription confirmations are received to unblock waiting subscribers
+	messages := s.pubsub.ChannelWithSubscriptions()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg, ok := <-messages:
+			if !ok {
+				return
+			}
+			switch m := msg.(type) {
+			case *redis.Subscription:
+				if m.Kind == "subscribe" {
+					s.confirm(m.Channel)
+				}
+			case *redis.Message:
+				s.relay(m)
+			}
+		case <-renew.C:
+			s.renewLeases(ctx)
+		}
+	}
+}
+
+func (s *RedisSubscriptionService) relay(msg *redis.Message) {
+	userDID, ok := s.keys.subscriptionChannelOwner(msg.Channel)
+	if !ok {
+		return
+	}
+	var event subscriptionEvent
+	if err := json.Unmarshal([]byte(msg.Payload), &event); err != nil {
+		log.Errorf("invalid subscription event in channel %s: %v", msg.Channel, err)
+		return
+	}
+	switch event.Type {
+	case subscriptionEventNotification:
+		if event.Payload != nil {
+			event.Payload.EventID = event.EventID
+			if event.Attributes != nil {
+				event.Payload.Attributes = *event.Attributes
+			}
+			if event.EncryptedAttributes != "" {
+				err := decryptJSON(s.cipher, event.EncryptedAttributes, []byte(userDID), &event.Payload.Attributes)
+				if err != nil {
+					log.Errorf("invalid attributes of notification in channel %s: %v", msg.Channel, err)
+				}
+			}
+			s.local.Notify(userDID, *event.Payload)
+		}
+	case subscriptionEventClose:
+		// leases are released when handlers unsubscribe closed channels
+		s.local.UnsubscribeAll(userDID)
+	}
+}
+
+func (s *RedisSubscriptionService) renewLeases(ctx context.Context) {
+	s.lock.Lock()
+	leases := make([]subscriptionLease, 0, len(s.leases))
+	for _, l := range s.leases {
+		leases = append(leases, l)
+	}
+	s.lock.Unlock()
+	if len(leases) == 0 {
+		return
+	}
+
+	expiresAt := time.Now().Add(s.leaseTTL).UnixMilli()
+	_, err := s.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, l := range leases {
+			key := s.keys.subscriptionLeases(l.userDID)
+			pipe.ZAdd(ctx, key, redis.Z{Score: float64(expiresAt), Member: l.id})
+			pipe.PExpireAt(ctx, key, time.UnixMilli(expiresAt))
+		}
+		return nil
+	})
+	if err != nil {
+		log.Errorf("failed to renew subscription leases: %v", err)
+	}
+}
+
+// leaseID returns a new ID of the lease followed by the subscription filter
+func (s *RedisSubscriptionService) leaseID(userDID string, filter SubscriptionFilter) (string, error) {
+	id := uuid.NewString()
+	if filter.IsEmpty() {
+		return id, nil
+	}
+	v, err := encryptJSON(s.cipher, filter, []byte(userDID))
+	if err != nil {
+		return "", err
+	}
+	return id + ":" + v, nil
+}
+
+// leaseFilter returns filter of the subscription holding the lease
+func (s *RedisSubscriptionService) leaseFilter(userDID, id string) (SubscriptionFilter, error) {
+	var filter SubscriptionFilter
+	_, v, found := strings.Cut(id, ":")
+	if !found {
+		return filter, nil
+	}
+	err := decryptJSON(s.cipher, v, []byte(userDID), &filter)
+	return filter, err
+}
+
+func (s *RedisSubscriptionService) releaseLease(ctx context.Context, lease subscriptionLease) {
+	if err := s.client.ZRem(ctx, s.keys.subscriptionLeases(lease.userDID), lease.id).Err(); err != nil {
+		log.Errorf("failed to release subscription lease of user %s: %v", lease.userDID, err)
+	}
+}
@@ -0,0 +1,250 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestRedisSubscriptionService(t *testing.T, mr *miniredis.Miniredis, maxSubscriptions int,
+	opts ...SubscriptionOption) *RedisSubscriptionService {
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	ctx, cancel := context.WithCancel(context.Background())
+	s := NewRedisSubscriptionService(client, "test", maxSubscriptions, 10, time.Minute, opts...)
+	done := make(chan struct{})
+	go func() {
+		s.Run(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+		_ = client.Close()
+	})
+	return s
+}
+
+func TestRedisSubscription_NotifyOtherReplica(t *testing.T) {
+	mr := miniredis.RunT(t)
+	replicaA := newTestRedisSubscriptionService(t, mr, 10)
+	replicaB := newTestRedisSubscriptionService(t, mr, 10)
+	userDID := "did:example:123"
+
+	ch, err := replicaB.Subscribe(userDID)
+	require.NoError(t, err)
+
+	payload := NotificationPayload{ID: "1", EventID: "1700000000000-0"}
+	require.True(t, replicaA.Notify(userDID, payload))
+	select {
+	case received := <-ch:
+		require.Equal(t, payload, received)
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for notification")
+	}
+
+	// subscriptions are closed on every replica
+	require.Equal(t, 1, replicaA.UnsubscribeAll(userDID))
+	select {
+	case _, ok := <-ch:
+		require.False(t, ok)
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for channel close")
+	}
+	replicaB.Unsubscribe(userDID, ch)
+	leases, _ := mr.ZMembers(replicaB.keys.subscriptionLeases(userDID))
+	require.Empty(t, leases)
+}
+
+func TestRedisSubscription_NotifyOtherNode(t *testing.T) {
+	mr := miniredis.RunT(t)
+	s := newTestRedisSubscriptionService(t, mr, 10)
+	userDID := "did:example:123"
+
+	require.False(t, s.Notify(userDID, NotificationPayload{ID: "1"}))
+	require.False(t, s.Notify(userDID, NewReadEvent([]string{"1"})))
+
+	// subscriber connected to another cluster node isn't counted by PUBLISH
+	_, err := mr.ZAdd(s.keys.subscriptionLeases(userDID),
+		float64(time.Now().Add(time.Minute).UnixMilli()), "other-node")
+	require.NoError(t, err)
+	require.True(t, s.Notify(userDID, NotificationPayload{ID: "2"}))
+
+	// expired lease doesn't count
+	mr.Del(s.keys.subscriptionLeases(userDID))
+	_, err = mr.ZAdd(s.keys.subscriptionLeases(userDID),
+		float64(time.Now().Add(-time.Second).UnixMilli()), "crashed")
+	require.NoError(t, err)
+	require.False(t, s.Notify(userDID, NotificationPayload{ID: "3"}))
+}
+
+func TestRedisSubscription_ClusterWideLimit(t *testing.T) {
+	mr := miniredis.RunT(t)
+	replicaA := newTestRedisSubscriptionService(t, mr, 1)
+	replicaB := newTestRedisSubscriptionService(t, mr, 1)
+	userDID := "did:example:123"
+
+	ch, err := replicaA.Subscribe(userDID)
+	require.NoError(t, err)
+	_, err = replicaB.Subscribe(userDID)
+	require.ErrorIs(t, err, ErrMaxSubscriptionsReached)
+
+	replicaA.Unsubscribe(userDID, ch)
+	ch, err = replicaB.Subscribe(userDID)
+	require.NoError(t, err)
+	replicaB.Unsubscribe(userDID, ch)
+
+	// lease of a crashed replica isn't renewed and expires
+	_, err = mr.ZAdd(replicaA.keys.subscriptionLeases(userDID),
+		float64(time.Now().Add(-time.Second).UnixMilli()), "crashed")
+	require.NoError(t, err)
+	_, err = replicaB.Subscribe(userDID)
+	require.NoError(t, err)
+}
+
+func TestRedisSubscription_CloseAll(t *testing.T) {
+	mr := miniredis.RunT(t)
+	s := newTestRedisSubscriptionService(t, mr, 10)
+	userDID := "did:example:123"
+
+	ch, err := s.Subscribe(userDID)
+	require.NoError(t, err)
+	require.Equal(t, 1, s.CloseAll(CloseReasonServerShutdown))
+	_, ok := <-ch
+	require.False(t, ok)
+	require.Equal(t, CloseReasonServerShutdown, s.CloseReason(userDID, ch))
+
+	// new subscriptions don't hold leases
+	_, err = s.Subscribe(userDID)
+	require.ErrorIs(t, err, ErrSubscriptionsClosed)
+	s.Unsubscribe(userDID, ch)
+	leases, _ := mr.ZMembers(s.keys.subscriptionLeases(userDID))
+	require.Empty(t, leases)
+}
+
+func TestRedisSubscription_Erase(t *testing.T) {
+	mr := miniredis.RunT(t)
+	replicaA := newTestRedisSubscriptionService(t, mr, 1)
+	replicaB := newTestRedisSubscriptionService(t, mr, 1)
+	userDID := "did:example:123"
+
+	ch, err := replicaA.Subscribe(userDID)
+	require.NoError(t, err)
+	require.Equal(t, 1, replicaA.UnsubscribeAll(userDID))
+	replicaA.Unsubscribe(userDID, ch)
+	// lease of a crashed replica is erased as well
+	_, err = mr.ZAdd(replicaA.keys.subscriptionLeases(userDID),
+		float64(time.Now().Add(time.Minute).UnixMilli()), "crashed")
+	require.NoError(t, err)
+
+	require.NoError(t, replicaA.Erase(context.Background(), userDID))
+	require.False(t, mr.Exists(replicaA.keys.subscriptionLeases(userDID)))
+	_, err = replicaB.Subscribe(userDID)
+	require.NoError(t, err)
+}
+
+func TestRedisSubscription_ChannelSubscription(t *testing.T) {
+	mr := miniredis.RunT(t)
+	replicaA := newTestRedisSubscriptionService(t, mr, 10)
+	replicaB := newTestRedisSubscriptionService(t, mr, 10)
+	userDID := "did:example:123"
+	channel := replicaB.keys.subscriptionChannel(userDID)
+
+	// the channel is subscribed in redis when Subscribe returns
+	ch, err := replicaB.Subscribe(userDID)
+	require.NoError(t, err)
+	require.Equal(t, map[string]int{channel: 1}, mr.PubSubNumSub(channel))
+	replicaB.Unsubscribe(userDID, ch)
+	ch, err = replicaB.Subscribe(userDID)
+	require.NoError(t, err)
+	require.True(t, replicaA.Notify(userDID, NotificationPayload{ID: "1"}))
+	replicaB.Unsubscribe(userDID, ch)
+	unsubscribed := func() bool { return mr.PubSubNumSub(channel)[channel] == 0 }
+	require.Eventually(t, unsubscribed, time.Second, 10*time.Millisecond)
+
+	// the channel is unsubscribed if the local subscription fails
+	replicaB.CloseAll(CloseReasonServerShutdown)
+	_, err = replicaB.Subscribe(userDID)
+	require.ErrorIs(t, err, ErrSubscriptionsClosed)
+	require.Empty(t, replicaB.channels)
+	require.Eventually(t, unsubscribed, time.Second, 10*time.Millisecond)
+}
+
+func TestRedisSubscription_FilterOtherReplica(t *testing.T) {
+	mr := miniredis.RunT(t)
+	replicaA := newTestRedisSubscriptionService(t, mr, 10)
+	replicaB := newTestRedisSubscriptionService(t, mr, 10)
+	userDID := "did:example:123"
+
+	ch, err := replicaB.SubscribeWithFilter(userDID, SubscriptionFilter{ThreadIDs: []string{"thread-1"}})
+	require.NoError(t, err)
+
+	// attributes are published with the notification, so the other replica can filter it,
+	// filters are kept in leases, so the publishing replica knows nothing matched
+	require.False(t, replicaA.Notify(userDID, NotificationPayload{ID: "1",
+		Attributes: NotificationAttributes{ThreadID: "thread-2"}}))
+	payload := NotificationPayload{ID: "2", Attributes: NotificationAttributes{ThreadID: "thread-1"}}
+	require.True(t, replicaA.Notify(userDID, payload))
+	select {
+	case received := <-ch:
+		require.Equal(t, payload, received)
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for notification")
+	}
+	// sync events match every filter
+	require.True(t, replicaA.Notify(userDID, NewReadEvent([]string{"2"})))
+
+	// lease without filter matches every notification
+	_, err = mr.ZAdd(replicaA.keys.subscriptionLeases(userDID),
+		float64(time.Now().Add(time.Minute).UnixMilli()), "crashed")
+	require.NoError(t, err)
+	require.True(t, replicaA.Notify(userDID, NotificationPayload{ID: "3",
+		Attributes: NotificationAttributes{ThreadID: "thread-2"}}))
+}
+
+func TestRedisSubscription_Encryption(t *testing.T) {
+	mr := miniredis.RunT(t)
+	c, err := NewStorageCipher("k1", map[string][]byte{"k1": bytes.Repeat([]byte{1}, 32)})
+	require.NoError(t, err)
+	replicaA := newTestRedisSubscriptionService(t, mr, 10, WithSubscriptionEncryption(c))
+	replicaB := newTestRedisSubscriptionService(t, mr, 10, WithSubscriptionEncryption(c))
+	userDID := "did:example:123"
+
+	ch, err := replicaB.SubscribeWithFilter(userDID, SubscriptionFilter{ThreadIDs: []string{"thread-1"}})
+	require.NoError(t, err)
+	// filter is kept in the lease encrypted
+	leases, err := mr.ZMembers(replicaB.keys.subscriptionLeases(userDID))
+	require.NoError(t, err)
+	require.Len(t, leases, 1)
+	require.NotContains(t, leases[0], "thread-1")
+
+	// attributes are published encrypted
+	spy := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { _ = spy.Close() })
+	pubsub := spy.Subscribe(context.Background(), replicaA.keys.subscriptionChannel(userDID))
+	t.Cleanup(func() { _ = pubsub.Close() })
+	_, err = pubsub.Receive(context.Background())
+	require.NoError(t, err)
+
+	require.False(t, replicaA.Notify(userDID, NotificationPayload{ID: "1",
+		Attributes: NotificationAttributes{ThreadID: "thread-2"}}))
+	payload := NotificationPayload{ID: "2", Attributes: NotificationAttributes{ThreadID: "thread-1"}}
+	require.True(t, replicaA.Notify(userDID, payload))
+	select {
+	case received := <-ch:
+		require.Equal(t, payload, received)
+	case <-time.After(time.Second):
+		t.Fatal("timeout waiting for notification")
+	}
+
+	for i := 0; i < 2; i++ {
+		msg, err := pubsub.ReceiveMessage(context.Background())
+		require.NoError(t, err)
+		require.NotContains(t, msg.Payload, "thread-")
+		require.Contains(t, msg.Payload, "encrypted_attributes")
+	}
+}
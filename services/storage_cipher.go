@@ -0,0 +1,204 @@
+package services
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	// encryptedValuePrefix marks values encrypted by StorageCipher.
+	// Values without the prefix are treated as plaintext written before encryption was enabled.
+	encryptedValuePrefix = "enc:v1:"
+	storageKeySize       = 32
+	// DerivedStorageKeyID is ID of the key derived from the service private key
+	DerivedStorageKeyID = "pk"
+)
+
+// ErrUnknownStorageKey is returned when value was encrypted with a key that isn't configured
+var ErrUnknownStorageKey = errors.New("unknown storage encryption key")
+
+// StorageCipher encrypts stored values with AES-256-GCM envelope encryption.
+// Every value is encrypted with a random data key, the data key is wrapped with the active
+// key encryption key. ID of the wrapping key is embedded into the value, so retired keys
+// can still decrypt old values after rotation.
+// Values are bound to the key they are stored by with additional authenticated data,
+// so a ciphertext copied under another key fails to decrypt.
+type StorageCipher struct {
+	activeKeyID string
+	keys        map[string]cipher.AEAD
+}
+
+// NewStorageCipher creates cipher with key encryption keys by their IDs.
+// New values are encrypted with activeKeyID key.
+func NewStorageCipher(activeKeyID string, keys map[string][]byte) (*StorageCipher, error) {
+	c := &StorageCipher{
+		activeKeyID: activeKeyID,
+		keys:        make(map[string]cipher.AEAD, len(keys)),
+	}
+	for id, k := range keys {
+		if id == "" || strings.Contains(id, ":") {
+			return nil, fmt.Errorf("invalid storage key id '%s'", id)
+		}
+		aead, err := newAEAD(k)
+		if err != nil {
+			return nil, fmt.Errorf("invalid storage key '%s': %w", id, err)
+		}
+		c.keys[id] = aead
+	}
+	if _, ok := c.keys[activeKeyID]; !ok {
+		return nil, fmt.Errorf("active storage key '%s' is not configured", activeKeyID)
+	}
+	return c, nil
+}
+
+// ParseStorageKeys parses keys in 'id:base64 key' format
+func ParseStorageKeys(keys []string) (map[string][]byte, error) {
+	res := make(map[string][]byte, len(keys))
+	for _, k := range keys {
+		id, encoded, ok := strings.Cut(k, ":")
+		if !ok {
+			return nil, errors.New("storage key must be in 'id:base64 key' format")
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, fmt.Errorf("storage key '%s' is not base64 encoded", id)
+		}
+		res[id] = key
+	}
+	return res, nil
+}
+
+// DeriveStorageKey derives key encryption key from the service private key
+func DeriveStorageKey(privKey interface{}) ([]byte, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(privKey)
+	if err != nil {
+		return nil, err
+	}
+	return hkdf.Key(sha256.New, der, nil, "notification-service storage encryption", storageKeySize)
+}
+
+// Encrypt encrypts plaintext with a new data key and binds it to aad
+func (c *StorageCipher) Encrypt(plaintext, aad []byte) (string, error) {
+	dataKey := make([]byte, storageKeySize)
+	if _, err := rand.Read(dataKey); err != nil {
+		return "", err
+	}
+	dataAEAD, err := newAEAD(dataKey)
+	if err != nil {
+		return "", err
+	}
+
+	wrappedKey, err := seal(c.keys[c.activeKeyID], dataKey, nil)
+	if err != nil {
+		return "", err
+	}
+	ciphertext, err := seal(dataAEAD, plaintext, aad)
+	if err != nil {
+		return "", err
+	}
+
+	return encryptedValuePrefix + c.activeKeyID + ":" +
+		base64.RawStdEncoding.EncodeToString(wrappedKey) + ":" +
+		base64.RawStdEncoding.EncodeToString(ciphertext), nil
+}
+
+// Decrypt decrypts value encrypted with the same aad. Plaintext values are returned as is.
+func (c *StorageCipher) Decrypt(value string, aad []byte) ([]byte, error) {
+	if !IsEncryptedValue(value) {
+		return []byte(value), nil
+	}
+	parts := strings.Split(strings.TrimPrefix(value, encryptedValuePrefix), ":")
+	if len(parts) != 3 {
+		return nil, errors.New("invalid encrypted value format")
+	}
+	kek, ok := c.keys[parts[0]]
+	if !ok {
+		return nil, fmt.Errorf("%w: '%s'", ErrUnknownStorageKey, parts[0])
+	}
+	wrappedKey, err := base64.RawStdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errors.New("invalid encrypted data key")
+	}
+	ciphertext, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, errors.New("invalid encrypted value")
+	}
+
+	dataKey, err := open(kek, wrappedKey, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap data key: %w", err)
+	}
+	dataAEAD, err := newAEAD(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	return open(dataAEAD, ciphertext, aad)
+}
+
+// IsCurrent checks that value is encrypted with the active key
+func (c *StorageCipher) IsCurrent(value string) bool {
+	return strings.HasPrefix(value, encryptedValuePrefix+c.activeKeyID+":")
+}
+
+// IsEncryptedValue checks that value was encrypted by StorageCipher
+func IsEncryptedValue(value string) bool {
+	return strings.HasPrefix(value, encryptedValuePrefix)
+}
+
+// encryptJSON marshals v and encrypts it bound to aad if c is set
+func encryptJSON(c *StorageCipher, v interface{}, aad []byte) (string, error) {
+	b, err := json.Marshal(v)
+	if err != nil || c == nil {
+		return string(b), err
+	}
+	return c.Encrypt(b, aad)
+}
+
+// decryptJSON decrypts value bound to aad if c is set and unmarshals it into v
+func decryptJSON(c *StorageCipher, value string, aad []byte, v interface{}) error {
+	b := []byte(value)
+	if c != nil {
+		var err error
+		if b, err = c.Decrypt(value, aad); err != nil {
+			return err
+		}
+	}
+	return json.Unmarshal(b, v)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != storageKeySize {
+		return nil, fmt.Errorf("key must be %d bytes long", storageKeySize)
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts plaintext with a random nonce prepended to the ciphertext
+func seal(aead cipher.AEAD, plaintext, aad []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, aad), nil
+}
+
+func open(aead cipher.AEAD, ciphertext, aad []byte) ([]byte, error) {
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errors.New("ciphertext is too short")
+	}
+	nonce, data := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+	return aead.Open(nil, nonce, data, aad)
+}
@@ -0,0 +1,52 @@
+package services
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStorageCipher_RoundTrip(t *testing.T) {
+	c, err := NewStorageCipher("k1", map[string][]byte{"k1": bytes.Repeat([]byte{1}, 32)})
+	require.NoError(t, err)
+
+	encrypted, err := c.Encrypt([]byte(`{"body":"secret"}`), []byte("did+a"))
+	require.NoError(t, err)
+	require.True(t, IsEncryptedValue(encrypted))
+	require.True(t, c.IsCurrent(encrypted))
+	require.NotContains(t, encrypted, "secret")
+
+	decrypted, err := c.Decrypt(encrypted, []byte("did+a"))
+	require.NoError(t, err)
+	require.Equal(t, `{"body":"secret"}`, string(decrypted))
+
+	// value is bound to the key it was encrypted for
+	_, err = c.Decrypt(encrypted, []byte("did+b"))
+	require.Error(t, err)
+
+	// plaintext values are returned as is
+	decrypted, err = c.Decrypt(`{"body":"legacy"}`, []byte("did+a"))
+	require.NoError(t, err)
+	require.Equal(t, `{"body":"legacy"}`, string(decrypted))
+}
+
+func TestStorageCipher_Rotation(t *testing.T) {
+	k1, k2 := bytes.Repeat([]byte{1}, 32), bytes.Repeat([]byte{2}, 32)
+	old, err := NewStorageCipher("k1", map[string][]byte{"k1": k1})
+	require.NoError(t, err)
+	encrypted, err := old.Encrypt([]byte("value"), []byte("id"))
+	require.NoError(t, err)
+
+	rotated, err := NewStorageCipher("k2", map[string][]byte{"k1": k1, "k2": k2})
+	require.NoError(t, err)
+	require.False(t, rotated.IsCurrent(encrypted))
+	decrypted, err := rotated.Decrypt(encrypted, []byte("id"))
+	require.NoError(t, err)
+	require.Equal(t, "value", string(decrypted))
+
+	retired, err := NewStorageCipher("k2", map[string][]byte{"k2": k2})
+	require.NoError(t, err)
+	_, err = retired.Decrypt(encrypted, []byte("id"))
+	require.ErrorIs(t, err, ErrUnknownStorageKey)
+}
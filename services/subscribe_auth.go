@@ -0,0 +1,165 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// subscribeTokenSize is a number of random bytes in tickets and sessions
+const subscribeTokenSize = 32
+
+// ErrInvalidSubscribeToken is returned when ticket or session is unknown, expired or already used
+var ErrInvalidSubscribeToken = errors.New("invalid or expired token")
+
+// subscribeGrant is a stored owner of ticket or session. Streams opened with the grant
+// are closed at ValidUntil, unix time in milliseconds, zero means the grant doesn't expire.
+type subscribeGrant struct {
+	UserDID    string `json:"user_did"`
+	ValidUntil int64  `json:"valid_until,omitempty"`
+}
+
+// SubscribeAuth issues credentials for clients which can't set Authorization header,
+// like browser EventSource. Tickets are short-lived and single-use, so they can be passed
+// in URL. Sessions are reusable until expiration and are meant for HttpOnly cookies.
+// Only hashes of tokens are stored, so tokens can't be recovered from Redis.
+// Keys of tokens are tracked per user, so they can be erased with user data.
+type SubscribeAuth struct {
+	client     redis.UniversalClient
+	keys       keySchema
+	ticketTTL  time.Duration
+	sessionTTL time.Duration
+}
+
+// NewSubscribeAuth creates service issuing tickets valid for ticketTTL and sessions valid for sessionTTL.
+func NewSubscribeAuth(client redis.UniversalClient, keyPrefix string, ticketTTL, sessionTTL time.Duration) *SubscribeAuth {
+	return &SubscribeAuth{
+		client:     client,
+		keys:       newKeySchema(keyPrefix),
+		ticketTTL:  ticketTTL,
+		sessionTTL: sessionTTL,
+	}
+}
+
+// IssueTicket returns a new single-use ticket of userDID and its expiration time.
+// Streams opened with the ticket are valid until validUntil, zero time means they don't expire.
+func (a *SubscribeAuth) IssueTicket(ctx context.Context, userDID string, validUntil time.Time) (string, time.Time, error) {
+	return a.issue(ctx, a.keys.subscribeTicket, userDID, a.ticketTTL, validUntil)
+}
+
+// RedeemTicket returns DID of the ticket owner and time when streams opened with the ticket expire.
+// The ticket can't be used again.
+func (a *SubscribeAuth) RedeemTicket(ctx context.Context, ticket string) (string, time.Time, error) {
+	return a.resolve(a.client.GetDel(ctx, a.keys.subscribeTicket(hashSubscribeToken(ticket))))
+}
+
+// IssueSession returns a new session of userDID and its expiration time. The session
+// doesn't outlive validUntil of the credentials it was issued with, zero time means
+// the session expires in sessionTTL.
+func (a *SubscribeAuth) IssueSession(ctx context.Context, userDID string, validUntil time.Time) (string, time.Time, error) {
+	expiresAt := time.Now().Add(a.sessionTTL)
+	if !validUntil.IsZero() && validUntil.Before(expiresAt) {
+		expiresAt = validUntil
+	}
+	// session of expired credentials is stored shortly and rejected on resolve
+	ttl := max(time.Until(expiresAt), time.Millisecond)
+	return a.issue(ctx, a.keys.subscribeSession, userDID, ttl, expiresAt)
+}
+
+// ResolveSession returns DID of the session owner and expiration time of the session.
+func (a *SubscribeAuth) ResolveSession(ctx context.Context, session string) (string, time.Time, error) {
+	return a.resolve(a.client.Get(ctx, a.keys.subscribeSession(hashSubscribeToken(session))))
+}
+
+// RevokeSession deletes the session. Unknown sessions are ignored.
+func (a *SubscribeAuth) RevokeSession(ctx context.Context, session string) error {
+	return a.client.Del(ctx, a.keys.subscribeSession(hashSubscribeToken(session))).Err()
+}
+
+func (a *SubscribeAuth) issue(ctx context.Context, key func(string) string,
+	userDID string, ttl time.Duration, validUntil time.Time) (string, time.Time, error) {
+	b := make([]byte, subscribeTokenSize)
+	if _, err := rand.Read(b); err != nil {
+		return "", time.Time{}, err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+
+	grant := subscribeGrant{UserDID: userDID}
+	if !validUntil.IsZero() {
+		grant.ValidUntil = validUntil.UnixMilli()
+	}
+	value, err := json.Marshal(grant)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	expiresAt := time.Now().Add(ttl)
+	tokenKey := key(hashSubscribeToken(token))
+	if err := a.client.Set(ctx, tokenKey, value, ttl).Err(); err != nil {
+		return "", time.Time{}, err
+	}
+	// token and grants keys are in different cluster slots, so they are written separately.
+	// The set outlives any token, keys of expired tokens are removed with the set.
+	grantsKey := a.keys.subscribeGrants(userDID)
+	_, err = a.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.SAdd(ctx, grantsKey, tokenKey)
+		pipe.Expire(ctx, grantsKey, max(a.ticketTTL, a.sessionTTL))
+		return nil
+	})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return token, expiresAt, nil
+}
+
+// Erase revokes all tickets and sessions of userDID.
+func (a *SubscribeAuth) Erase(ctx context.Context, userDID string) error {
+	grantsKey := a.keys.subscribeGrants(userDID)
+	keys, err := a.client.SMembers(ctx, grantsKey).Result()
+	if err != nil {
+		return err
+	}
+	// keys of tokens belong to different cluster slots
+	_, err = a.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, k := range keys {
+			pipe.Del(ctx, k)
+		}
+		pipe.Del(ctx, grantsKey)
+		return nil
+	})
+	return err
+}
+
+func (a *SubscribeAuth) resolve(cmd *redis.StringCmd) (string, time.Time, error) {
+	b, err := cmd.Bytes()
+	if errors.Is(err, redis.Nil) {
+		return "", time.Time{}, ErrInvalidSubscribeToken
+	} else if err != nil {
+		return "", time.Time{}, err
+	}
+
+	var grant subscribeGrant
+	if err := json.Unmarshal(b, &grant); err != nil {
+		return "", time.Time{}, err
+	}
+	if grant.ValidUntil == 0 {
+		return grant.UserDID, time.Time{}, nil
+	}
+	validUntil := time.UnixMilli(grant.ValidUntil)
+	if !validUntil.After(time.Now()) {
+		return "", time.Time{}, ErrInvalidSubscribeToken
+	}
+	return grant.UserDID, validUntil, nil
+}
+
+func hashSubscribeToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
@@ -0,0 +1,156 @@
+package services
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestSubscribeAuth(t *testing.T) (*SubscribeAuth, *miniredis.Miniredis) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { _ = client.Close() })
+	return NewSubscribeAuth(client, "test", 30*time.Second, time.Hour), mr
+}
+
+func TestSubscribeAuth_Ticket(t *testing.T) {
+	a, mr := newTestSubscribeAuth(t)
+	ctx := context.Background()
+	userDID := "did:example:123"
+
+	ticket, expiresAt, err := a.IssueTicket(ctx, userDID, time.Time{})
+	require.NoError(t, err)
+	require.NotEmpty(t, ticket)
+	require.WithinDuration(t, time.Now().Add(30*time.Second), expiresAt, time.Second)
+	// token itself isn't stored
+	require.False(t, mr.Exists(a.keys.subscribeTicket(ticket)))
+
+	owner, validUntil, err := a.RedeemTicket(ctx, ticket)
+	require.NoError(t, err)
+	require.Equal(t, userDID, owner)
+	require.True(t, validUntil.IsZero())
+
+	// ticket is single-use
+	_, _, err = a.RedeemTicket(ctx, ticket)
+	require.ErrorIs(t, err, ErrInvalidSubscribeToken)
+
+	ticket, _, err = a.IssueTicket(ctx, userDID, time.Time{})
+	require.NoError(t, err)
+	mr.FastForward(31 * time.Second)
+	_, _, err = a.RedeemTicket(ctx, ticket)
+	require.ErrorIs(t, err, ErrInvalidSubscribeToken)
+
+	_, _, err = a.RedeemTicket(ctx, "unknown")
+	require.ErrorIs(t, err, ErrInvalidSubscribeToken)
+}
+
+func TestSubscribeAuth_Session(t *testing.T) {
+	a, mr := newTestSubscribeAuth(t)
+	ctx := context.Background()
+	userDID := "did:example:123"
+
+	session, expiresAt, err := a.IssueSession(ctx, userDID, time.Time{})
+	require.NoError(t, err)
+
+	// session is reusable until expiration
+	for i := 0; i < 2; i++ {
+		owner, validUntil, err := a.ResolveSession(ctx, session)
+		require.NoError(t, err)
+		require.Equal(t, userDID, owner)
+		// streams are closed when the session expires
+		require.WithinDuration(t, expiresAt, validUntil, time.Millisecond)
+	}
+
+	// sessions and tickets aren't interchangeable
+	_, _, err = a.RedeemTicket(ctx, session)
+	require.ErrorIs(t, err, ErrInvalidSubscribeToken)
+
+	require.NoError(t, a.RevokeSession(ctx, session))
+	_, _, err = a.ResolveSession(ctx, session)
+	require.ErrorIs(t, err, ErrInvalidSubscribeToken)
+
+	session, _, err = a.IssueSession(ctx, userDID, time.Time{})
+	require.NoError(t, err)
+	mr.FastForward(time.Hour + time.Second)
+	_, _, err = a.ResolveSession(ctx, session)
+	require.ErrorIs(t, err, ErrInvalidSubscribeToken)
+}
+
+func TestSubscribeAuth_TicketValidUntil(t *testing.T) {
+	a, _ := newTestSubscribeAuth(t)
+	ctx := context.Background()
+	userDID := "did:example:123"
+
+	// ticket keeps expiration time of the JWZ it was issued with
+	jwzValidUntil := time.Now().Add(time.Minute)
+	ticket, _, err := a.IssueTicket(ctx, userDID, jwzValidUntil)
+	require.NoError(t, err)
+	_, validUntil, err := a.RedeemTicket(ctx, ticket)
+	require.NoError(t, err)
+	require.WithinDuration(t, jwzValidUntil, validUntil, time.Millisecond)
+
+	// ticket of expired JWZ is rejected
+	ticket, _, err = a.IssueTicket(ctx, userDID, time.Now().Add(-time.Second))
+	require.NoError(t, err)
+	_, _, err = a.RedeemTicket(ctx, ticket)
+	require.ErrorIs(t, err, ErrInvalidSubscribeToken)
+}
+
+func TestSubscribeAuth_Erase(t *testing.T) {
+	a, mr := newTestSubscribeAuth(t)
+	ctx := context.Background()
+	userDID := "did:example:123"
+
+	ticket, _, err := a.IssueTicket(ctx, userDID, time.Time{})
+	require.NoError(t, err)
+	session, _, err := a.IssueSession(ctx, userDID, time.Time{})
+	require.NoError(t, err)
+	otherSession, _, err := a.IssueSession(ctx, "did:example:456", time.Time{})
+	require.NoError(t, err)
+
+	require.NoError(t, a.Erase(ctx, userDID))
+	_, _, err = a.RedeemTicket(ctx, ticket)
+	require.ErrorIs(t, err, ErrInvalidSubscribeToken)
+	_, _, err = a.ResolveSession(ctx, session)
+	require.ErrorIs(t, err, ErrInvalidSubscribeToken)
+	require.False(t, mr.Exists(a.keys.subscribeGrants(userDID)))
+
+	// tokens of other users are kept
+	owner, _, err := a.ResolveSession(ctx, otherSession)
+	require.NoError(t, err)
+	require.Equal(t, "did:example:456", owner)
+
+	// erase of user without tokens is a no-op
+	require.NoError(t, a.Erase(ctx, userDID))
+}
+
+func TestSubscribeAuth_SessionValidUntil(t *testing.T) {
+	a, mr := newTestSubscribeAuth(t)
+	ctx := context.Background()
+	userDID := "did:example:123"
+
+	// session expires with the JWZ it was issued with
+	jwzValidUntil := time.Now().Add(time.Minute)
+	session, expiresAt, err := a.IssueSession(ctx, userDID, jwzValidUntil)
+	require.NoError(t, err)
+	require.WithinDuration(t, jwzValidUntil, expiresAt, time.Millisecond)
+	_, validUntil, err := a.ResolveSession(ctx, session)
+	require.NoError(t, err)
+	require.WithinDuration(t, jwzValidUntil, validUntil, time.Millisecond)
+	require.LessOrEqual(t, mr.TTL(a.keys.subscribeSession(hashSubscribeToken(session))), time.Minute)
+
+	// JWZ valid longer than the session doesn't extend it
+	_, expiresAt, err = a.IssueSession(ctx, userDID, time.Now().Add(2*time.Hour))
+	require.NoError(t, err)
+	require.WithinDuration(t, time.Now().Add(time.Hour), expiresAt, time.Second)
+
+	// session of expired JWZ is rejected
+	session, _, err = a.IssueSession(ctx, userDID, time.Now().Add(-time.Second))
+	require.NoError(t, err)
+	_, _, err = a.ResolveSession(ctx, session)
+	require.ErrorIs(t, err, ErrInvalidSubscribeToken)
+}
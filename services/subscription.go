@@ -2,8 +2,11 @@ package services
 
 import (
 	"errors"
+	"expvar"
 	"fmt"
+	"hash/maphash"
 	"sync"
+	"sync/atomic"
 
 	"github.com/iden3/notification-service/log"
 )
@@ -11,8 +14,68 @@ import (
 var (
 	// ErrMaxSubscriptionsReached is returned when a user has reached the maximum number of subscriptions
 	ErrMaxSubscriptionsReached = errors.New("maximum number of subscriptions reached")
+	// ErrSubscriptionsClosed is returned when subscriptions are closed on shutdown
+	ErrSubscriptionsClosed = errors.New("subscriptions are closed")
 )
 
+// SlowConsumerPolicy defines what happens to a notification when buffer of subscription is full
+type SlowConsumerPolicy string
+
+const (
+	// SlowConsumerDropNewest drops the notification
+	SlowConsumerDropNewest SlowConsumerPolicy = "drop_newest"
+	// SlowConsumerDropOldest drops the oldest buffered notifications to deliver the new one
+	SlowConsumerDropOldest SlowConsumerPolicy = "drop_oldest"
+	// SlowConsumerDisconnect closes the subscription, so the client reconnects and replays missed events
+	SlowConsumerDisconnect SlowConsumerPolicy = "disconnect"
+	// SlowConsumerCoalesce replaces buffered notifications with a single event with their number
+	SlowConsumerCoalesce SlowConsumerPolicy = "coalesce"
+)
+
+// Validate checks that the policy is known
+func (p SlowConsumerPolicy) Validate() error {
+	switch p {
+	case SlowConsumerDropNewest, SlowConsumerDropOldest, SlowConsumerDisconnect, SlowConsumerCoalesce:
+		return nil
+	default:
+		return fmt.Errorf("unknown slow consumer policy '%s'", p)
+	}
+}
+
+// Reasons why a subscription was closed by the service
+const (
+	CloseReasonUnsubscribed   = "unsubscribed"
+	CloseReasonSlowConsumer   = "slow_consumer"
+	CloseReasonServerShutdown = "server_shutdown"
+	// CloseReasonAuthExpired is sent when credentials the subscription was opened with expire
+	CloseReasonAuthExpired = "auth_expired"
+)
+
+// subscriptionMetrics counts notifications sent to subscriptions by outcome:
+// delivered, or handled by one of slow consumer policies
+var subscriptionMetrics = expvar.NewMap("subscription_notifications")
+
+const metricDelivered = "delivered"
+
+// SubscriptionOption configures SubscriptionService optional parameters.
+type SubscriptionOption func(*SubscriptionService)
+
+// WithSlowConsumerPolicy sets what happens to notifications when buffer of subscription is full.
+// Notifications are dropped by default.
+func WithSlowConsumerPolicy(p SlowConsumerPolicy) SubscriptionOption {
+	return func(s *SubscriptionService) {
+		s.slowConsumerPolicy = p
+	}
+}
+
+// WithSubscriptionEncryption encrypts message attributes and subscription filters
+// shared by replicas through Redis. It has no effect on subscriptions of a single replica.
+func WithSubscriptionEncryption(c *StorageCipher) SubscriptionOption {
+	return func(s *SubscriptionService) {
+		s.cipher = c
+	}
+}
+
 type Subscriber struct {
 	userDID string
 }
@@ -23,84 +86,302 @@ func NewSubscriber(userDID string) Subscriber {
 	}
 }
 
-type SubscriptionService struct {
+// subscriptionShards is a number of registry shards, a power of two
+const subscriptionShards = 64
+
+// subscriptionShard keeps subscriptions of users whose DID hashes to the shard.
+// Position of every channel in the slice of its subscriber is indexed by the receive-only
+// view returned to the subscriber, so a subscription is removed in constant time.
+type subscriptionShard struct {
 	lock        sync.RWMutex
 	subscribers map[Subscriber][]chan NotificationPayload
+	positions   map[<-chan NotificationPayload]int
+	// closeReasons keeps why subscriptions were closed by the service until they are unsubscribed
+	closeReasons map[<-chan NotificationPayload]string
+	// filters of subscriptions which get only some notifications
+	filters map[<-chan NotificationPayload]SubscriptionFilter
+}
+
+// SubscriptionService is a registry of subscriptions open on this replica.
+// Subscriptions are sharded by DID, so connections of different users rarely contend for a lock.
+type SubscriptionService struct {
+	seed   maphash.Seed
+	shards [subscriptionShards]subscriptionShard
+	// closed rejects new subscriptions after CloseAll
+	closed atomic.Bool
 
 	maxSubscriptionsPerUser int
 	channelBufferSize       int
+	slowConsumerPolicy      SlowConsumerPolicy
+	// cipher is used by RedisSubscriptionService
+	cipher *StorageCipher
 }
 
 func NewSubscriptionService(
 	maxSubscriptionsPerUser int,
 	channelBufferSize int,
+	opts ...SubscriptionOption,
 ) *SubscriptionService {
-	return &SubscriptionService{
-		lock:        sync.RWMutex{},
-		subscribers: make(map[Subscriber][]chan NotificationPayload),
+	s := &SubscriptionService{
+		seed: maphash.MakeSeed(),
 
 		maxSubscriptionsPerUser: maxSubscriptionsPerUser,
 		channelBufferSize:       channelBufferSize,
+		slowConsumerPolicy:      SlowConsumerDropNewest,
+	}
+	for i := range s.shards {
+		s.shards[i].subscribers = make(map[Subscriber][]chan NotificationPayload)
+		s.shards[i].positions = make(map[<-chan NotificationPayload]int)
+		s.shards[i].closeReasons = make(map[<-chan NotificationPayload]string)
+		s.shards[i].filters = make(map[<-chan NotificationPayload]SubscriptionFilter)
+	}
+	for _, opt := range opts {
+		if opt != nil {
+			opt(s)
+		}
 	}
+	return s
+}
+
+func (s *SubscriptionService) shard(userDID string) *subscriptionShard {
+	return &s.shards[maphash.String(s.seed, userDID)&(subscriptionShards-1)]
 }
 
 func (s *SubscriptionService) Subscribe(userDID string) (<-chan NotificationPayload, error) {
-	s.lock.Lock()
-	defer s.lock.Unlock()
+	return s.SubscribeWithFilter(userDID, SubscriptionFilter{})
+}
+
+// SubscribeWithFilter opens subscription of userDID which gets only notifications matching the filter
+func (s *SubscriptionService) SubscribeWithFilter(userDID string, filter SubscriptionFilter) (<-chan NotificationPayload, error) {
+	shard := s.shard(userDID)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+
+	if s.closed.Load() {
+		return nil, ErrSubscriptionsClosed
+	}
 
 	subscriber := NewSubscriber(userDID)
+	channels := shard.subscribers[subscriber]
 	// Check if max subscriptions reached
 	// if maxSubscriptionsPerUser is 0, then unlimited subscriptions are allowed
 	if s.maxSubscriptionsPerUser > 0 &&
-		len(s.subscribers[subscriber]) >= s.maxSubscriptionsPerUser {
+		len(channels) >= s.maxSubscriptionsPerUser {
 		return nil, fmt.Errorf("%w: allowed connections: %v",
 			ErrMaxSubscriptionsReached, s.maxSubscriptionsPerUser)
 	}
 
 	ch := make(chan NotificationPayload, s.channelBufferSize)
-	s.subscribers[subscriber] = append(s.subscribers[subscriber], ch)
+	if !filter.IsEmpty() {
+		shard.filters[ch] = filter
+	}
+	shard.positions[ch] = len(channels)
+	shard.subscribers[subscriber] = append(channels, ch)
 	return ch, nil
 }
 
 func (s *SubscriptionService) Unsubscribe(userDID string, uch <-chan NotificationPayload) {
-	s.lock.Lock()
-	defer s.lock.Unlock()
+	shard := s.shard(userDID)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
 
-	subscriber := NewSubscriber(userDID)
-	channels, ok := s.subscribers[subscriber]
-	if !ok {
-		return
+	// subscription could be already closed by the service
+	delete(shard.closeReasons, uch)
+	if c, ok := shard.remove(NewSubscriber(userDID), uch); ok {
+		close(c)
 	}
+}
 
-	for idx, c := range channels {
-		// nolint:gocritic // breaking loop is intended here
-		if c == uch {
-			// https://go.dev/wiki/SliceTricks to prevent memory leak
-			close(c)
-			copy(channels[idx:], channels[idx+1:])
-			channels[len(channels)-1] = nil
-			s.subscribers[subscriber] = channels[:len(channels)-1]
-			break
-		}
+// remove deletes subscription channel of subscriber. Must be called with the write lock.
+func (shard *subscriptionShard) remove(subscriber Subscriber, uch <-chan NotificationPayload) (chan NotificationPayload, bool) {
+	channels := shard.subscribers[subscriber]
+	idx, ok := shard.positions[uch]
+	if !ok || idx >= len(channels) || channels[idx] != uch {
+		return nil, false
+	}
+	delete(shard.positions, uch)
+	delete(shard.filters, uch)
+
+	// the last channel takes place of the removed one
+	c, last := channels[idx], len(channels)-1
+	if idx != last {
+		channels[idx] = channels[last]
+		shard.positions[channels[idx]] = idx
 	}
+	channels[last] = nil
+	channels = channels[:last]
 
 	// if no more channels, remove subscriber entry
-	if len(s.subscribers[subscriber]) == 0 {
-		delete(s.subscribers, subscriber)
+	if len(channels) == 0 {
+		delete(shard.subscribers, subscriber)
+		return c, true
 	}
+	shard.subscribers[subscriber] = channels
+	return c, true
 }
 
-func (s *SubscriptionService) Notify(userDID string, payload NotificationPayload) {
-	s.lock.RLock()
-	defer s.lock.RUnlock()
+// CloseReason returns why the subscription channel of userDID was closed by the service
+func (s *SubscriptionService) CloseReason(userDID string, uch <-chan NotificationPayload) string {
+	shard := s.shard(userDID)
+	shard.lock.RLock()
+	defer shard.lock.RUnlock()
 
-	if channels, exists := s.subscribers[NewSubscriber(userDID)]; exists {
-		for _, c := range channels {
-			select {
-			case c <- payload:
-			default:
-				log.Warnf("Notification dropped for user %s: channel is full", userDID)
+	if reason, ok := shard.closeReasons[uch]; ok {
+		return reason
+	}
+	return CloseReasonUnsubscribed
+}
+
+// UnsubscribeAll closes all subscriptions of userDID. Returns number of closed subscriptions.
+func (s *SubscriptionService) UnsubscribeAll(userDID string) int {
+	shard := s.shard(userDID)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+
+	subscriber := NewSubscriber(userDID)
+	channels := shard.subscribers[subscriber]
+	for _, c := range channels {
+		delete(shard.positions, c)
+		delete(shard.filters, c)
+		close(c)
+	}
+	delete(shard.subscribers, subscriber)
+	return len(channels)
+}
+
+// CloseAll closes subscriptions of all users with the reason and rejects new subscriptions.
+// Returns number of closed subscriptions.
+func (s *SubscriptionService) CloseAll(reason string) int {
+	s.closed.Store(true)
+
+	closed := 0
+	for i := range s.shards {
+		shard := &s.shards[i]
+		shard.lock.Lock()
+		for subscriber, channels := range shard.subscribers {
+			for _, c := range channels {
+				delete(shard.positions, c)
+				delete(shard.filters, c)
+				shard.closeReasons[c] = reason
+				close(c)
 			}
+			closed += len(channels)
+			delete(shard.subscribers, subscriber)
+		}
+		shard.lock.Unlock()
+	}
+	return closed
+}
+
+// Notify sends payload to subscriptions of userDID whose filter matches it.
+// Returns false if no subscription of the user on this replica matches the payload.
+func (s *SubscriptionService) Notify(userDID string, payload NotificationPayload) bool {
+	var slow []chan NotificationPayload
+
+	shard := s.shard(userDID)
+	shard.lock.RLock()
+	matched := false
+	for _, c := range shard.subscribers[NewSubscriber(userDID)] {
+		if f, ok := shard.filters[c]; ok && !f.Match(payload) {
+			continue
+		}
+		matched = true
+		select {
+		case c <- payload:
+			subscriptionMetrics.Add(metricDelivered, 1)
+			continue
+		default:
+		}
+
+		policy := s.slowConsumerPolicy
+		if cap(c) == 0 {
+			// nothing is buffered to drop or coalesce
+			policy = SlowConsumerDropNewest
+		}
+		switch policy {
+		case SlowConsumerDropOldest:
+			dropOldest(c, payload)
+		case SlowConsumerCoalesce:
+			coalesce(c, payload)
+		case SlowConsumerDisconnect:
+			// closing requires the write lock
+			slow = append(slow, c)
+		default:
+			log.Warnf("Notification dropped for user %s: channel is full", userDID)
+			subscriptionMetrics.Add(string(SlowConsumerDropNewest), 1)
+		}
+	}
+	shard.lock.RUnlock()
+
+	for _, c := range slow {
+		log.Warnf("Subscription of user %s closed: channel is full", userDID)
+		s.disconnect(userDID, c, CloseReasonSlowConsumer)
+	}
+	return matched
+}
+
+// disconnect closes subscription channel unless it's already unsubscribed.
+// Buffered notifications are still delivered.
+func (s *SubscriptionService) disconnect(userDID string, uch <-chan NotificationPayload, reason string) {
+	shard := s.shard(userDID)
+	shard.lock.Lock()
+	defer shard.lock.Unlock()
+
+	c, ok := shard.remove(NewSubscriber(userDID), uch)
+	if !ok {
+		return
+	}
+	shard.closeReasons[c] = reason
+	close(c)
+	subscriptionMetrics.Add(string(SlowConsumerDisconnect), 1)
+}
+
+// coalescedCount returns number of new notifications in the event.
+// Clients reload inbox on coalesced event, so read and delete events aren't counted.
+func coalescedCount(payload NotificationPayload) int {
+	switch payload.Event {
+	case "":
+		return 1
+	case EventNotificationsCoalesced:
+		return payload.Count
+	default:
+		return 0
+	}
+}
+
+// dropOldest drops buffered notifications until payload fits into the channel
+func dropOldest(c chan NotificationPayload, payload NotificationPayload) {
+	for {
+		select {
+		case c <- payload:
+			return
+		default:
+		}
+		select {
+		case <-c:
+			subscriptionMetrics.Add(string(SlowConsumerDropOldest), 1)
+		default:
+		}
+	}
+}
+
+// coalesce replaces buffered notifications and payload with a single event with their number.
+// The event has ID of payload, so events replayed after it are newer than the coalesced ones.
+func coalesce(c chan NotificationPayload, payload NotificationPayload) {
+	event := NotificationPayload{Event: EventNotificationsCoalesced, EventID: payload.EventID}
+	event.Count = coalescedCount(payload)
+	for {
+		select {
+		case buffered := <-c:
+			event.Count += coalescedCount(buffered)
+			continue
+		default:
+		}
+		select {
+		case c <- event:
+			subscriptionMetrics.Add(string(SlowConsumerCoalesce), 1)
+			return
+		default:
 		}
 	}
 }
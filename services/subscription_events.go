@@ -0,0 +1,52 @@
+package services
+
+import (
+	"context"
+
+	"github.com/iden3/notification-service/log"
+)
+
+// Types of events sent to subscriptions besides new notifications
+const (
+	// EventNotificationRead is sent when notifications are read on one of user devices
+	EventNotificationRead = "notification_read"
+	// EventNotificationDeleted is sent when notifications are removed from the inbox
+	EventNotificationDeleted = "notification_deleted"
+	// EventNotificationsCoalesced replaces events buffered for slow subscriber
+	EventNotificationsCoalesced = "coalesced_notifications"
+)
+
+// Reasons why notifications were removed from the inbox
+const (
+	DeleteReasonDeleted = "deleted"
+	DeleteReasonEvicted = "evicted"
+	DeleteReasonExpired = "expired"
+)
+
+// NewReadEvent creates event about notifications read by the owner
+func NewReadEvent(ids []string) NotificationPayload {
+	return NotificationPayload{Event: EventNotificationRead, IDs: ids}
+}
+
+// NewDeletedEvent creates event about notifications removed from the inbox
+func NewDeletedEvent(ids []string, reason string) NotificationPayload {
+	return NotificationPayload{Event: EventNotificationDeleted, IDs: ids, Reason: reason}
+}
+
+// publishEvent sends the event to subscriptions of userDID and returns the event with ID.
+// Logged events get ID, so reconnected clients replay them.
+// Returns false if the user has no subscriptions.
+func publishEvent(ctx context.Context, sub subscriptionService, l eventLog,
+	userDID string, payload NotificationPayload) (NotificationPayload, bool) {
+	if sub == nil {
+		return payload, false
+	}
+	if l != nil {
+		id, err := l.Append(ctx, userDID, payload)
+		if err != nil {
+			log.WithContext(ctx).Warnf("failed to log subscription event: %v", err)
+		}
+		payload.EventID = id
+	}
+	return payload, sub.Notify(userDID, payload)
+}
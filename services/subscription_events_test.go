@@ -0,0 +1,139 @@
+package services
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type subscriptionRecorder struct {
+	lock   sync.Mutex
+	events map[string][]NotificationPayload
+	// offline users have no subscriptions, their events are recorded but not delivered
+	offline map[string]bool
+}
+
+func (s *subscriptionRecorder) Notify(userDID string, payload NotificationPayload) bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.events == nil {
+		s.events = make(map[string][]NotificationPayload)
+	}
+	s.events[userDID] = append(s.events[userDID], payload)
+	return !s.offline[userDID]
+}
+
+func (s *subscriptionRecorder) take(userDID string) []NotificationPayload {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	events := s.events[userDID]
+	delete(s.events, userDID)
+	return events
+}
+
+func TestInbox_SyncEvents(t *testing.T) {
+	ctx := context.Background()
+	userDID := "did:example:1"
+	start := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	storage := &InboxStorageMock{}
+	storage.add(t, "did:example:1+a", start, false)
+	storage.add(t, "did:example:1+b", start.Add(time.Minute), false)
+	storage.add(t, "did:example:1+c", start.Add(2*time.Minute), true)
+	sub := &subscriptionRecorder{}
+	inbox := NewInboxService(storage, WithSyncEvents(sub, nil))
+
+	require.NoError(t, inbox.Ack(ctx, userDID, "did:example:1+a"))
+	require.Equal(t, []NotificationPayload{NewReadEvent([]string{"did:example:1+a"})}, sub.take(userDID))
+
+	// notifications without owner have no subscriptions to sync
+	anonymous := &InboxStorageMock{}
+	anonymous.add(t, "anonymous", start, false)
+	require.NoError(t, NewInboxService(anonymous, WithSyncEvents(sub, nil)).Ack(ctx, "", "anonymous"))
+	require.Empty(t, sub.events)
+
+	// only notifications that were unread are sent
+	_, err := inbox.MarkAsRead(ctx, userDID, InboxReadRequest{IDs: []string{"did:example:1+b", "did:example:1+c"}})
+	require.NoError(t, err)
+	require.Equal(t, []NotificationPayload{NewReadEvent([]string{"did:example:1+b"})}, sub.take(userDID))
+	_, err = inbox.MarkAsRead(ctx, userDID, InboxReadRequest{IDs: []string{"did:example:1+b"}})
+	require.NoError(t, err)
+	require.Empty(t, sub.take(userDID))
+
+	require.NoError(t, inbox.Delete(ctx, userDID, "did:example:1+a"))
+	require.Equal(t, []NotificationPayload{
+		NewDeletedEvent([]string{"did:example:1+a"}, DeleteReasonDeleted),
+	}, sub.take(userDID))
+
+	isRead := true
+	_, err = inbox.DeleteAll(ctx, userDID, InboxDeleteFilter{IsRead: &isRead})
+	require.NoError(t, err)
+	require.Equal(t, []NotificationPayload{
+		NewDeletedEvent([]string{"did:example:1+b", "did:example:1+c"}, DeleteReasonDeleted),
+	}, sub.take(userDID))
+}
+
+func TestNotificationService_SyncEvents(t *testing.T) {
+	l, _ := newTestEventLog(t, 100)
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	cs, err := NewCryptoService(privateKey)
+	require.NoError(t, err)
+	sub := &subscriptionRecorder{}
+
+	notificationService := NewNotificationService(
+		NewPushClient(http.DefaultClient, "http://localhost"),
+		cs,
+		RedisMock{saved: SaveResult{Evicted: []string{"did:example:1+old"}, Expired: []string{"did:example:1+expired"}}},
+		"http://host",
+		time.Hour*24,
+		sub,
+		[]string{"iden3.web.browser"},
+		WithEventLog(l),
+	)
+
+	encodedDevice, err := json.Marshal(Device{
+		AppID:    "iden3.web.browser",
+		Pushkey:  "did:example:1",
+		UniqueID: "did:example:1",
+	})
+	require.NoError(t, err)
+	ciphertext, err := notificationService.cryptoService.Encrypt(encodedDevice)
+	require.NoError(t, err)
+
+	res, ids := notificationService.SendNotification(context.Background(), &PushNotification{
+		Message: []byte(`{}`),
+		PushMetadata: PushMetadata{
+			Devices: []EncryptedDeviceMetadata{
+				{
+					Ciphertext: base64.StdEncoding.EncodeToString(ciphertext),
+					Alg:        rsaAlg,
+				},
+			},
+		},
+	})
+	require.Len(t, res, 1)
+	require.Len(t, ids, 1)
+
+	events := sub.take("did:example:1")
+	require.Len(t, events, 3)
+	require.Equal(t, EventNotificationDeleted, events[0].Event)
+	require.Equal(t, DeleteReasonEvicted, events[0].Reason)
+	require.Equal(t, []string{"did:example:1+old"}, events[0].IDs)
+	require.Equal(t, DeleteReasonExpired, events[1].Reason)
+	require.Equal(t, []string{"did:example:1+expired"}, events[1].IDs)
+	require.Empty(t, events[2].Event)
+	require.Equal(t, ids[0], events[2].ID)
+
+	// events are logged for replay
+	logged, err := l.Since(context.Background(), "did:example:1", "0-1")
+	require.NoError(t, err)
+	require.Equal(t, events, logged)
+}
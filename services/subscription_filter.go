@@ -0,0 +1,58 @@
+package services
+
+import (
+	"encoding/json"
+	"slices"
+)
+
+// NotificationAttributes are fields of iden3comm message used to filter subscriptions.
+// They are empty for messages which are not plain JSON, like encrypted ones.
+type NotificationAttributes struct {
+	Type     string `json:"type,omitempty"`
+	ThreadID string `json:"thid,omitempty"`
+	From     string `json:"from,omitempty"`
+}
+
+// IsEmpty reports whether no attribute is set
+func (a NotificationAttributes) IsEmpty() bool {
+	return a == NotificationAttributes{}
+}
+
+// messageAttributes extracts filtering attributes from the message of sender
+func messageAttributes(message json.RawMessage) NotificationAttributes {
+	var attrs NotificationAttributes
+	if err := json.Unmarshal(message, &attrs); err != nil {
+		return NotificationAttributes{}
+	}
+	return attrs
+}
+
+// SubscriptionFilter selects new notifications delivered to a subscription by attributes
+// of their messages. A notification matches if every non-empty field of the filter contains
+// its attribute. Inbox sync events are delivered to every subscription.
+type SubscriptionFilter struct {
+	Types     []string `json:"types,omitempty"`
+	ThreadIDs []string `json:"thid,omitempty"`
+	From      []string `json:"from,omitempty"`
+}
+
+// IsEmpty reports whether the filter matches every notification
+func (f SubscriptionFilter) IsEmpty() bool {
+	return len(f.Types) == 0 && len(f.ThreadIDs) == 0 && len(f.From) == 0
+}
+
+// Match reports whether payload is delivered to subscription with the filter
+func (f SubscriptionFilter) Match(payload NotificationPayload) bool {
+	if payload.Event != "" {
+		// clients keep views in sync with inbox on read and delete events
+		return true
+	}
+	attrs := payload.Attributes
+	return matchAttribute(f.Types, attrs.Type) &&
+		matchAttribute(f.ThreadIDs, attrs.ThreadID) &&
+		matchAttribute(f.From, attrs.From)
+}
+
+func matchAttribute(values []string, attr string) bool {
+	return len(values) == 0 || slices.Contains(values, attr)
+}
@@ -0,0 +1,80 @@
+package services
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMessageAttributes(t *testing.T) {
+	attrs := messageAttributes([]byte(`{
+		"type": "https://iden3-communication.io/credentials/1.0/offer",
+		"thid": "thread-1",
+		"from": "did:example:issuer",
+		"body": {}
+	}`))
+	require.Equal(t, NotificationAttributes{
+		Type:     "https://iden3-communication.io/credentials/1.0/offer",
+		ThreadID: "thread-1",
+		From:     "did:example:issuer",
+	}, attrs)
+
+	// encrypted messages have no attributes
+	require.True(t, messageAttributes([]byte(`"eyJhbGciOiJSU0EtT0FFUC0yNTYifQ"`)).IsEmpty())
+	require.True(t, messageAttributes([]byte(`not json`)).IsEmpty())
+}
+
+func TestSubscriptionFilter_Match(t *testing.T) {
+	offer := NotificationPayload{ID: "1", Attributes: NotificationAttributes{
+		Type: "offer", ThreadID: "thread-1", From: "did:example:issuer",
+	}}
+	encrypted := NotificationPayload{ID: "2"}
+
+	require.True(t, SubscriptionFilter{}.Match(offer))
+	require.True(t, SubscriptionFilter{}.Match(encrypted))
+	require.True(t, SubscriptionFilter{Types: []string{"auth", "offer"}}.Match(offer))
+	require.False(t, SubscriptionFilter{Types: []string{"auth"}}.Match(offer))
+	require.False(t, SubscriptionFilter{Types: []string{"offer"}}.Match(encrypted))
+	// every filter field has to match
+	require.True(t, SubscriptionFilter{
+		Types: []string{"offer"}, ThreadIDs: []string{"thread-1"}, From: []string{"did:example:issuer"},
+	}.Match(offer))
+	require.False(t, SubscriptionFilter{
+		Types: []string{"offer"}, From: []string{"did:example:other"},
+	}.Match(offer))
+	// sync events are delivered to every subscription
+	require.True(t, SubscriptionFilter{Types: []string{"auth"}}.Match(NewReadEvent([]string{"1"})))
+}
+
+func TestNotify_Filter(t *testing.T) {
+	service := NewSubscriptionService(10, 10)
+	userDID := "did:example:123"
+
+	offers, err := service.SubscribeWithFilter(userDID, SubscriptionFilter{Types: []string{"offer"}})
+	require.NoError(t, err)
+	all, err := service.Subscribe(userDID)
+	require.NoError(t, err)
+
+	offer := NotificationPayload{ID: "1", Attributes: NotificationAttributes{Type: "offer"}}
+	auth := NotificationPayload{ID: "2", Attributes: NotificationAttributes{Type: "auth"}}
+	read := NewReadEvent([]string{"1"})
+	require.True(t, service.Notify(userDID, offer))
+	require.True(t, service.Notify(userDID, auth))
+	require.True(t, service.Notify(userDID, read))
+
+	require.Equal(t, []NotificationPayload{offer, read}, receiveAll(offers))
+	require.Equal(t, []NotificationPayload{offer, auth, read}, receiveAll(all))
+
+	// notification isn't delivered if no filter matches it
+	service.Unsubscribe(userDID, all)
+	require.False(t, service.Notify(userDID, auth))
+	require.True(t, service.Notify(userDID, offer))
+	require.Equal(t, []NotificationPayload{offer}, receiveAll(offers))
+
+	// filter is dropped with the subscription
+	service.Unsubscribe(userDID, offers)
+	shard := service.shard(userDID)
+	shard.lock.RLock()
+	require.Empty(t, shard.filters)
+	shard.lock.RUnlock()
+}
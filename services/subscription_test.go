@@ -1,7 +1,10 @@
 package services
 
 import (
+	"expvar"
+	"fmt"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -58,7 +61,7 @@ func TestNotify_MultipleSubscribersForSameUser(t *testing.T) {
 	// Give goroutines time to start waiting on channels
 	time.Sleep(50 * time.Millisecond)
 
-	service.Notify(userDID, payload)
+	require.True(t, service.Notify(userDID, payload))
 	wg.Wait()
 }
 
@@ -68,7 +71,7 @@ func TestNotify_NoSubscribers(t *testing.T) {
 	payload := NotificationPayload{ID: "3"}
 
 	// Should not panic or block
-	service.Notify(userDID, payload)
+	require.False(t, service.Notify(userDID, payload))
 }
 
 func TestNotify_DifferentUsers(t *testing.T) {
@@ -98,3 +101,233 @@ func TestNotify_DifferentUsers(t *testing.T) {
 		// Expected - user2 should not receive anything
 	}
 }
+
+func TestUnsubscribeAll(t *testing.T) {
+	service := NewSubscriptionService(10, 10)
+	userDID := "did:example:123"
+
+	ch1, err := service.Subscribe(userDID)
+	require.NoError(t, err)
+	ch2, err := service.Subscribe(userDID)
+	require.NoError(t, err)
+
+	require.Equal(t, 2, service.UnsubscribeAll(userDID))
+	_, ok := <-ch1
+	require.False(t, ok)
+	_, ok = <-ch2
+	require.False(t, ok)
+
+	// subscription handler unsubscribes after the channel is closed
+	service.Unsubscribe(userDID, ch1)
+	require.Zero(t, service.UnsubscribeAll(userDID))
+}
+
+func TestUnsubscribe_KeepsOtherSubscriptions(t *testing.T) {
+	service := NewSubscriptionService(3, 10)
+	userDID := "did:example:123"
+
+	channels := make([]<-chan NotificationPayload, 3)
+	for i := range channels {
+		var err error
+		channels[i], err = service.Subscribe(userDID)
+		require.NoError(t, err)
+	}
+
+	service.Unsubscribe(userDID, channels[0])
+	// unknown and already removed channels are ignored
+	service.Unsubscribe(userDID, channels[0])
+	service.Unsubscribe("did:example:other", channels[1])
+
+	service.Notify(userDID, NotificationPayload{ID: "1"})
+	_, ok := <-channels[0]
+	require.False(t, ok)
+	for _, ch := range channels[1:] {
+		require.Equal(t, []NotificationPayload{{ID: "1"}}, receiveAll(ch))
+	}
+
+	service.Unsubscribe(userDID, channels[2])
+	service.Notify(userDID, NotificationPayload{ID: "2"})
+	require.Equal(t, []NotificationPayload{{ID: "2"}}, receiveAll(channels[1]))
+	require.Equal(t, 1, service.UnsubscribeAll(userDID))
+}
+
+func TestCloseAll(t *testing.T) {
+	service := NewSubscriptionService(10, 10)
+
+	ch1, err := service.Subscribe("did:example:1")
+	require.NoError(t, err)
+	ch2, err := service.Subscribe("did:example:2")
+	require.NoError(t, err)
+
+	require.Equal(t, 2, service.CloseAll(CloseReasonServerShutdown))
+	for userDID, ch := range map[string]<-chan NotificationPayload{"did:example:1": ch1, "did:example:2": ch2} {
+		_, ok := <-ch
+		require.False(t, ok)
+		require.Equal(t, CloseReasonServerShutdown, service.CloseReason(userDID, ch))
+		service.Unsubscribe(userDID, ch)
+	}
+
+	_, err = service.Subscribe("did:example:1")
+	require.ErrorIs(t, err, ErrSubscriptionsClosed)
+}
+
+func metricValue(name string) int64 {
+	if v, ok := subscriptionMetrics.Get(name).(*expvar.Int); ok {
+		return v.Value()
+	}
+	return 0
+}
+
+func receiveAll(ch <-chan NotificationPayload) []NotificationPayload {
+	var received []NotificationPayload
+	for {
+		select {
+		case p, ok := <-ch:
+			if !ok {
+				return received
+			}
+			received = append(received, p)
+		default:
+			return received
+		}
+	}
+}
+
+func TestNotify_SlowConsumerPolicy(t *testing.T) {
+	userDID := "did:example:123"
+	notify := func(service *SubscriptionService) {
+		for _, id := range []string{"1", "2", "3"} {
+			service.Notify(userDID, NotificationPayload{ID: id, EventID: id + "-0"})
+		}
+	}
+
+	tests := []struct {
+		policy   SlowConsumerPolicy
+		expected []NotificationPayload
+	}{
+		{
+			policy: SlowConsumerDropNewest,
+			expected: []NotificationPayload{
+				{ID: "1", EventID: "1-0"},
+				{ID: "2", EventID: "2-0"},
+			},
+		},
+		{
+			policy: SlowConsumerDropOldest,
+			expected: []NotificationPayload{
+				{ID: "2", EventID: "2-0"},
+				{ID: "3", EventID: "3-0"},
+			},
+		},
+		{
+			policy: SlowConsumerCoalesce,
+			expected: []NotificationPayload{
+				{Event: EventNotificationsCoalesced, EventID: "3-0", Count: 3},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(string(tt.policy), func(t *testing.T) {
+			require.NoError(t, tt.policy.Validate())
+			service := NewSubscriptionService(10, 2, WithSlowConsumerPolicy(tt.policy))
+			ch, err := service.Subscribe(userDID)
+			require.NoError(t, err)
+
+			before := metricValue(string(tt.policy))
+			notify(service)
+			require.Equal(t, tt.expected, receiveAll(ch))
+			require.Greater(t, metricValue(string(tt.policy)), before)
+
+			// notifications are delivered again when the buffer is read
+			service.Notify(userDID, NotificationPayload{ID: "4"})
+			require.Len(t, receiveAll(ch), 1)
+		})
+	}
+
+	require.Error(t, SlowConsumerPolicy("unknown").Validate())
+}
+
+func TestNotify_SlowConsumerDisconnect(t *testing.T) {
+	userDID := "did:example:123"
+	service := NewSubscriptionService(1, 2, WithSlowConsumerPolicy(SlowConsumerDisconnect))
+	ch, err := service.Subscribe(userDID)
+	require.NoError(t, err)
+
+	for _, id := range []string{"1", "2", "3"} {
+		service.Notify(userDID, NotificationPayload{ID: id})
+	}
+
+	// buffered notifications are delivered before the channel is closed
+	require.Equal(t, []NotificationPayload{{ID: "1"}, {ID: "2"}}, receiveAll(ch))
+	_, ok := <-ch
+	require.False(t, ok)
+	require.Equal(t, CloseReasonSlowConsumer, service.CloseReason(userDID, ch))
+
+	// the slot is released before the client unsubscribes
+	ch2, err := service.Subscribe(userDID)
+	require.NoError(t, err)
+	service.Unsubscribe(userDID, ch)
+	require.Equal(t, CloseReasonUnsubscribed, service.CloseReason(userDID, ch))
+	service.Unsubscribe(userDID, ch2)
+}
+
+const benchmarkSubscribers = 10000
+
+func benchmarkDIDs() []string {
+	dids := make([]string, benchmarkSubscribers)
+	for i := range dids {
+		dids[i] = fmt.Sprintf("did:example:%d", i)
+	}
+	return dids
+}
+
+// BenchmarkSubscriptionService_Churn opens, notifies and closes subscriptions of different users concurrently
+func BenchmarkSubscriptionService_Churn(b *testing.B) {
+	service := NewSubscriptionService(10, 10)
+	dids := benchmarkDIDs()
+	var next atomic.Int64
+
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			userDID := dids[next.Add(1)%benchmarkSubscribers]
+			ch, err := service.Subscribe(userDID)
+			if err != nil {
+				continue
+			}
+			service.Notify(userDID, NotificationPayload{ID: "1"})
+			service.Unsubscribe(userDID, ch)
+		}
+	})
+}
+
+// BenchmarkSubscriptionService_NotifyWithChurn notifies users with open subscriptions
+// while other subscriptions are opened and closed
+func BenchmarkSubscriptionService_NotifyWithChurn(b *testing.B) {
+	service := NewSubscriptionService(0, 10, WithSlowConsumerPolicy(SlowConsumerDropOldest))
+	dids := benchmarkDIDs()
+	for _, userDID := range dids {
+		if _, err := service.Subscribe(userDID); err != nil {
+			b.Fatal(err)
+		}
+	}
+	var next atomic.Int64
+
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			n := next.Add(1)
+			userDID := dids[n%benchmarkSubscribers]
+			if n%4 != 0 {
+				service.Notify(userDID, NotificationPayload{ID: "1"})
+				continue
+			}
+			ch, err := service.Subscribe(userDID)
+			if err != nil {
+				b.Error(err)
+				return
+			}
+			service.Unsubscribe(userDID, ch)
+		}
+	})
+}